@@ -0,0 +1,205 @@
+package innpark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/studiogenesisprojects/lib-innpark/plate"
+)
+
+// AccessPassStatus is the lifecycle state of an access pass item.
+type AccessPassStatus string
+
+const (
+	ACCESS_PASS_STATUS_UNUSED      AccessPassStatus = "unused"
+	ACCESS_PASS_STATUS_ACTIVE      AccessPassStatus = "active"
+	ACCESS_PASS_STATUS_DEACTIVATED AccessPassStatus = "deactivated"
+	ACCESS_PASS_STATUS_CANCELLED   AccessPassStatus = "cancelled"
+	ACCESS_PASS_STATUS_EXPIRED     AccessPassStatus = "expired"
+)
+
+// AccessPassMetadata is the decoded AccessPassItem.Metadata. Keys the
+// library does not know are kept in Extra.
+type AccessPassMetadata struct {
+	PlanName    string      `json:"plan_name"`
+	PackName    string      `json:"pack_name"`
+	ParkingIds  []string    `json:"parking_ids"`
+	VehicleType VehicleType `json:"vehicle_type"`
+	Amount      int         `json:"amount"`
+	PaymentId   string      `json:"payment_id"`
+	PurchasedAt DateTime    `json:"purchased_at"`
+
+	Extra map[string]any `json:"-"`
+}
+
+// ParsedMetadata decodes Metadata. An empty Metadata decodes to the zero
+// AccessPassMetadata.
+func (a AccessPassItem) ParsedMetadata() (AccessPassMetadata, error) {
+	var metadata AccessPassMetadata
+	if strings.TrimSpace(a.Metadata) == "" {
+		return metadata, nil
+	}
+
+	if err := json.Unmarshal([]byte(a.Metadata), &metadata); err != nil {
+		return AccessPassMetadata{}, fmt.Errorf("innpark: access pass %s metadata: %w", a.Id, err)
+	}
+	if err := json.Unmarshal([]byte(a.Metadata), &metadata.Extra); err != nil {
+		return AccessPassMetadata{}, fmt.Errorf("innpark: access pass %s metadata: %w", a.Id, err)
+	}
+	for _, key := range []string{"plan_name", "pack_name", "parking_ids", "vehicle_type", "amount", "payment_id", "purchased_at"} {
+		delete(metadata.Extra, key)
+	}
+
+	return metadata, nil
+}
+
+// ErrInvalidAccessPassEnd is returned by ExtendAccessPass for an end that
+// does not come after the current one.
+var ErrInvalidAccessPassEnd = errors.New("innpark: invalid access pass end")
+
+// AccessPassPack is a bundle of access passes of a plan, used up item by
+// item.
+type AccessPassPack struct {
+	Id               string   `json:"id"`
+	AccessPassPlanId string   `json:"access_pass_plan_id"`
+	UserId           string   `json:"user_id"`
+	Quantity         int      `json:"quantity"`
+	Consumed         int      `json:"consumed"`
+	ExpiresAt        DateTime `json:"expires_at"`
+}
+
+// Remaining returns how many passes are left in the pack.
+func (p AccessPassPack) Remaining() int {
+	return max(p.Quantity-p.Consumed, 0)
+}
+
+// The lifecycle calls below follow ActivateAccessPass: a POST to
+// /v1/access-passes-items/<action> with the arguments as camelCase query
+// parameters and no body.
+
+// DeactivateAccessPass stops an active pass item before it ends. Onstreet
+// decides whether the unused time is kept.
+func (c *Client) DeactivateAccessPass(ctx context.Context, accessPassItemId string) (AccessPassItem, error) {
+	return c.accessPassItemAction(ctx, "DeactivateAccessPass", "deactivate", accessPassItemId, url.Values{})
+}
+
+// CancelAccessPass cancels a pass item for good, e.g. after a refund.
+func (c *Client) CancelAccessPass(ctx context.Context, accessPassItemId string, reason string) (AccessPassItem, error) {
+	query := url.Values{}
+	if reason != "" {
+		query.Set("reason", reason)
+	}
+	return c.accessPassItemAction(ctx, "CancelAccessPass", "cancel", accessPassItemId, query)
+}
+
+// ExtendAccessPass moves the end of a pass item to toDate, which must come
+// after its current end. Passes without an end cannot be extended.
+func (c *Client) ExtendAccessPass(ctx context.Context, accessPassItemId string, toDate time.Time) (AccessPassItem, error) {
+	current, err := c.GetAccessPassItem(ctx, accessPassItemId)
+	if err != nil {
+		return AccessPassItem{}, err
+	}
+	if current.ToDate.IsZero() {
+		return AccessPassItem{}, fmt.Errorf("%w: access pass %s never ends", ErrInvalidAccessPassEnd, accessPassItemId)
+	}
+	if !toDate.After(current.ToDate.End()) {
+		return AccessPassItem{}, fmt.Errorf("%w: %s is not after the end of access pass %s, %s", ErrInvalidAccessPassEnd, FormatDateTime(toDate), accessPassItemId, current.ToDate)
+	}
+
+	return c.accessPassItemAction(ctx, "ExtendAccessPass", "extend", accessPassItemId, url.Values{"toDate": {FormatDateTime(toDate)}})
+}
+
+// TransferAccessPass moves a pass item to another plate, which is
+// normalized, see plate.Clean.
+func (c *Client) TransferAccessPass(ctx context.Context, accessPassItemId string, vehiclePlate string) (AccessPassItem, error) {
+	vehiclePlate, err := plate.Clean(vehiclePlate)
+	if err != nil {
+		return AccessPassItem{}, err
+	}
+
+	return c.accessPassItemAction(ctx, "TransferAccessPass", "transfer", accessPassItemId, url.Values{"plate": {vehiclePlate}})
+}
+
+// GetAccessPassItem returns the pass item with the given id.
+func (c *Client) GetAccessPassItem(ctx context.Context, accessPassItemId string) (AccessPassItem, error) {
+	url, err := c.recordURL(BACKEND_ONSTREET, "access_passes_items", accessPassItemId)
+	if err != nil {
+		return AccessPassItem{}, err
+	}
+
+	var accessPass AccessPassItem
+	if err := c.doJSON(ctx, BACKEND_ONSTREET, "GetAccessPassItem", "GET", url, nil, &accessPass); err != nil {
+		return AccessPassItem{}, err
+	}
+
+	return accessPass, nil
+}
+
+// GetAccessPassHistory returns every pass item of the user, the most recent
+// first.
+func (c *Client) GetAccessPassHistory(ctx context.Context, userId string) ([]AccessPassItem, error) {
+	query := NewQuery().Where(Eq("user_id", userId)).Sort("-from_date", "-created")
+
+	return collect(iterate[AccessPassItem](ctx, c, BACKEND_ONSTREET, "GetAccessPassHistory", "access_passes_items", query))
+}
+
+// GetAccessPassPack returns the pack with the given id.
+func (c *Client) GetAccessPassPack(ctx context.Context, accessPassPackId string) (AccessPassPack, error) {
+	url, err := c.recordURL(BACKEND_ONSTREET, "access_passes_packs", accessPassPackId)
+	if err != nil {
+		return AccessPassPack{}, err
+	}
+
+	var pack AccessPassPack
+	if err := c.doJSON(ctx, BACKEND_ONSTREET, "GetAccessPassPack", "GET", url, nil, &pack); err != nil {
+		return AccessPassPack{}, err
+	}
+
+	return pack, nil
+}
+
+// ConsumeAccessPassPack takes quantity passes out of the pack for the plate,
+// starting at startAt, and returns the pass items created.
+func (c *Client) ConsumeAccessPassPack(ctx context.Context, accessPassPackId string, quantity int, vehiclePlate string, startAt time.Time) ([]AccessPassItem, error) {
+	if quantity <= 0 {
+		return nil, fmt.Errorf("innpark: consuming %d passes from pack %s", quantity, accessPassPackId)
+	}
+
+	vehiclePlate, err := plate.Clean(vehiclePlate)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"accessPassPackId": {accessPassPackId},
+		"quantity":         {strconv.Itoa(quantity)},
+		"plate":            {vehiclePlate},
+		"startDateTime":    {FormatDateTime(startAt)},
+	}
+	url := fmt.Sprintf("%s/v1/access-passes-packs/consume?%s", c.config.OnstreetURL, query.Encode())
+
+	accessPasses := []AccessPassItem{}
+	if err := c.doIdempotent(ctx, BACKEND_ONSTREET, "ConsumeAccessPassPack", "POST", url, nil, &accessPasses); err != nil {
+		return nil, err
+	}
+
+	return accessPasses, nil
+}
+
+func (c *Client) accessPassItemAction(ctx context.Context, operation string, action string, accessPassItemId string, query url.Values) (AccessPassItem, error) {
+	query.Set("accessPassItemId", accessPassItemId)
+	url := fmt.Sprintf("%s/v1/access-passes-items/%s?%s", c.config.OnstreetURL, action, query.Encode())
+
+	var accessPass AccessPassItem
+	if err := c.doIdempotent(ctx, BACKEND_ONSTREET, operation, "POST", url, nil, &accessPass); err != nil {
+		return AccessPassItem{}, err
+	}
+
+	return accessPass, nil
+}
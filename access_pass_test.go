@@ -0,0 +1,69 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAccessPassLifecycle(t *testing.T) {
+	var requests []*url.URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(`{"id":"a1","from_date":"2024-05-01","to_date":"2024-05-31"}`))
+			return
+		}
+		if r.ContentLength > 0 {
+			t.Errorf("%s sent a body", r.URL.Path)
+		}
+		requests = append(requests, r.URL)
+		w.Write([]byte(`{"id":"a1"}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(Config{OnstreetURL: server.URL})
+	ctx := context.Background()
+
+	// the pass covers the whole of May 31
+	for _, end := range []time.Time{
+		time.Date(2024, 5, 20, 0, 0, 0, 0, Madrid),
+		time.Date(2024, 5, 31, 18, 0, 0, 0, Madrid),
+		time.Date(2024, 6, 1, 0, 0, 0, 0, Madrid),
+	} {
+		if _, err := c.ExtendAccessPass(ctx, "a1", end); !errors.Is(err, ErrInvalidAccessPassEnd) {
+			t.Errorf("extending to %s: got %v, want ErrInvalidAccessPassEnd", end, err)
+		}
+	}
+	if len(requests) != 0 {
+		t.Fatalf("invalid extensions reached onstreet")
+	}
+
+	end := time.Date(2024, 6, 30, 0, 0, 0, 0, Madrid)
+	if _, err := c.ExtendAccessPass(ctx, "a1", end); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CancelAccessPass(ctx, "a1", "refunded"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.TransferAccessPass(ctx, "a1", "5678 bcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		path  string
+		query url.Values
+	}{
+		{"/v1/access-passes-items/extend", url.Values{"accessPassItemId": {"a1"}, "toDate": {FormatDateTime(end)}}},
+		{"/v1/access-passes-items/cancel", url.Values{"accessPassItemId": {"a1"}, "reason": {"refunded"}}},
+		{"/v1/access-passes-items/transfer", url.Values{"accessPassItemId": {"a1"}, "plate": {"5678BCD"}}},
+	}
+	for i, w := range want {
+		if requests[i].Path != w.path || requests[i].Query().Encode() != w.query.Encode() {
+			t.Errorf("got %s, want %s?%s", requests[i], w.path, w.query.Encode())
+		}
+	}
+}
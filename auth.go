@@ -19,8 +19,10 @@ const (
 	ADMIN_TENENT = "INNPARK-ADMINS-07uhs"
 )
 
-func Auth(app core.App, target string) echo.HandlerFunc {
-	return func(c echo.Context) error {
+// Auth returns a handler that exchanges a Firebase ID token for a PocketBase
+// auth response, creating the user record on first login.
+func (c *Client) Auth(app core.App, target string) echo.HandlerFunc {
+	return func(e echo.Context) error {
 
 		tenantToUse := ""
 		switch target {
@@ -32,12 +34,12 @@ func Auth(app core.App, target string) echo.HandlerFunc {
 			return apis.NewUnauthorizedError("invalid tenant", nil)
 		}
 
-		idToken := c.QueryParam("token")
+		idToken := e.QueryParam("token")
 		if idToken == "" {
 			return apis.NewUnauthorizedError("missing token", nil)
 		}
 
-		token, err := veifyFirebaseToken(idToken)
+		token, err := c.veifyFirebaseToken(e.Request().Context(), idToken)
 		if err != nil {
 			return apis.NewUnauthorizedError("invalid token", nil)
 		}
@@ -52,7 +54,7 @@ func Auth(app core.App, target string) echo.HandlerFunc {
 		user, err := app.Dao().FindRecordById(target, userId)
 
 		if err != nil {
-			userInFirebase, err := getFirebaseUser(token.UID, tenantToUse)
+			userInFirebase, err := c.getFirebaseUser(e.Request().Context(), token.UID, tenantToUse)
 			if err != nil {
 				return apis.NewUnauthorizedError("user-not-found", err)
 			}
@@ -83,46 +85,72 @@ func Auth(app core.App, target string) echo.HandlerFunc {
 			}
 		}
 
-		return apis.RecordAuthResponse(app, c, user, nil)
+		return apis.RecordAuthResponse(app, e, user, nil)
 
 	}
 }
 
-func veifyFirebaseToken(token string) (*auth.Token, error) {
-	if client, err := getClient(); err != nil {
+func (c *Client) veifyFirebaseToken(ctx context.Context, token string) (_ *auth.Token, err error) {
+	ctx, end := c.startCall(ctx, BACKEND_FIREBASE, "VerifyIDToken")
+	defer func() { end(err) }()
+
+	if client, err := c.getFirebaseAuth(); err != nil {
 		return nil, err
 	} else {
-		return client.VerifyIDToken(context.Background(), token)
+		return client.VerifyIDToken(ctx, token)
 	}
 }
 
-func getFirebaseUser(uid string, tentantId string) (*auth.UserRecord, error) {
+func (c *Client) getFirebaseUser(ctx context.Context, uid string, tentantId string) (_ *auth.UserRecord, err error) {
+	ctx, end := c.startCall(ctx, BACKEND_FIREBASE, "GetUser")
+	defer func() { end(err) }()
 
-	if client, err := getClient(); err != nil {
+	if client, err := c.getFirebaseAuth(); err != nil {
 		return nil, err
 	} else {
 		ct, err := client.TenantManager.AuthForTenant(tentantId)
 		if err != nil {
 			return nil, err
 		}
-		return ct.GetUser(context.Background(), uid)
+		return ct.GetUser(ctx, uid)
 	}
 }
 
-func getClient() (*auth.Client, error) {
-	if currentDir, err := os.Getwd(); err != nil {
-		return nil, err
-	} else {
-		opt := option.WithCredentialsFile(currentDir + "/serviceAccountKey.json")
-		firebaseConfig := &firebase.Config{
-			ProjectID: "innpark",
-		}
-		if fb, err := firebase.NewApp(context.Background(), firebaseConfig, opt); err != nil {
+// getFirebaseAuth lazily initializes the Firebase auth client and reuses it
+// for subsequent calls. Failed initializations are retried on the next call.
+func (c *Client) getFirebaseAuth() (*auth.Client, error) {
+	c.firebaseMu.Lock()
+	defer c.firebaseMu.Unlock()
+
+	if c.firebaseAuth != nil {
+		return c.firebaseAuth, nil
+	}
+
+	credentialsFile := c.config.FirebaseCredentialsFile
+	if credentialsFile == "" {
+		currentDir, err := os.Getwd()
+		if err != nil {
 			return nil, err
-		} else {
-			return fb.Auth(context.Background())
 		}
+		credentialsFile = currentDir + "/serviceAccountKey.json"
 	}
+
+	opt := option.WithCredentialsFile(credentialsFile)
+	firebaseConfig := &firebase.Config{
+		ProjectID: c.config.FirebaseProjectID,
+	}
+	fb, err := firebase.NewApp(context.Background(), firebaseConfig, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := fb.Auth(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	c.firebaseAuth = client
+	return client, nil
 }
 
 func getProviderUserInf(users []*auth.UserInfo, provider string) (*auth.UserInfo, error) {
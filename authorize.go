@@ -0,0 +1,156 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DecisionReason tells why Authorize allowed or denied a plate.
+type DecisionReason string
+
+const (
+	DECISION_REASON_WHITELIST   DecisionReason = "whitelist"   // an active list item without free bag
+	DECISION_REASON_ACTIVE_PASS DecisionReason = "active-pass" // an access pass covering the time
+	DECISION_REASON_FREE_BAG    DecisionReason = "free-bag"    // a list item with free bag seconds left
+	DECISION_REASON_UNUSED_PASS DecisionReason = "unused-pass" // an access pass that can be activated
+	DECISION_REASON_NONE        DecisionReason = "none"
+)
+
+// Decision is the outcome of Authorize. The ids point at what allowed the
+// plate: ListItemId for whitelist and free bag decisions, AccessPassItemId
+// for pass decisions.
+type Decision struct {
+	Allowed bool           `json:"allowed"`
+	Reason  DecisionReason `json:"reason"`
+
+	ListId     string `json:"list_id,omitempty"`
+	ListItemId string `json:"list_item_id,omitempty"`
+
+	// RemainingFreeBagSeconds is set on free bag decisions, to be consumed
+	// with DecrementFreeBagSeconds.
+	RemainingFreeBagSeconds int `json:"remaining_free_bag_seconds,omitempty"`
+
+	// AccessPassItemId is set on pass decisions. An unused pass still has to
+	// be started with ActivateAccessPass.
+	AccessPassItemId string `json:"access_pass_item_id,omitempty"`
+
+	// Until is when the list item or active pass stops covering the plate,
+	// zero when it does not end.
+	Until DateTime `json:"until"`
+}
+
+// Authorize decides whether the plate may park at the parking at the given
+// time. It looks the plate lists and access passes up concurrently and
+// prefers, in order, a whitelist entry, an active pass, free bag seconds and
+// an unused pass. Only list items and passes of the parking that apply to
+// the vehicle type count; a zero vehicleType is inferred from the plate and
+// left unchecked when the plate does not tell.
+//
+// Lookups that find nothing are misses. When a lookup fails, a match of
+// lower priority is returned along with the lookup error: the plate is
+// allowed, but the failed source might have allowed it without activating a
+// pass or consuming free bag seconds. Callers that act on such a decision
+// must check the error first.
+func (c *Client) Authorize(ctx context.Context, vehiclePlate string, parkingId string, vehicleType VehicleType, at time.Time) (Decision, error) {
+	if vehicleType == "" {
+		vehicleType = InferVehicleType(vehiclePlate)
+	}
+
+	var (
+		lists        []EnrichedListItem
+		activePass   AccessPassItem
+		unusedPasses []AccessPassItem
+
+		listsErr, activeErr, unusedErr error
+	)
+
+	// a failed lookup must not cancel the others, one of them may still
+	// allow the plate
+	var g errgroup.Group
+	g.Go(func() error {
+		lists, listsErr = missing(c.GetEnrichedPlateLists(ctx, vehiclePlate, at))
+		return nil
+	})
+	g.Go(func() error {
+		activePass, activeErr = missing(c.GetActiveAccessPassesByPlateAndParkingAndDateTime(ctx, vehiclePlate, parkingId, at))
+		return nil
+	})
+	g.Go(func() error {
+		unusedPasses, unusedErr = missing(c.GetUnusedAccessPassesByPlateAndParking(ctx, vehiclePlate, parkingId))
+		return nil
+	})
+	g.Wait()
+
+	applies := func(item EnrichedListItem) bool {
+		return (item.ParkingId == "" || item.ParkingId == parkingId) && item.ActiveAt(at) && appliesTo(item, vehicleType)
+	}
+
+	for _, item := range lists {
+		if item.Seconds == 0 && applies(item) {
+			return Decision{
+				Allowed:    true,
+				Reason:     DECISION_REASON_WHITELIST,
+				ListId:     item.ListId,
+				ListItemId: item.Id,
+				Until:      item.ToDate,
+			}, nil
+		}
+	}
+
+	if activePass.Id != "" && (activePass.FromDate.IsZero() || activePass.ActiveAt(at)) && appliesTo(activePass, vehicleType) {
+		return Decision{
+			Allowed:          true,
+			Reason:           DECISION_REASON_ACTIVE_PASS,
+			AccessPassItemId: activePass.Id,
+			Until:            activePass.ToDate,
+		}, listsErr
+	}
+
+	// the lists were found, so only the active pass lookup can have failed
+	for _, item := range lists {
+		if item.Seconds > 0 && item.RemainingSeconds > 0 && applies(item) {
+			return Decision{
+				Allowed:                 true,
+				Reason:                  DECISION_REASON_FREE_BAG,
+				ListId:                  item.ListId,
+				ListItemId:              item.Id,
+				RemainingFreeBagSeconds: item.RemainingSeconds,
+				Until:                   item.ToDate,
+			}, activeErr
+		}
+	}
+
+	for _, pass := range unusedPasses {
+		// an unused pass has no FromDate yet, but it may have expired
+		if activeAt(time.Time{}, pass.ToDate.End(), at) && appliesTo(pass, vehicleType) {
+			return Decision{
+				Allowed:          true,
+				Reason:           DECISION_REASON_UNUSED_PASS,
+				AccessPassItemId: pass.Id,
+			}, errors.Join(listsErr, activeErr)
+		}
+	}
+
+	if err := errors.Join(listsErr, activeErr, unusedErr); err != nil {
+		return Decision{}, err
+	}
+	return Decision{Reason: DECISION_REASON_NONE}, nil
+}
+
+// appliesTo reports whether the restricted item applies to the vehicle
+// type. A zero vehicleType, a vehicle of unknown type, passes every check.
+func appliesTo(item VehicleTyped, vehicleType VehicleType) bool {
+	return vehicleType == "" || item.GetVehicleType().Matches(vehicleType)
+}
+
+// missing turns ErrNotFound into a zero result.
+func missing[T any](result T, err error) (T, error) {
+	if errors.Is(err, ErrNotFound) {
+		var zero T
+		return zero, nil
+	}
+	return result, err
+}
@@ -0,0 +1,157 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorize(t *testing.T) {
+	at := time.Date(2024, 5, 15, 12, 0, 0, 0, Madrid)
+
+	type responses struct {
+		lists, active, unused string
+	}
+	reply := func(w http.ResponseWriter, body string) {
+		switch body {
+		case "404":
+			w.WriteHeader(http.StatusNotFound)
+		case "500":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(body))
+		}
+	}
+
+	tests := []struct {
+		name        string
+		responses   responses
+		vehicleType VehicleType
+		reason      DecisionReason
+		id          string
+		err         bool
+	}{
+		{
+			name:      "whitelist",
+			responses: responses{lists: `[{"id":"i1","list_id":"l1","parking_id":"p1"}]`, active: `{}`, unused: `[]`},
+			reason:    DECISION_REASON_WHITELIST,
+			id:        "i1",
+		},
+		{
+			name:      "whitelist of another parking",
+			responses: responses{lists: `[{"id":"i1","list_id":"l1","parking_id":"p2"}]`, active: `{}`, unused: `[]`},
+			reason:    DECISION_REASON_NONE,
+		},
+		{
+			name:      "free bag",
+			responses: responses{lists: `[{"id":"i1","seconds":600,"remaining_seconds":300}]`, active: `{}`, unused: `[]`},
+			reason:    DECISION_REASON_FREE_BAG,
+			id:        "i1",
+		},
+		{
+			name:        "whitelist of another vehicle type",
+			responses:   responses{lists: `[{"id":"i1","vehicle_type":"MOTORBIKE"}]`, active: `{}`, unused: `[]`},
+			vehicleType: VEHICLE_TYPE_CAR,
+			reason:      DECISION_REASON_NONE,
+		},
+		{
+			name:      "not found is a miss",
+			responses: responses{lists: `404`, active: `404`, unused: `[{"id":"a1"}]`},
+			reason:    DECISION_REASON_UNUSED_PASS,
+			id:        "a1",
+		},
+		{
+			name:      "whitelist wins over failed pass lookups",
+			responses: responses{lists: `[{"id":"i1","list_id":"l1"}]`, active: `500`, unused: `500`},
+			reason:    DECISION_REASON_WHITELIST,
+			id:        "i1",
+		},
+		{
+			name:      "active pass with a failed list lookup",
+			responses: responses{lists: `500`, active: `{"id":"a1","from_date":"2024-05-15","to_date":"2024-05-15"}`, unused: `500`},
+			reason:    DECISION_REASON_ACTIVE_PASS,
+			id:        "a1",
+			err:       true,
+		},
+		{
+			name:      "free bag with a failed active pass lookup",
+			responses: responses{lists: `[{"id":"i1","seconds":600,"remaining_seconds":300}]`, active: `500`, unused: `[]`},
+			reason:    DECISION_REASON_FREE_BAG,
+			id:        "i1",
+			err:       true,
+		},
+		{
+			name:      "unused pass with a failed list lookup",
+			responses: responses{lists: `500`, active: `{}`, unused: `[{"id":"u1"}]`},
+			reason:    DECISION_REASON_UNUSED_PASS,
+			id:        "u1",
+			err:       true,
+		},
+		{
+			name:      "failed unused pass lookup",
+			responses: responses{lists: `[]`, active: `{}`, unused: `500`},
+			reason:    DECISION_REASON_NONE,
+			err:       true,
+		},
+		{
+			name:      "failed lookup without match",
+			responses: responses{lists: `[]`, active: `500`, unused: `[]`},
+			err:       true,
+		},
+		{
+			name:      "expired unused pass",
+			responses: responses{lists: `[]`, active: `{}`, unused: `[{"id":"a1","to_date":"2024-05-14"},{"id":"a2","to_date":"2024-05-15"}]`},
+			reason:    DECISION_REASON_UNUSED_PASS,
+			id:        "a2",
+		},
+		{
+			name:        "unused pass of another vehicle type",
+			responses:   responses{lists: `[]`, active: `{}`, unused: `[{"id":"a1","vehicle_type":"MOTORBIKE"}]`},
+			vehicleType: VEHICLE_TYPE_CAR,
+			reason:      DECISION_REASON_NONE,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/lists/get-enriched-plate-lists":
+					reply(w, tt.responses.lists)
+				case "/v1/active-access-passes-items":
+					reply(w, tt.responses.active)
+				case "/v1/unused-access-passes-items":
+					reply(w, tt.responses.unused)
+				}
+			}))
+			defer server.Close()
+
+			c := NewClient(Config{OnstreetURL: server.URL, Retry: RetryPolicy{MaxAttempts: 1}})
+			decision, err := c.Authorize(context.Background(), "1234BCD", "p1", tt.vehicleType, at)
+			if tt.err {
+				if !errors.Is(err, ErrUnavailable) {
+					t.Errorf("got %v, want ErrUnavailable", err)
+				}
+				if tt.reason == "" || tt.reason == DECISION_REASON_NONE {
+					if decision != (Decision{}) {
+						t.Errorf("got %+v with the error, want no decision", decision)
+					}
+					return
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			id := decision.ListItemId
+			if id == "" {
+				id = decision.AccessPassItemId
+			}
+			if decision.Reason != tt.reason || id != tt.id || decision.Allowed != (tt.reason != DECISION_REASON_NONE) {
+				t.Errorf("got %+v, want %s with %q", decision, tt.reason, tt.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BREAKER_CLOSED    BreakerState = "closed"
+	BREAKER_OPEN      BreakerState = "open"
+	BREAKER_HALF_OPEN BreakerState = "half-open"
+)
+
+// ErrCircuitOpen is returned without calling the backend while its circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("innpark: circuit breaker open")
+
+// BreakerConfig configures the circuit breaker of one backend. Only
+// transport errors and 429/5xx responses count as failures.
+type BreakerConfig struct {
+	FailureThreshold    int           // consecutive failures that open the circuit
+	OpenTimeout         time.Duration // how long the circuit stays open before probing
+	HalfOpenMaxRequests int           // concurrent probes allowed while half-open
+}
+
+var DefaultBreakerConfig = BreakerConfig{
+	FailureThreshold:    5,
+	OpenTimeout:         30 * time.Second,
+	HalfOpenMaxRequests: 1,
+}
+
+type circuitBreaker struct {
+	service Backend
+	config  BreakerConfig
+
+	mu                  sync.Mutex
+	state               BreakerState
+	consecutiveFailures int
+	halfOpenInFlight    int
+	openedAt            time.Time
+	lastFailureAt       time.Time
+	lastError           string
+}
+
+func newCircuitBreaker(service Backend, config BreakerConfig) *circuitBreaker {
+	if config.FailureThreshold < 1 {
+		config.FailureThreshold = DefaultBreakerConfig.FailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultBreakerConfig.OpenTimeout
+	}
+	if config.HalfOpenMaxRequests < 1 {
+		config.HalfOpenMaxRequests = DefaultBreakerConfig.HalfOpenMaxRequests
+	}
+	return &circuitBreaker{service: service, config: config, state: BREAKER_CLOSED}
+}
+
+// allow reports whether a call may go through. Every allowed call must be
+// followed by exactly one call to done.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BREAKER_OPEN && time.Since(b.openedAt) >= b.config.OpenTimeout {
+		b.state = BREAKER_HALF_OPEN
+		b.halfOpenInFlight = 0
+	}
+
+	switch b.state {
+	case BREAKER_OPEN:
+		return false
+	case BREAKER_HALF_OPEN:
+		if b.halfOpenInFlight >= b.config.HalfOpenMaxRequests {
+			return false
+		}
+		b.halfOpenInFlight++
+	}
+	return true
+}
+
+// done records the outcome of an allowed call. A nil failure is a success;
+// cancelled calls say nothing about the backend and are not counted.
+func (b *circuitBreaker) done(failure error, cancelled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BREAKER_HALF_OPEN && b.halfOpenInFlight > 0 {
+		b.halfOpenInFlight--
+	}
+	if cancelled {
+		return
+	}
+
+	if failure == nil {
+		b.consecutiveFailures = 0
+		b.state = BREAKER_CLOSED
+		return
+	}
+
+	b.consecutiveFailures++
+	b.lastFailureAt = time.Now()
+	b.lastError = failure.Error()
+	if b.state == BREAKER_HALF_OPEN || b.consecutiveFailures >= b.config.FailureThreshold {
+		b.state = BREAKER_OPEN
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) health() BackendHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.state
+	if state == BREAKER_OPEN && time.Since(b.openedAt) >= b.config.OpenTimeout {
+		state = BREAKER_HALF_OPEN
+	}
+
+	return BackendHealth{
+		Backend:             b.service,
+		State:               state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		OpenedAt:            b.openedAt,
+		LastFailureAt:       b.lastFailureAt,
+		LastError:           b.lastError,
+	}
+}
+
+// breakerTransport fails fast while the breaker is open and reports the
+// outcome of each call, retries included, to the breaker.
+type breakerTransport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	response, err := t.next.RoundTrip(req)
+
+	cancelled := errors.Is(req.Context().Err(), context.Canceled)
+	switch {
+	case err != nil:
+		t.breaker.done(err, cancelled)
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		t.breaker.done(errors.New(response.Status), cancelled)
+	default:
+		t.breaker.done(nil, cancelled)
+	}
+
+	return response, err
+}
+
+// BackendHealth is the circuit breaker view of one backend.
+type BackendHealth struct {
+	Backend             Backend      `json:"backend"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            time.Time    `json:"opened_at"`
+	LastFailureAt       time.Time    `json:"last_failure_at"`
+	LastError           string       `json:"last_error,omitempty"`
+}
+
+// HealthReport is a point in time snapshot of every backend, suitable for
+// serving as JSON to an admin dashboard.
+type HealthReport struct {
+	Healthy  bool            `json:"healthy"`
+	Backends []BackendHealth `json:"backends"`
+}
+
+// Health reports the circuit breaker state of each backend. The report is
+// healthy when no circuit is open.
+func (c *Client) Health() HealthReport {
+	report := HealthReport{Healthy: true}
+	for _, service := range httpBackends {
+		health := c.breakers[service].health()
+		if health.State == BREAKER_OPEN {
+			report.Healthy = false
+		}
+		report.Backends = append(report.Backends, health)
+	}
+	return report
+}
+
+// Health reports the backends of the default client, see Client.Health.
+func Health() HealthReport {
+	return Default().Health()
+}
@@ -0,0 +1,195 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newBreakerTransport(config BreakerConfig) *breakerTransport {
+	return &breakerTransport{breaker: newCircuitBreaker(BACKEND_ONSTREET, config), next: http.DefaultTransport}
+}
+
+func roundTrip(t *testing.T, transport http.RoundTripper, ctx context.Context, url string) error {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	response, err := transport.RoundTrip(req)
+	if err == nil {
+		response.Body.Close()
+	}
+	return err
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	var calls atomic.Int32
+	var status atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	const openTimeout = 20 * time.Millisecond
+	transport := newBreakerTransport(BreakerConfig{FailureThreshold: 2, OpenTimeout: openTimeout, HalfOpenMaxRequests: 1})
+
+	steps := []struct {
+		name     string
+		wait     bool // past the open timeout first
+		status   int
+		wantOpen bool // rejected without calling upstream
+		want     BreakerState
+	}{
+		{name: "success", status: 200, want: BREAKER_CLOSED},
+		{name: "first failure", status: 500, want: BREAKER_CLOSED},
+		{name: "client errors are not failures", status: 404, want: BREAKER_CLOSED},
+		{name: "failure after a success", status: 503, want: BREAKER_CLOSED},
+		{name: "threshold reached", status: 429, want: BREAKER_OPEN},
+		{name: "open", status: 200, wantOpen: true, want: BREAKER_OPEN},
+		{name: "failed probe reopens", wait: true, status: 500, want: BREAKER_OPEN},
+		{name: "reopened", status: 200, wantOpen: true, want: BREAKER_OPEN},
+		{name: "successful probe closes", wait: true, status: 200, want: BREAKER_CLOSED},
+		{name: "closed again", status: 500, want: BREAKER_CLOSED},
+	}
+
+	for _, step := range steps {
+		if step.wait {
+			time.Sleep(openTimeout)
+			if state := transport.breaker.health().State; state != BREAKER_HALF_OPEN {
+				t.Errorf("%s: got %s after the open timeout, want half-open", step.name, state)
+			}
+		}
+
+		before := calls.Load()
+		status.Store(int32(step.status))
+		err := roundTrip(t, transport, context.Background(), server.URL)
+
+		if step.wantOpen != errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("%s: got error %v, want circuit open %t", step.name, err, step.wantOpen)
+		}
+		if called := calls.Load() > before; called == step.wantOpen {
+			t.Errorf("%s: upstream called %t", step.name, called)
+		}
+		if state := transport.breaker.health().State; state != step.want {
+			t.Errorf("%s: got %s, want %s", step.name, state, step.want)
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpenMaxRequests(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	const openTimeout = 10 * time.Millisecond
+	transport := newBreakerTransport(BreakerConfig{FailureThreshold: 1, OpenTimeout: openTimeout, HalfOpenMaxRequests: 2})
+
+	failing.Store(true)
+	roundTrip(t, transport, context.Background(), server.URL)
+	failing.Store(false)
+	time.Sleep(openTimeout)
+
+	probes := make(chan error, 2)
+	for range 2 {
+		go func() { probes <- roundTrip(t, transport, context.Background(), server.URL) }()
+		<-received
+	}
+
+	// both probes are in flight, a third call is rejected
+	if err := roundTrip(t, transport, context.Background(), server.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("third probe: got %v, want ErrCircuitOpen", err)
+	}
+
+	close(release)
+	for range 2 {
+		if err := <-probes; err != nil {
+			t.Error(err)
+		}
+	}
+	if state := transport.breaker.health().State; state != BREAKER_CLOSED {
+		t.Errorf("got %s after successful probes, want closed", state)
+	}
+}
+
+func TestCircuitBreakerIgnoresCancelledCalls(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	transport := newBreakerTransport(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+
+	for range 3 {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-received
+			cancel()
+		}()
+		if err := roundTrip(t, transport, ctx, server.URL); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	}
+
+	health := transport.breaker.health()
+	if health.State != BREAKER_CLOSED || health.ConsecutiveFailures != 0 {
+		t.Errorf("got %+v, want a closed breaker without failures", health)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	const openTimeout = 20 * time.Millisecond
+	c := NewClient(Config{
+		OnstreetURL: server.URL,
+		Retry:       RetryPolicy{MaxAttempts: 1},
+		Breakers:    map[Backend]BreakerConfig{BACKEND_ONSTREET: {FailureThreshold: 1, OpenTimeout: openTimeout}},
+	})
+
+	report := c.Health()
+	if !report.Healthy || len(report.Backends) != len(httpBackends) {
+		t.Fatalf("got %+v, want every backend healthy", report)
+	}
+
+	if _, err := c.GetPlateLists(context.Background(), "1234BCD", time.Now()); err == nil {
+		t.Fatal("failing lookup succeeded")
+	}
+
+	report = c.Health()
+	if report.Healthy {
+		t.Error("got healthy with an open circuit")
+	}
+	for _, backend := range report.Backends {
+		switch {
+		case backend.Backend == BACKEND_ONSTREET:
+			if backend.State != BREAKER_OPEN || backend.ConsecutiveFailures != 1 || backend.LastError == "" || backend.OpenedAt.IsZero() {
+				t.Errorf("onstreet: got %+v, want an open circuit with its failure", backend)
+			}
+		case backend.State != BREAKER_CLOSED:
+			t.Errorf("%s: got %s, want closed", backend.Backend, backend.State)
+		}
+	}
+
+	// past the timeout the next call probes, which no longer counts as open
+	time.Sleep(openTimeout)
+	if report := c.Health(); !report.Healthy {
+		t.Errorf("got %+v, want healthy once half-open", report)
+	}
+}
@@ -0,0 +1,240 @@
+package innpark
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+	novu "github.com/novuhq/go-novu/lib"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_NOVU_URL            = "https://api.novu.co"
+	DEFAULT_FIREBASE_PROJECT_ID = "innpark"
+)
+
+// Config holds the endpoints and credentials of every backend the library
+// talks to. Empty fields fall back to the defaults documented on each field.
+type Config struct {
+	OnstreetURL   string
+	OnstreetToken string
+
+	OffstreetURL string
+	// OffstreetVehiclesCollection is the offstreet collection holding the
+	// vehicles registered with CreateVehicle, e.g. "vehicles". Offstreet
+	// documents none, so ListVehicles, GetVehicle and GetVehicleByPlate fail
+	// with ErrNoVehiclesCollection until it is set.
+	OffstreetVehiclesCollection string
+
+	PaymentURL   string
+	PaymentToken string
+
+	NovuURL              string // defaults to DEFAULT_NOVU_URL
+	NovuToken            string
+	NovuFCMIntegrationId string
+
+	FirebaseProjectID string // defaults to DEFAULT_FIREBASE_PROJECT_ID
+	// FirebaseCredentialsFile is the service account key used to verify
+	// tokens. Defaults to serviceAccountKey.json in the working directory.
+	FirebaseCredentialsFile string
+
+	// Timeouts bounds every call to a backend, retries included. Backends
+	// missing from the map use DefaultTimeouts.
+	Timeouts map[Backend]time.Duration
+	// Retry controls how idempotent calls are retried. The zero value uses
+	// DefaultRetryPolicy.
+	Retry RetryPolicy
+	// IdempotentEndpoints lists the path patterns, in path.Match syntax, of
+	// the upstream mutations documented to deduplicate on the
+	// Idempotency-Key header, e.g. "/v1/services/*/payments/create". Only
+	// those are retried; every other POST or PATCH is attempted once, key
+	// or not. Empty by default.
+	IdempotentEndpoints []string
+	// Breakers configures the circuit breaker of each backend. Backends
+	// missing from the map use DefaultBreakerConfig.
+	Breakers map[Backend]BreakerConfig
+	// Transport is the round tripper shared by every backend. Defaults to a
+	// pooled clone of http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// TracerProvider and MeterProvider receive a span and latency and error
+	// metrics for every backend call. Propagator injects the trace context
+	// into upstream requests. Nil values disable each of them.
+	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
+	Propagator     propagation.TextMapPropagator
+
+	// Logger receives the structured logs of the library, with the values
+	// of RedactedKeys and the matches of RedactedPatterns masked. Nil
+	// discards them. RedactedKeys and RedactedPatterns default to
+	// DefaultRedactedKeys and DefaultRedactedPatterns; empty non-nil
+	// slices disable each of them.
+	Logger           *slog.Logger
+	RedactedKeys     []string
+	RedactedPatterns []*regexp.Regexp
+
+	// IdempotencyStore persists the outcome of mutating calls so replayed
+	// idempotency keys return the original result. When nil, keys are still
+	// sent upstream but nothing is replayed locally.
+	IdempotencyStore IdempotencyStore
+
+	// FreeBagLedger records every free bag decrement and its outcome, see
+	// ConsumeFreeBag. When nil, decrements are not recorded.
+	FreeBagLedger FreeBagLedger
+
+	// PaymentStateStore tracks the lifecycle of every payment so calls the
+	// current state does not allow, or racing another call on the same
+	// payment, are rejected before reaching the payment API. When nil,
+	// payments are not tracked and refunds are sent without checking them
+	// against what was captured.
+	PaymentStateStore PaymentStateStore
+
+	// OrganizationTaxRates gives the VAT rate of the organization of each
+	// payee, which the payment calls split their amounts by, see
+	// TaxBreakdown. When nil, only Taxed payees and payables are split.
+	OrganizationTaxRates OrganizationTaxRates
+	// OmitTaxBreakdown leaves the TaxBreakdown out of the payment bodies and
+	// PayableMetadata, for payment APIs that do not accept one.
+	OmitTaxBreakdown bool
+
+	// RefundLedger records every refund with its reason and operator, see
+	// IssueRefund. When nil, refunds are not recorded.
+	RefundLedger RefundLedger
+
+	// PreauthorizationStore tracks the open holds of preauthorization
+	// payments until they are captured or cancelled, see
+	// PreauthorizationExpiryJob. When nil, holds are not tracked.
+	PreauthorizationStore PreauthorizationStore
+}
+
+// ConfigFromEnv builds a Config from the environment variables historically
+// read by the package.
+func ConfigFromEnv() Config {
+	return Config{
+		OnstreetURL:          os.Getenv("API_ONSTREET_URL"),
+		OnstreetToken:        os.Getenv("API_ONSTREET_TOKEN"),
+		OffstreetURL:         os.Getenv("API_OFFSTREET_URL"),
+		PaymentURL:           os.Getenv("API_PAYMENT"),
+		PaymentToken:         os.Getenv("API_PAYMENT_TOKEN"),
+		NovuToken:            os.Getenv("NOVU_TOKEN"),
+		NovuFCMIntegrationId: os.Getenv("NOVU_FCM_ID"),
+	}
+}
+
+// Client talks to the onstreet, offstreet and payment APIs, Novu and
+// Firebase using its own Config. Every outbound call honours the deadline and
+// cancellation of the context it is given. It is safe for concurrent use.
+type Client struct {
+	config      Config
+	httpClients map[Backend]*http.Client
+	breakers    map[Backend]*circuitBreaker
+	novu        *novu.APIClient
+	logger      *slog.Logger
+	redactor    *redactor
+	telemetry
+
+	firebaseMu   sync.Mutex
+	firebaseAuth *auth.Client
+}
+
+func NewClient(config Config) *Client {
+	if config.NovuURL == "" {
+		config.NovuURL = DEFAULT_NOVU_URL
+	}
+	if config.FirebaseProjectID == "" {
+		config.FirebaseProjectID = DEFAULT_FIREBASE_PROJECT_ID
+	}
+
+	if config.Retry == (RetryPolicy{}) {
+		config.Retry = DefaultRetryPolicy
+	}
+	if config.Transport == nil {
+		config.Transport = newPooledTransport()
+	}
+
+	c := &Client{
+		config:      config,
+		httpClients: map[Backend]*http.Client{},
+		breakers:    map[Backend]*circuitBreaker{},
+		logger:      newLogger(config),
+		redactor:    newRedactor(config),
+		telemetry:   newTelemetry(config),
+	}
+	for _, service := range httpBackends {
+		timeout, ok := config.Timeouts[service]
+		if !ok {
+			timeout = DefaultTimeouts[service]
+		}
+		breakerConfig, ok := config.Breakers[service]
+		if !ok {
+			breakerConfig = DefaultBreakerConfig
+		}
+
+		c.breakers[service] = newCircuitBreaker(service, breakerConfig)
+		c.httpClients[service] = &http.Client{
+			Timeout: timeout,
+			Transport: &breakerTransport{
+				breaker: c.breakers[service],
+				next: &retryTransport{
+					base:       config.Transport,
+					policy:     config.Retry,
+					keyedPaths: config.IdempotentEndpoints,
+				},
+			},
+		}
+	}
+
+	novuConfig := &novu.Config{HttpClient: c.httpClients[BACKEND_NOVU]}
+	if backendURL, err := url.Parse(config.NovuURL); err == nil {
+		novuConfig.BackendURL = backendURL
+	}
+	c.novu = novu.NewAPIClient(config.NovuToken, novuConfig)
+
+	return c
+}
+
+// httpBackends are the backends reached through the client transport, each
+// with its own timeout and circuit breaker.
+var httpBackends = []Backend{BACKEND_ONSTREET, BACKEND_OFFSTREET, BACKEND_PAYMENT, BACKEND_NOVU}
+
+// Config returns a copy of the configuration the client was built with.
+func (c *Client) Config() Config {
+	return c.config
+}
+
+var (
+	defaultClientOnce sync.Once
+	defaultClientMu   sync.RWMutex
+	defaultClient     *Client
+)
+
+// Default returns the client used by the package-level functions. Unless
+// replaced with SetDefault, it is built from ConfigFromEnv on first use.
+func Default() *Client {
+	defaultClientOnce.Do(func() {
+		defaultClientMu.Lock()
+		if defaultClient == nil {
+			defaultClient = NewClient(ConfigFromEnv())
+		}
+		defaultClientMu.Unlock()
+	})
+
+	defaultClientMu.RLock()
+	defer defaultClientMu.RUnlock()
+	return defaultClient
+}
+
+// SetDefault replaces the client used by the package-level functions.
+func SetDefault(c *Client) {
+	defaultClientMu.Lock()
+	defaultClient = c
+	defaultClientMu.Unlock()
+}
@@ -0,0 +1,46 @@
+package innpark
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+// ensureCollection creates a base collection with the given fields when it
+// does not exist yet, so the PocketBase-backed stores of the library work
+// without a migration. Existing collections are left untouched. Rules are
+// left nil, which restricts the API access to admins.
+func ensureCollection(app core.App, name string, fields []*schema.SchemaField, indexes ...string) error {
+	if _, err := app.Dao().FindCollectionByNameOrId(name); err == nil {
+		return nil
+	}
+
+	collection := &models.Collection{
+		Name:    name,
+		Type:    models.CollectionTypeBase,
+		Schema:  schema.NewSchema(fields...),
+		Indexes: indexes,
+	}
+
+	return app.Dao().SaveCollection(collection)
+}
+
+func textField(name string, required bool) *schema.SchemaField {
+	return &schema.SchemaField{Name: name, Type: schema.FieldTypeText, Required: required, Options: &schema.TextOptions{}}
+}
+
+func numberField(name string) *schema.SchemaField {
+	return &schema.SchemaField{Name: name, Type: schema.FieldTypeNumber, Options: &schema.NumberOptions{}}
+}
+
+func boolField(name string) *schema.SchemaField {
+	return &schema.SchemaField{Name: name, Type: schema.FieldTypeBool, Options: &schema.BoolOptions{}}
+}
+
+func dateField(name string) *schema.SchemaField {
+	return &schema.SchemaField{Name: name, Type: schema.FieldTypeDate, Options: &schema.DateOptions{}}
+}
+
+func jsonField(name string) *schema.SchemaField {
+	return &schema.SchemaField{Name: name, Type: schema.FieldTypeJson, Options: &schema.JsonOptions{MaxSize: 2 << 20}}
+}
@@ -0,0 +1,183 @@
+package innpark
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// The package-level functions below delegate to Default() with a background
+// context and are kept for callers that predate Client.
+
+// appLogger returns the logger of app redacting like the default client, as
+// the errors the wrappers log hold request URLs, plates included.
+func appLogger(app core.App) *slog.Logger {
+	return Default().redactor.logger(app.Logger())
+}
+
+func Auth(app core.App, target string) echo.HandlerFunc {
+	return Default().Auth(app, target)
+}
+
+// Offstreet
+
+func CreateVehicle(plate string, vehicleId string, userId string) (string, error) {
+	return Default().CreateVehicle(context.Background(), plate, vehicleId, userId, "")
+}
+
+func DeleteVehicle(plate string, userId string) error {
+	return Default().DeleteVehicle(context.Background(), plate, userId)
+}
+
+// Deprecated: use Client.GetParkings, which reports upstream failures
+// instead of returning an empty slice.
+func GetParkings(organizationId string, clusterId string) []Parking {
+	parkings, err := Default().GetParkings(context.Background(), organizationId, clusterId)
+	if err != nil {
+		return []Parking{}
+	}
+	return parkings
+}
+
+// Onstreet
+
+// Deprecated: use Client.GetPlateLists, which reports upstream failures
+// instead of returning an empty slice.
+func GetPlateLists(plate string, startDateTime string) []ListItem {
+	lists, err := Default().getPlateLists(context.Background(), plate, startDateTime)
+	if err != nil {
+		return []ListItem{}
+	}
+	return lists
+}
+
+// Deprecated: use Client.GetEnrichedPlateLists, which reports upstream
+// failures instead of returning an empty slice.
+func GetEnrichedPlateLists(plate string, startDateTime string) []EnrichedListItem {
+	lists, err := Default().getEnrichedPlateLists(context.Background(), plate, startDateTime)
+	if err != nil {
+		return []EnrichedListItem{}
+	}
+	return lists
+}
+
+// Deprecated: use Client.GetPlatesInList, which reports upstream failures
+// instead of logging them and returning an empty slice.
+func GetPlatesInList(app core.App, listId string) []string {
+	plates, err := Default().GetPlatesInList(context.Background(), listId)
+	if err != nil {
+		appLogger(app).Error("error getting plates in list", "list_id", listId, "error", err)
+		return []string{}
+	}
+	return plates
+}
+
+// Deprecated: use Client.DecrementFreeBagSeconds, which reports whether the
+// decrement was applied.
+func DecrementFreeBagSeconds(app core.App, listItemId string, secondsToDecrement int) {
+	if err := Default().DecrementFreeBagSeconds(context.Background(), listItemId, secondsToDecrement); err != nil {
+		appLogger(app).Error("error decrementing free bag seconds", "list_item_id", listItemId, "error", err)
+	}
+}
+
+// Deprecated: use Client.GetActiveAccessPassesByPlateAndParkingAndDateTime,
+// which tells a missing pass apart from an upstream failure.
+func GetActiveAccessPassesByPlateAndParkingAndDateTime(app core.App, plate string, parkingId string, startDateTime string) AccessPassItem {
+	accessPass, err := Default().getActiveAccessPass(context.Background(), plate, parkingId, startDateTime)
+	if err != nil {
+		appLogger(app).Error("error getting active access pass", "parking_id", parkingId, "error", err)
+		return AccessPassItem{}
+	}
+	return accessPass
+}
+
+// Deprecated: use Client.GetUnusedAccessPassesByPlateAndParking, which
+// reports upstream failures instead of returning an empty slice.
+func GetUnusedAccessPassesByPlateAndParking(app core.App, plate string, parkingId string) []AccessPassItem {
+	accessPasses, err := Default().GetUnusedAccessPassesByPlateAndParking(context.Background(), plate, parkingId)
+	if err != nil {
+		appLogger(app).Error("error getting unused access passes", "parking_id", parkingId, "error", err)
+		return []AccessPassItem{}
+	}
+	return accessPasses
+}
+
+func ActivateAccessPass(app core.App, accessPasssItemId string, startDateTime string) (AccessPassItem, error) {
+	accessPass, err := Default().activateAccessPass(context.Background(), accessPasssItemId, startDateTime)
+	if err != nil {
+		appLogger(app).Error("error activating access pass", "access_pass_item_id", accessPasssItemId, "error", err)
+	}
+	return accessPass, err
+}
+
+// Payment
+
+func CreateService(payable Payable, payee Payee) error {
+	return Default().CreateService(context.Background(), payable, payee)
+}
+
+func RefundPartialPaymentFromService(payable Payable, amount int) error {
+	return Default().RefundPartialPaymentFromService(context.Background(), payable, nil, Cents(amount))
+}
+
+func CreateServiceWithMetadata(app core.App, payable Payable, payee Payee) error {
+	return Default().CreateServiceWithMetadata(context.Background(), app, payable, payee)
+}
+
+func UpdateService(app core.App, payable Payable, amount int) error {
+	return Default().UpdateService(context.Background(), app, payable, nil, Cents(amount))
+}
+
+func CreatePayment(payable Payable, payee Payee, payment_type string) (*PaymentResponse, error) {
+	return Default().CreatePayment(context.Background(), payable, payee, payment_type)
+}
+
+func CreatePaymentByMethodId(payable Payable, payee Payee, payment_type string, paymentMethodId string) (*PaymentResponse, error) {
+	return Default().CreatePaymentByMethodId(context.Background(), payable, payee, payment_type, paymentMethodId)
+}
+
+func CreateRedirectPayment(payable Payable, payee Payee, returnUrlOk string, returnUrlKo string, returnUrlNotification string) (*RedirectPaymentResponse, error) {
+	return Default().CreateRedirectPayment(context.Background(), payable, payee, returnUrlOk, returnUrlKo, returnUrlNotification)
+}
+
+func ConfirmPreautorhization(payable Payable) error {
+	return Default().ConfirmPreautorhization(context.Background(), payable)
+}
+
+func CancelPreautorhization(payable Payable) error {
+	return Default().CancelPreautorhization(context.Background(), payable)
+}
+
+func RefundPayment(payable Payable) error {
+	return Default().RefundPayment(context.Background(), payable)
+}
+
+// Notifications
+
+func UpdateSubscriberCredentials(userId string, tokens []string) error {
+	return Default().UpdateSubscriberCredentials(context.Background(), userId, tokens)
+}
+
+func CreateSubscriber(userID string, email string) error {
+	return Default().CreateSubscriber(context.Background(), userID, email)
+}
+
+func TriggerWorkflow(workflowName string, subscriberId string, payload map[string]interface{}) error {
+	return Default().TriggerWorkflow(context.Background(), workflowName, subscriberId, payload)
+}
+
+// TriggerWorkflowForOrganization triggers a workflow via the payment API,
+// which will restrict FCM delivery to tokens registered under the given organization.
+func TriggerWorkflowForOrganization(workflowName string, userId string, organizationId string, payload map[string]interface{}) error {
+	return Default().TriggerWorkflowForOrganization(context.Background(), workflowName, userId, organizationId, payload)
+}
+
+func GetSubscriber(userID string) (Subscriber, error) {
+	return Default().GetSubscriber(context.Background(), userID)
+}
+
+func DeleteSubscriber(userID string) error {
+	return Default().DeleteSubscriber(context.Background(), userID)
+}
@@ -0,0 +1,185 @@
+package innpark
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	// embeds the zone database so Madrid loads on hosts without one
+	_ "time/tzdata"
+)
+
+// DATETIME_LAYOUT is the wire format of every date the library sends: UTC
+// with millisecond precision, as PocketBase stores them.
+const DATETIME_LAYOUT = "2006-01-02 15:04:05.000Z"
+
+// Madrid is the Europe/Madrid zone every backend reasons about local time in.
+var Madrid = mustLoadLocation("Europe/Madrid")
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}
+
+// layouts accepted by ParseDateTime, tried in order. The ones without a zone
+// are Madrid local time.
+var dateTimeLayouts = []struct {
+	layout string
+	local  bool
+}{
+	{DATETIME_LAYOUT, false},
+	{time.RFC3339Nano, false},
+	{"2006-01-02 15:04:05.999999999Z07:00", false},
+	{"2006-01-02T15:04:05.999999999", true},
+	{"2006-01-02 15:04:05.999999999", true},
+	{"2006-01-02T15:04", true},
+	{"2006-01-02 15:04", true},
+	{time.DateOnly, true},
+}
+
+// ParseDateTime parses the date formats the backends and apps use:
+// DATETIME_LAYOUT, RFC 3339 with either a "T" or a space, and the same
+// without a zone or without a time, which are read as Madrid local time.
+// An empty string parses to the zero time.
+func ParseDateTime(value string) (time.Time, error) {
+	t, _, err := parseDateTime(value)
+	return t, err
+}
+
+// parseDateTime is ParseDateTime also reporting whether the value was a
+// date without a time.
+func parseDateTime(value string) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+
+	for _, l := range dateTimeLayouts {
+		location := time.UTC
+		if l.local {
+			location = Madrid
+		}
+		if t, err := time.ParseInLocation(l.layout, value, location); err == nil {
+			return t, l.layout == time.DateOnly, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("innpark: invalid date time %q", value)
+}
+
+// FormatDateTime formats t in DATETIME_LAYOUT. The zero time formats as an
+// empty string.
+func FormatDateTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(DATETIME_LAYOUT)
+}
+
+// StartOfDay returns midnight of t's day in Madrid. Days are 23 or 25 hours
+// long across daylight saving changes, so use it and AddDays rather than
+// adding multiples of 24 hours.
+func StartOfDay(t time.Time) time.Time {
+	year, month, day := t.In(Madrid).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, Madrid)
+}
+
+// AddDays adds calendar days in Madrid, keeping the wall clock time.
+func AddDays(t time.Time, days int) time.Time {
+	return t.In(Madrid).AddDate(0, 0, days)
+}
+
+// DateTime is a time.Time that travels in DATETIME_LAYOUT and decodes any of
+// the formats ParseDateTime accepts. Decoded times are in Madrid. The zero
+// DateTime is sent as an empty string.
+//
+// A date decoded without a time stands for the whole Madrid day, see
+// DateOnly and End, and is sent back as a date.
+type DateTime struct {
+	time.Time
+	dateOnly bool
+}
+
+// NewDateTime wraps t.
+func NewDateTime(t time.Time) DateTime {
+	return DateTime{Time: t}
+}
+
+// DateOnly reports whether the date time was decoded from a date without a
+// time.
+func (d DateTime) DateOnly() bool {
+	return d.dateOnly
+}
+
+// End returns when the date time is over: the next Madrid midnight for a
+// date only value, which includes its whole day, and the time itself
+// otherwise.
+func (d DateTime) End() time.Time {
+	if d.dateOnly && !d.IsZero() {
+		return AddDays(StartOfDay(d.Time), 1)
+	}
+	return d.Time
+}
+
+// String returns the date time in DATETIME_LAYOUT, or time.DateOnly for a
+// date only value.
+func (d DateTime) String() string {
+	if d.dateOnly && !d.IsZero() {
+		return d.In(Madrid).Format(time.DateOnly)
+	}
+	return FormatDateTime(d.Time)
+}
+
+func (d DateTime) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *DateTime) UnmarshalText(text []byte) error {
+	t, dateOnly, err := parseDateTime(string(text))
+	if err != nil {
+		return err
+	}
+	if !t.IsZero() {
+		t = t.In(Madrid)
+	}
+	d.Time, d.dateOnly = t, dateOnly
+	return nil
+}
+
+func (d DateTime) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + d.String() + `"`), nil
+}
+
+func (d *DateTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*d = DateTime{}
+		return nil
+	}
+	return d.UnmarshalText([]byte(strings.Trim(string(data), `"`)))
+}
+
+// Value implements driver.Valuer so DateTime fields can be read and written
+// with the PocketBase dao.
+func (d DateTime) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// Scan implements sql.Scanner.
+func (d *DateTime) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		*d = DateTime{}
+		return nil
+	case time.Time:
+		*d = DateTime{Time: v.In(Madrid)}
+		return nil
+	case string:
+		return d.UnmarshalText([]byte(v))
+	case []byte:
+		return d.UnmarshalText(v)
+	}
+	return fmt.Errorf("innpark: cannot scan %T into DateTime", value)
+}
@@ -0,0 +1,106 @@
+package innpark
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDateTimeJSON(t *testing.T) {
+	var item ListItem
+	if err := json.Unmarshal([]byte(`{"from_date":"2024-03-30 23:00:00.000Z","to_date":"2024-03-31"}`), &item); err != nil {
+		t.Fatal(err)
+	}
+
+	if item.FromDate.DateOnly() || !item.ToDate.DateOnly() {
+		t.Errorf("got date only %t and %t, want false and true", item.FromDate.DateOnly(), item.ToDate.DateOnly())
+	}
+	if want := time.Date(2024, 3, 31, 0, 0, 0, 0, Madrid); !item.FromDate.Equal(want) {
+		t.Errorf("got from %s, want %s", item.FromDate, want)
+	}
+	// the last day of March 2024 is 23 hours long in Madrid
+	if want := time.Date(2024, 4, 1, 0, 0, 0, 0, Madrid); !item.ToDate.End().Equal(want) {
+		t.Errorf("got end %s, want %s", item.ToDate.End(), want)
+	}
+
+	raw, err := json.Marshal(item.ToDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `"2024-03-31"` {
+		t.Errorf("got %s, want the date back", raw)
+	}
+	if got := NewDateTime(item.FromDate.Time).String(); got != "2024-03-30 23:00:00.000Z" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestActiveAt(t *testing.T) {
+	var item ListItem
+	if err := json.Unmarshal([]byte(`{"from_date":"2024-05-01","to_date":"2024-05-31"}`), &item); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{at: time.Date(2024, 4, 30, 23, 59, 0, 0, Madrid), want: false},
+		{at: time.Date(2024, 5, 1, 0, 0, 0, 0, Madrid), want: true},
+		{at: time.Date(2024, 5, 31, 23, 59, 0, 0, Madrid), want: true},
+		{at: time.Date(2024, 6, 1, 0, 0, 0, 0, Madrid), want: false},
+	}
+	for _, tt := range tests {
+		if got := item.ActiveAt(tt.at); got != tt.want {
+			t.Errorf("at %s: got %t, want %t", tt.at, got, tt.want)
+		}
+	}
+
+	exact := ListItem{ToDate: NewDateTime(time.Date(2024, 5, 31, 12, 0, 0, 0, Madrid))}
+	if exact.ActiveAt(time.Date(2024, 5, 31, 12, 0, 0, 0, Madrid)) {
+		t.Error("an item is active at its exact end")
+	}
+}
+
+func TestAccessPassRemaining(t *testing.T) {
+	at := time.Date(2024, 10, 26, 12, 0, 0, 0, Madrid)
+
+	never := AccessPassItem{FromDate: NewDateTime(at.Add(-time.Hour))}
+	if _, ok := never.Remaining(at); ok {
+		t.Error("a pass without end reports a remaining time")
+	}
+
+	// the night of October 27 2024 is an hour longer in Madrid
+	pass := AccessPassItem{
+		FromDate: NewDateTime(at.Add(-time.Hour)),
+		ToDate:   NewDateTime(time.Date(2024, 10, 27, 12, 0, 0, 0, Madrid)),
+	}
+	if remaining, ok := pass.Remaining(at); !ok || remaining != 25*time.Hour {
+		t.Errorf("got %s, %t, want 25h", remaining, ok)
+	}
+
+	ended := AccessPassItem{FromDate: pass.FromDate, ToDate: NewDateTime(at.Add(-time.Minute))}
+	if remaining, ok := ended.Remaining(at); !ok || remaining != 0 {
+		t.Errorf("ended: got %s, %t, want 0", remaining, ok)
+	}
+}
+
+func TestStartDateTimePassedThrough(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get("startDateTime")
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	c := NewClient(Config{OnstreetURL: server.URL})
+	if _, err := c.getPlateLists(context.Background(), "1234BCD", "2024-05-01 10:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "2024-05-01 10:00:00" {
+		t.Errorf("sent %q, want the caller's value", got)
+	}
+}
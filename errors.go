@@ -0,0 +1,223 @@
+package innpark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/studiogenesisprojects/lib-innpark/plate"
+)
+
+// Backend identifies one of the upstream services the library talks to.
+type Backend string
+
+const (
+	BACKEND_ONSTREET  Backend = "onstreet"
+	BACKEND_OFFSTREET Backend = "offstreet"
+	BACKEND_PAYMENT   Backend = "payment"
+	BACKEND_NOVU      Backend = "novu"
+	BACKEND_FIREBASE  Backend = "firebase"
+)
+
+var (
+	ErrNotFound        = errors.New("innpark: not found")
+	ErrUnauthorized    = errors.New("innpark: unauthorized")
+	ErrForbidden       = errors.New("innpark: forbidden")
+	ErrConflict        = errors.New("innpark: conflict")
+	ErrPaymentDeclined = errors.New("innpark: payment declined")
+	ErrRateLimited     = errors.New("innpark: rate limited")
+	ErrUnavailable     = errors.New("innpark: upstream unavailable")
+)
+
+// maxErrorBodySize bounds how much of an upstream error response is kept.
+const maxErrorBodySize = 64 << 10
+
+// APIError describes a failed call to one of the upstream services. It is
+// returned both for non-2xx responses and for requests that never got a
+// response, in which case StatusCode is 0 and Err holds the cause.
+//
+// Use errors.Is with the Err* sentinels to classify it and errors.As to
+// inspect the upstream response.
+type APIError struct {
+	Service    Backend
+	Method     string
+	URL        string
+	StatusCode int
+
+	// Body is the raw upstream response body, Code and Message are decoded
+	// from it when it follows the usual {"code", "message", "data"} shape.
+	Body    []byte
+	Code    string
+	Message string
+	Data    map[string]any
+
+	Retryable bool
+	Err       error
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("api-%s-error", e.Service)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(": %d", e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if target := strings.TrimSpace(e.Method + " " + e.URL); target != "" {
+		msg += " (" + target + ")"
+	}
+	return msg
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error matches one of the package sentinels.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrPaymentDeclined:
+		return e.Service == BACKEND_PAYMENT &&
+			(e.StatusCode == http.StatusPaymentRequired || e.Code == "payment-declined")
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrUnavailable:
+		return e.StatusCode >= 500 ||
+			(e.StatusCode == 0 && (e.Retryable || errors.Is(e.Err, ErrCircuitOpen)))
+	}
+	return false
+}
+
+// newResponseError builds an APIError from a non-2xx response, consuming
+// its body.
+func newResponseError(service Backend, response *http.Response) *APIError {
+	apiErr := &APIError{
+		Service:    service,
+		StatusCode: response.StatusCode,
+		Retryable:  isRetryableStatus(response.StatusCode),
+	}
+	if response.Request != nil {
+		apiErr.Method = response.Request.Method
+		apiErr.URL = response.Request.URL.String()
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBodySize))
+	apiErr.Body = body
+
+	decoded := struct {
+		Code    any            `json:"code"`
+		Message string         `json:"message"`
+		Error   string         `json:"error"`
+		Data    map[string]any `json:"data"`
+	}{}
+	if json.Unmarshal(body, &decoded) == nil {
+		if decoded.Code != nil {
+			apiErr.Code = fmt.Sprint(decoded.Code)
+		}
+		apiErr.Message = decoded.Message
+		if apiErr.Message == "" {
+			apiErr.Message = decoded.Error
+		}
+		apiErr.Data = decoded.Data
+	}
+
+	return apiErr
+}
+
+// newRequestError wraps a failure that happened before a response was
+// received, or while decoding it.
+func newRequestError(service Backend, req *http.Request, statusCode int, err error) *APIError {
+	apiErr := &APIError{
+		Service:    service,
+		StatusCode: statusCode,
+		Err:        err,
+		Retryable: statusCode == 0 && !errors.Is(err, ErrCircuitOpen) &&
+			!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded),
+	}
+	if req != nil {
+		apiErr.Method = req.Method
+		apiErr.URL = req.URL.String()
+	}
+	return apiErr
+}
+
+// newNovuError wraps an error returned by the Novu SDK, which only reports
+// the upstream status inside the error message.
+func newNovuError(operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	apiErr := newRequestError(BACKEND_NOVU, nil, 0, err)
+	apiErr.Method = operation
+	if i := strings.Index(err.Error(), "status code "); i >= 0 {
+		fmt.Sscanf(err.Error()[i+len("status code "):], "%d", &apiErr.StatusCode)
+		apiErr.Retryable = isRetryableStatus(apiErr.StatusCode)
+	}
+	return apiErr
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented:
+		return false
+	}
+	return status >= 500
+}
+
+// ToApiError maps an error returned by the library to the PocketBase API
+// error a route should respond with. Upstream 401 and 403 responses reject
+// the credentials of the library, so they map to 502 rather than telling
+// the client its user is not logged in.
+func ToApiError(err error) *apis.ApiError {
+	var apiErr *apis.ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	switch {
+	case errors.Is(err, plate.ErrInvalid), errors.Is(err, ErrInvalidVehicleType), errors.Is(err, ErrInvalidFilter),
+		errors.Is(err, ErrInvalidStay), errors.Is(err, ErrMaxStayExceeded), errors.Is(err, ErrRefundExceedsCaptured),
+		errors.Is(err, ErrCurrencyMismatch), errors.Is(err, ErrInvalidCurrency), errors.Is(err, ErrInvalidTaxRate),
+		errors.Is(err, ErrInvalidAccessPassEnd), errors.Is(err, ErrInvalidRefundAmount):
+		return apis.NewBadRequestError("", err)
+	case errors.Is(err, ErrNotFound):
+		return apis.NewNotFoundError("", err)
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrForbidden):
+		// the library's own credentials were rejected, not the user's
+		return apis.NewApiError(http.StatusBadGateway, "upstream-auth-failed", err)
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrInvalidPaymentTransition), errors.Is(err, ErrPaymentTransitionPending):
+		return apis.NewApiError(http.StatusConflict, "conflict", err)
+	case errors.Is(err, ErrPaymentDeclined):
+		return apis.NewApiError(http.StatusPaymentRequired, "payment-declined", err)
+	case errors.Is(err, ErrRateLimited):
+		return apis.NewApiError(http.StatusTooManyRequests, "rate-limited", err)
+	case errors.Is(err, ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return apis.NewApiError(http.StatusServiceUnavailable, "upstream-unavailable", err)
+	}
+
+	var upstreamErr *APIError
+	if errors.As(err, &upstreamErr) && upstreamErr.StatusCode >= 400 && upstreamErr.StatusCode < 500 {
+		return apis.NewBadRequestError(upstreamErr.Message, err)
+	}
+
+	return apis.NewApiError(http.StatusInternalServerError, "", err)
+}
@@ -0,0 +1,33 @@
+package innpark
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestToApiError(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want int
+	}{
+		"upstream 401":       {&APIError{Service: BACKEND_ONSTREET, StatusCode: http.StatusUnauthorized}, http.StatusBadGateway},
+		"upstream 403":       {&APIError{Service: BACKEND_PAYMENT, StatusCode: http.StatusForbidden}, http.StatusBadGateway},
+		"upstream 404":       {&APIError{Service: BACKEND_ONSTREET, StatusCode: http.StatusNotFound}, http.StatusNotFound},
+		"upstream 409":       {&APIError{Service: BACKEND_PAYMENT, StatusCode: http.StatusConflict}, http.StatusConflict},
+		"upstream 400":       {&APIError{Service: BACKEND_PAYMENT, StatusCode: http.StatusBadRequest}, http.StatusBadRequest},
+		"upstream 503":       {&APIError{Service: BACKEND_PAYMENT, StatusCode: http.StatusServiceUnavailable}, http.StatusServiceUnavailable},
+		"declined":           {&APIError{Service: BACKEND_PAYMENT, StatusCode: http.StatusPaymentRequired}, http.StatusPaymentRequired},
+		"wrapped":            {fmt.Errorf("capturing: %w", &APIError{Service: BACKEND_PAYMENT, StatusCode: http.StatusUnauthorized}), http.StatusBadGateway},
+		"deadline":           {context.DeadlineExceeded, http.StatusServiceUnavailable},
+		"invalid refund":     {ErrInvalidRefundAmount, http.StatusBadRequest},
+		"pending transition": {ErrPaymentTransitionPending, http.StatusConflict},
+		"unknown":            {fmt.Errorf("boom"), http.StatusInternalServerError},
+	}
+	for name, tt := range tests {
+		if got := ToApiError(tt.err).Code; got != tt.want {
+			t.Errorf("%s: got %d, want %d", name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package innpark
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/studiogenesisprojects/lib-innpark/plate"
+)
+
+const (
+	FREE_BAG_LEDGER_COLLECTION    = "free_bag_ledger"
+	FREE_BAG_BASELINES_COLLECTION = "free_bag_baselines"
+)
+
+// ErrNoFreeBagLedger is returned by the ledger reads of a client configured
+// without a FreeBagLedger.
+var ErrNoFreeBagLedger = errors.New("innpark: no free bag ledger configured")
+
+// FreeBagConsumption is a decrement of the free bag of a list item. StayId
+// and Plate are recorded in the ledger; entries without a plate cannot be
+// reconciled.
+type FreeBagConsumption struct {
+	ListItemId string
+	StayId     string
+	Plate      string
+	Seconds    int
+}
+
+// FreeBagEntry is a decrement recorded in the FreeBagLedger.
+type FreeBagEntry struct {
+	Id             string
+	ListItemId     string
+	StayId         string
+	Plate          string
+	Seconds        int
+	IdempotencyKey string
+	Outcome        LedgerOutcome
+	Error          string
+	Created        time.Time
+}
+
+// FreeBagLedger records every free bag decrement, keyed by list item, and
+// its upstream outcome.
+type FreeBagLedger interface {
+	Ledger[FreeBagEntry]
+	// EntriesSince returns the decrements recorded since the given time,
+	// oldest first.
+	EntriesSince(ctx context.Context, since time.Time) ([]FreeBagEntry, error)
+	// Baseline returns the reconciliation baseline of the list item, nil
+	// when none was taken yet.
+	Baseline(ctx context.Context, listItemId string) (*FreeBagBaseline, error)
+	// SaveBaseline stores the baseline of its list item, replacing the
+	// previous one.
+	SaveBaseline(ctx context.Context, baseline FreeBagBaseline) error
+}
+
+// FreeBagBaseline is what onstreet reported as consumed from the free bag of
+// a list item when its reconciliation started. Onstreet only reports
+// lifetime consumption, so ReconcileFreeBags compares what was consumed
+// since the baseline with the ledger entries recorded after it.
+type FreeBagBaseline struct {
+	ListItemId              string    `json:"list_item_id"`
+	UpstreamConsumedSeconds int       `json:"upstream_consumed_seconds"`
+	TakenAt                 time.Time `json:"taken_at"`
+}
+
+// ConsumeFreeBag decrements the free bag of a list item, recording the
+// decrement and its outcome in the FreeBagLedger when the client has one.
+func (c *Client) ConsumeFreeBag(ctx context.Context, consumption FreeBagConsumption) error {
+	ledger := c.config.FreeBagLedger
+	if ledger == nil {
+		return c.decrementFreeBagSeconds(ctx, consumption.ListItemId, consumption.Seconds)
+	}
+
+	key, ok := IdempotencyKeyFromContext(ctx)
+	if !ok {
+		key = NewIdempotencyKey()
+		ctx = WithIdempotencyKey(ctx, key)
+	}
+
+	entry := FreeBagEntry{
+		ListItemId:     consumption.ListItemId,
+		StayId:         consumption.StayId,
+		Plate:          plate.Normalize(consumption.Plate),
+		Seconds:        consumption.Seconds,
+		IdempotencyKey: key,
+		Outcome:        LEDGER_OUTCOME_PENDING,
+	}
+	return appendAndCall(c, ctx, ledger, entry, func(ctx context.Context) error {
+		return c.decrementFreeBagSeconds(ctx, consumption.ListItemId, consumption.Seconds)
+	}, "list_item_id", consumption.ListItemId)
+}
+
+// FreeBagBalance sums the ledger entries of a list item. It is what was
+// consumed through this library, not what is left of the free bag, which
+// only onstreet knows, see FreeBag.RemainingSeconds.
+type FreeBagBalance struct {
+	ListItemId string `json:"list_item_id"`
+	// ConsumedSeconds were applied upstream.
+	ConsumedSeconds int `json:"consumed_seconds"`
+	// UncertainSeconds are pending or unknown, they may or may not have
+	// been applied.
+	UncertainSeconds int `json:"uncertain_seconds"`
+	// FailedSeconds were rejected upstream.
+	FailedSeconds int       `json:"failed_seconds"`
+	Entries       int       `json:"entries"`
+	LastEntryAt   time.Time `json:"last_entry_at"`
+}
+
+// FreeBagBalance returns what the local ledger knows was consumed from the
+// free bag of the list item.
+func (c *Client) FreeBagBalance(ctx context.Context, listItemId string) (FreeBagBalance, error) {
+	if c.config.FreeBagLedger == nil {
+		return FreeBagBalance{}, ErrNoFreeBagLedger
+	}
+
+	entries, err := c.config.FreeBagLedger.Entries(ctx, listItemId)
+	if err != nil {
+		return FreeBagBalance{}, err
+	}
+
+	return freeBagBalanceOf(listItemId, entries), nil
+}
+
+func freeBagBalanceOf(listItemId string, entries []FreeBagEntry) FreeBagBalance {
+	balance := FreeBagBalance{ListItemId: listItemId, Entries: len(entries)}
+	for _, entry := range entries {
+		switch entry.Outcome {
+		case LEDGER_OUTCOME_APPLIED:
+			balance.ConsumedSeconds += entry.Seconds
+		case LEDGER_OUTCOME_FAILED:
+			balance.FailedSeconds += entry.Seconds
+		default:
+			balance.UncertainSeconds += entry.Seconds
+		}
+		if entry.Created.After(balance.LastEntryAt) {
+			balance.LastEntryAt = entry.Created
+		}
+	}
+	return balance
+}
+
+// FreeBagDrift compares, for a list item, what onstreet reports as consumed
+// since the baseline with the ledger entries recorded after it.
+// DriftSeconds is upstream minus local consumption; it is explained when it
+// lies within [0, UncertainSeconds].
+type FreeBagDrift struct {
+	ListItemId              string `json:"list_item_id"`
+	Plate                   string `json:"plate"`
+	UpstreamConsumedSeconds int    `json:"upstream_consumed_seconds"`
+	LocalConsumedSeconds    int    `json:"local_consumed_seconds"`
+	UncertainSeconds        int    `json:"uncertain_seconds"`
+	DriftSeconds            int    `json:"drift_seconds"`
+	// Baselined is set when this reconciliation took the baseline of the
+	// list item, there is nothing to compare yet.
+	Baselined bool `json:"baselined"`
+	// Missing is set when onstreet no longer returns the list item for the
+	// plate, e.g. because it expired.
+	Missing bool `json:"missing"`
+}
+
+// Explained reports whether the drift can be accounted for by the
+// decrements whose outcome is uncertain.
+func (d FreeBagDrift) Explained() bool {
+	return !d.Missing && d.DriftSeconds >= 0 && d.DriftSeconds <= d.UncertainSeconds
+}
+
+// ReconcileFreeBags compares every list item with decrements recorded since
+// the given time against GetEnrichedPlateLists and returns a drift per list
+// item. Unexplained drifts are logged.
+//
+// The first reconciliation of a list item, and any after onstreet reports
+// less consumed than before, e.g. because the free bag was renewed, takes a
+// new FreeBagBaseline instead of comparing. A decrement in flight while a
+// baseline is taken may show as a one-off drift.
+func (c *Client) ReconcileFreeBags(ctx context.Context, since time.Time) ([]FreeBagDrift, error) {
+	ledger := c.config.FreeBagLedger
+	if ledger == nil {
+		return nil, ErrNoFreeBagLedger
+	}
+
+	recent, err := ledger.EntriesSince(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+
+	// list items by plate, entries without a plate cannot be looked up
+	plates := map[string][]string{}
+	seen := map[string]bool{}
+	for _, entry := range recent {
+		if entry.Plate == "" || seen[entry.ListItemId] {
+			continue
+		}
+		seen[entry.ListItemId] = true
+		plates[entry.Plate] = append(plates[entry.Plate], entry.ListItemId)
+	}
+
+	drifts := []FreeBagDrift{}
+	for vehiclePlate, listItemIds := range plates {
+		// taken before the upstream read, so entries recorded after a new
+		// baseline are never already part of it
+		now := time.Now()
+		lists, err := c.GetEnrichedPlateLists(ctx, vehiclePlate, now)
+		if err != nil {
+			return nil, err
+		}
+		upstream := map[string]EnrichedListItem{}
+		for _, item := range lists {
+			upstream[item.Id] = item
+		}
+
+		for _, listItemId := range listItemIds {
+			drift := FreeBagDrift{ListItemId: listItemId, Plate: vehiclePlate}
+
+			item, ok := upstream[listItemId]
+			if !ok {
+				drift.Missing = true
+				drifts = append(drifts, drift)
+				continue
+			}
+			upstreamConsumed := item.Seconds - item.RemainingSeconds
+
+			baseline, err := ledger.Baseline(ctx, listItemId)
+			if err != nil {
+				return nil, err
+			}
+			if baseline == nil || upstreamConsumed < baseline.UpstreamConsumedSeconds {
+				err := ledger.SaveBaseline(ctx, FreeBagBaseline{
+					ListItemId:              listItemId,
+					UpstreamConsumedSeconds: upstreamConsumed,
+					TakenAt:                 now,
+				})
+				if err != nil {
+					return nil, err
+				}
+				drift.Baselined = true
+				drifts = append(drifts, drift)
+				continue
+			}
+
+			entries, err := ledger.Entries(ctx, listItemId)
+			if err != nil {
+				return nil, err
+			}
+			entries = slices.DeleteFunc(entries, func(entry FreeBagEntry) bool {
+				return !entry.Created.After(baseline.TakenAt)
+			})
+			balance := freeBagBalanceOf(listItemId, entries)
+
+			drift.UpstreamConsumedSeconds = upstreamConsumed - baseline.UpstreamConsumedSeconds
+			drift.LocalConsumedSeconds = balance.ConsumedSeconds
+			drift.UncertainSeconds = balance.UncertainSeconds
+			drift.DriftSeconds = drift.UpstreamConsumedSeconds - drift.LocalConsumedSeconds
+
+			if !drift.Explained() {
+				c.logger.WarnContext(ctx, "free bag drift",
+					"list_item_id", listItemId,
+					"upstream_consumed_seconds", drift.UpstreamConsumedSeconds,
+					"local_consumed_seconds", drift.LocalConsumedSeconds,
+					"uncertain_seconds", drift.UncertainSeconds,
+					"drift_seconds", drift.DriftSeconds)
+			}
+			drifts = append(drifts, drift)
+		}
+	}
+
+	return drifts, nil
+}
+
+// FreeBagReconciliationJob returns a job reconciling the list items with
+// decrements in the last window, to be scheduled with the PocketBase cron,
+// e.g. scheduler.MustAdd("free-bag-reconciliation", "0 * * * *", job).
+func (c *Client) FreeBagReconciliationJob(window time.Duration) func() {
+	return func() {
+		ctx := context.Background()
+		if _, err := c.ReconcileFreeBags(ctx, time.Now().Add(-window)); err != nil {
+			c.logger.ErrorContext(ctx, "error reconciling free bags", "error", err)
+		}
+	}
+}
+
+// pocketBaseFreeBagLedger keeps the entries in the FREE_BAG_LEDGER_COLLECTION.
+type pocketBaseFreeBagLedger struct {
+	pocketBaseLedger
+}
+
+// NewPocketBaseFreeBagLedger returns a FreeBagLedger backed by the
+// FREE_BAG_LEDGER_COLLECTION, creating the collection if needed.
+func NewPocketBaseFreeBagLedger(app core.App) (FreeBagLedger, error) {
+	err := ensureCollection(app, FREE_BAG_LEDGER_COLLECTION,
+		ledgerFields(
+			textField("list_item_id", true),
+			textField("stay_id", false),
+			textField("plate", false),
+			numberField("seconds"),
+		),
+		"CREATE INDEX idx_free_bag_ledger_list_item ON "+FREE_BAG_LEDGER_COLLECTION+" (list_item_id)",
+		"CREATE INDEX idx_free_bag_ledger_created ON "+FREE_BAG_LEDGER_COLLECTION+" (created)",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ensureCollection(app, FREE_BAG_BASELINES_COLLECTION,
+		[]*schema.SchemaField{
+			textField("list_item_id", true),
+			numberField("upstream_consumed_seconds"),
+			dateField("taken_at"),
+		},
+		"CREATE UNIQUE INDEX idx_free_bag_baselines_list_item ON "+FREE_BAG_BASELINES_COLLECTION+" (list_item_id)",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pocketBaseFreeBagLedger{pocketBaseLedger{app: app, collection: FREE_BAG_LEDGER_COLLECTION}}, nil
+}
+
+func (l *pocketBaseFreeBagLedger) Append(ctx context.Context, entry FreeBagEntry) (string, error) {
+	collection, err := l.app.Dao().FindCollectionByNameOrId(FREE_BAG_LEDGER_COLLECTION)
+	if err != nil {
+		return "", err
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("list_item_id", entry.ListItemId)
+	record.Set("stay_id", entry.StayId)
+	record.Set("plate", entry.Plate)
+	record.Set("seconds", entry.Seconds)
+	record.Set("idempotency_key", entry.IdempotencyKey)
+	record.Set("outcome", string(entry.Outcome))
+	record.Set("error", entry.Error)
+	if err := l.app.Dao().SaveRecord(record); err != nil {
+		return "", err
+	}
+
+	return record.Id, nil
+}
+
+func (l *pocketBaseFreeBagLedger) Entries(ctx context.Context, listItemId string) ([]FreeBagEntry, error) {
+	return l.find("list_item_id = {:id}", dbx.Params{"id": listItemId})
+}
+
+func (l *pocketBaseFreeBagLedger) EntriesSince(ctx context.Context, since time.Time) ([]FreeBagEntry, error) {
+	return l.find("created >= {:since}", dbx.Params{"since": FormatDateTime(since)})
+}
+
+func (l *pocketBaseFreeBagLedger) find(filter string, params dbx.Params) ([]FreeBagEntry, error) {
+	records, err := l.app.Dao().FindRecordsByFilter(FREE_BAG_LEDGER_COLLECTION, filter, "created", 0, 0, params)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]FreeBagEntry, 0, len(records))
+	for _, record := range records {
+		entries = append(entries, FreeBagEntry{
+			Id:             record.Id,
+			ListItemId:     record.GetString("list_item_id"),
+			StayId:         record.GetString("stay_id"),
+			Plate:          record.GetString("plate"),
+			Seconds:        record.GetInt("seconds"),
+			IdempotencyKey: record.GetString("idempotency_key"),
+			Outcome:        LedgerOutcome(record.GetString("outcome")),
+			Error:          record.GetString("error"),
+			Created:        record.GetDateTime("created").Time(),
+		})
+	}
+	return entries, nil
+}
+
+func (l *pocketBaseFreeBagLedger) Baseline(ctx context.Context, listItemId string) (*FreeBagBaseline, error) {
+	record, err := l.app.Dao().FindFirstRecordByData(FREE_BAG_BASELINES_COLLECTION, "list_item_id", listItemId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &FreeBagBaseline{
+		ListItemId:              record.GetString("list_item_id"),
+		UpstreamConsumedSeconds: record.GetInt("upstream_consumed_seconds"),
+		TakenAt:                 record.GetDateTime("taken_at").Time(),
+	}, nil
+}
+
+func (l *pocketBaseFreeBagLedger) SaveBaseline(ctx context.Context, baseline FreeBagBaseline) error {
+	dao := l.app.Dao()
+	record, err := dao.FindFirstRecordByData(FREE_BAG_BASELINES_COLLECTION, "list_item_id", baseline.ListItemId)
+	if errors.Is(err, sql.ErrNoRows) {
+		collection, err := dao.FindCollectionByNameOrId(FREE_BAG_BASELINES_COLLECTION)
+		if err != nil {
+			return err
+		}
+		record = models.NewRecord(collection)
+	} else if err != nil {
+		return err
+	}
+
+	record.Set("list_item_id", baseline.ListItemId)
+	record.Set("upstream_consumed_seconds", baseline.UpstreamConsumedSeconds)
+	record.Set("taken_at", baseline.TakenAt)
+	return dao.SaveRecord(record)
+}
@@ -0,0 +1,137 @@
+package innpark
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type memoryFreeBagLedger struct {
+	entries   []FreeBagEntry
+	baselines map[string]FreeBagBaseline
+}
+
+func (l *memoryFreeBagLedger) Append(ctx context.Context, entry FreeBagEntry) (string, error) {
+	entry.Id = fmt.Sprint(len(l.entries) + 1)
+	entry.Created = time.Now()
+	l.entries = append(l.entries, entry)
+	return entry.Id, nil
+}
+
+func (l *memoryFreeBagLedger) Settle(ctx context.Context, id string, outcome LedgerOutcome, message string) error {
+	for i := range l.entries {
+		if l.entries[i].Id == id {
+			l.entries[i].Outcome, l.entries[i].Error = outcome, message
+		}
+	}
+	return nil
+}
+
+func (l *memoryFreeBagLedger) Entries(ctx context.Context, listItemId string) ([]FreeBagEntry, error) {
+	var entries []FreeBagEntry
+	for _, entry := range l.entries {
+		if entry.ListItemId == listItemId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (l *memoryFreeBagLedger) EntriesSince(ctx context.Context, since time.Time) ([]FreeBagEntry, error) {
+	var entries []FreeBagEntry
+	for _, entry := range l.entries {
+		if !entry.Created.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (l *memoryFreeBagLedger) Baseline(ctx context.Context, listItemId string) (*FreeBagBaseline, error) {
+	baseline, ok := l.baselines[listItemId]
+	if !ok {
+		return nil, nil
+	}
+	return &baseline, nil
+}
+
+func (l *memoryFreeBagLedger) SaveBaseline(ctx context.Context, baseline FreeBagBaseline) error {
+	l.baselines[baseline.ListItemId] = baseline
+	return nil
+}
+
+func TestReconcileFreeBags(t *testing.T) {
+	// onstreet reports the lifetime consumption, 3000 seconds of which
+	// predate the ledger
+	remaining := 7200 - 3000
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/lists/get-enriched-plate-lists":
+			fmt.Fprintf(w, `[{"id":"li1","seconds":7200,"remaining_seconds":%d}]`, remaining)
+		case "/v1/subscriptions/decrement-free-bag-seconds":
+			var seconds int
+			fmt.Sscan(r.URL.Query().Get("seconds"), &seconds)
+			remaining -= seconds
+		}
+	}))
+	defer server.Close()
+
+	ledger := &memoryFreeBagLedger{baselines: map[string]FreeBagBaseline{}}
+	c := NewClient(Config{OnstreetURL: server.URL, FreeBagLedger: ledger})
+	ctx := context.Background()
+	since := time.Now().Add(-time.Hour)
+
+	consume := func(seconds int) {
+		t.Helper()
+		if err := c.ConsumeFreeBag(ctx, FreeBagConsumption{ListItemId: "li1", Plate: "1234BCD", Seconds: seconds}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconcile := func() FreeBagDrift {
+		t.Helper()
+		drifts, err := c.ReconcileFreeBags(ctx, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(drifts) != 1 {
+			t.Fatalf("got %d drifts, want 1", len(drifts))
+		}
+		return drifts[0]
+	}
+
+	consume(600)
+	if drift := reconcile(); !drift.Baselined {
+		t.Fatalf("first reconciliation: got %+v, want a baseline", drift)
+	}
+
+	time.Sleep(time.Millisecond)
+	consume(300)
+	drift := reconcile()
+	if drift.Baselined || drift.UpstreamConsumedSeconds != 300 || drift.LocalConsumedSeconds != 300 || !drift.Explained() {
+		t.Errorf("after the baseline: got %+v, want 300 seconds on both sides", drift)
+	}
+
+	// a decrement applied upstream without going through the ledger
+	remaining -= 120
+	drift = reconcile()
+	if drift.DriftSeconds != 120 || drift.Explained() {
+		t.Errorf("untracked decrement: got %+v, want an unexplained drift of 120", drift)
+	}
+
+	// a renewed free bag takes a new baseline
+	remaining = 7200
+	if drift := reconcile(); !drift.Baselined {
+		t.Errorf("renewed free bag: got %+v, want a new baseline", drift)
+	}
+
+	balance, err := c.FreeBagBalance(ctx, "li1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.ConsumedSeconds != 900 || balance.Entries != 2 {
+		t.Errorf("got balance %+v, want 900 seconds in 2 entries", balance)
+	}
+}
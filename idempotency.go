@@ -0,0 +1,317 @@
+package innpark
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER      = "Idempotency-Key"
+	IDEMPOTENCY_KEYS_COLLECTION = "idempotency_keys"
+
+	IDEMPOTENCY_STATUS_PENDING   = "pending"
+	IDEMPOTENCY_STATUS_COMPLETED = "completed"
+	IDEMPOTENCY_STATUS_UNKNOWN   = "unknown"
+)
+
+var (
+	// ErrIdempotencyKeyInFlight is returned when another call holding the
+	// same key has not finished yet.
+	ErrIdempotencyKeyInFlight = errors.New("innpark: idempotency key in flight")
+	// ErrIdempotencyKeyReused is returned when a key is replayed against a
+	// different operation than the one it was first used for.
+	ErrIdempotencyKeyReused = errors.New("innpark: idempotency key reused for a different operation")
+	// ErrIdempotencyOutcomeUnknown is returned for a key whose call may or
+	// may not have been applied upstream, e.g. after a timeout, until it is
+	// resolved with ResolveIdempotencyKey.
+	ErrIdempotencyOutcomeUnknown = errors.New("innpark: idempotency key outcome unknown")
+	// ErrNoIdempotencyStore is returned by ResolveIdempotencyKey on a client
+	// configured without an IdempotencyStore.
+	ErrNoIdempotencyStore = errors.New("innpark: no idempotency store configured")
+)
+
+type idempotencyKeyContextKey struct{}
+
+// WithIdempotencyKey attaches the key to the mutating calls made with ctx.
+// Use one key per logical operation and reuse it when retrying that
+// operation; calls without a key get a fresh one, which only protects the
+// retries made by the transport itself.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key, ok && key != ""
+}
+
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// IdempotencyRecord is the stored outcome of a mutating call.
+type IdempotencyRecord struct {
+	Key       string
+	Operation string
+	Response  json.RawMessage
+}
+
+// IdempotencyStore persists the outcome of mutating calls so a replayed key
+// returns the original result instead of repeating the side effect.
+type IdempotencyStore interface {
+	// Reserve claims the key for operation. It returns the stored record
+	// when the key already completed, ErrIdempotencyKeyInFlight when it is
+	// claimed by a call still running, ErrIdempotencyOutcomeUnknown when
+	// its call ended without a usable answer, or was abandoned, and
+	// ErrIdempotencyKeyReused when it was claimed for another operation.
+	Reserve(ctx context.Context, key string, operation string) (*IdempotencyRecord, error)
+	// Complete stores the upstream response of a reserved key.
+	Complete(ctx context.Context, key string, response json.RawMessage) error
+	// MarkUnknown records that the call of a reserved key may have been
+	// applied, so the key is neither replayed nor sent again.
+	MarkUnknown(ctx context.Context, key string) error
+	// Release frees a reserved key after a call rejected upstream so it can
+	// be retried.
+	Release(ctx context.Context, key string) error
+	// Prune deletes the records last updated before the given time.
+	Prune(ctx context.Context, before time.Time) error
+}
+
+// doIdempotent is doJSON for mutating calls. It attaches an idempotency key
+// and, when the client has an IdempotencyStore and the caller supplied the
+// key, replays stored outcomes. Generated keys are sent but not stored, as
+// nobody can replay them.
+func (c *Client) doIdempotent(ctx context.Context, service Backend, operation string, method string, rawUrl string, body io.Reader, out any) error {
+	key, ok := IdempotencyKeyFromContext(ctx)
+	if !ok {
+		key = NewIdempotencyKey()
+		ctx = WithIdempotencyKey(ctx, key)
+	}
+
+	store := c.config.IdempotencyStore
+	if store == nil || !ok {
+		return c.doJSON(ctx, service, operation, method, rawUrl, body, out)
+	}
+
+	// keys are bound to the exact request they were first used for, body
+	// included, so a key reused with another amount is not replayed
+	requestLine := method + " " + rawUrl
+	if u, err := url.Parse(rawUrl); err == nil {
+		requestLine = method + " " + u.RequestURI()
+	}
+	if body != nil {
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(raw)
+		requestLine += " " + hex.EncodeToString(sum[:])
+		body = bytes.NewReader(raw)
+	}
+
+	record, err := store.Reserve(ctx, key, requestLine)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		c.logger.InfoContext(ctx, "replaying idempotent response",
+			"backend", string(service),
+			"operation", operation,
+			"idempotency_key", key)
+		return decodeStoredResponse(record.Response, out)
+	}
+
+	var response json.RawMessage
+	if err := c.doJSON(ctx, service, operation, method, rawUrl, body, &response); err != nil {
+		// only a rejection proves nothing happened upstream; after a timeout
+		// or a 5xx, sending the key again could apply the call twice
+		release, action := store.Release, "releasing"
+		if !isUpstreamRejection(err) {
+			release, action = store.MarkUnknown, "marking unknown"
+		}
+		if releaseErr := release(context.WithoutCancel(ctx), key); releaseErr != nil {
+			c.logger.ErrorContext(ctx, "error "+action+" idempotency key",
+				"backend", string(service),
+				"operation", operation,
+				"idempotency_key", key,
+				"error", releaseErr)
+		}
+		return err
+	}
+
+	// the side effect already happened upstream, so a failure to store it
+	// must not be reported as a failed call
+	if err := store.Complete(context.WithoutCancel(ctx), key, response); err != nil {
+		c.logger.ErrorContext(ctx, "error storing idempotent response",
+			"backend", string(service),
+			"operation", operation,
+			"idempotency_key", key,
+			"error", err)
+	}
+
+	return decodeStoredResponse(response, out)
+}
+
+// ResolveIdempotencyKey settles a key left with an unknown outcome once it
+// is known, e.g. from the upstream API: applied replays an empty response
+// for the key from then on, otherwise the key is freed to be sent again.
+func (c *Client) ResolveIdempotencyKey(ctx context.Context, key string, applied bool) error {
+	store := c.config.IdempotencyStore
+	if store == nil {
+		return ErrNoIdempotencyStore
+	}
+
+	if applied {
+		return store.Complete(ctx, key, nil)
+	}
+	return store.Release(ctx, key)
+}
+
+func decodeStoredResponse(response json.RawMessage, out any) error {
+	if out == nil || len(response) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response, out)
+}
+
+// pocketBaseIdempotencyStore keeps the records in the IDEMPOTENCY_KEYS_COLLECTION.
+type pocketBaseIdempotencyStore struct {
+	app core.App
+	// pendingTTL is how long a reservation is reported in flight before it
+	// is considered abandoned, e.g. after a crash mid-call, and its outcome
+	// unknown.
+	pendingTTL time.Duration
+}
+
+// NewPocketBaseIdempotencyStore returns an IdempotencyStore backed by the
+// IDEMPOTENCY_KEYS_COLLECTION, creating the collection if needed.
+func NewPocketBaseIdempotencyStore(app core.App) (IdempotencyStore, error) {
+	err := ensureCollection(app, IDEMPOTENCY_KEYS_COLLECTION,
+		[]*schema.SchemaField{
+			textField("idempotency_key", true),
+			textField("operation", true),
+			textField("status", true),
+			jsonField("response"),
+		},
+		"CREATE UNIQUE INDEX idx_idempotency_keys_key ON "+IDEMPOTENCY_KEYS_COLLECTION+" (idempotency_key)",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pocketBaseIdempotencyStore{app: app, pendingTTL: 5 * time.Minute}, nil
+}
+
+func (s *pocketBaseIdempotencyStore) Reserve(ctx context.Context, key string, operation string) (*IdempotencyRecord, error) {
+	dao := s.app.Dao()
+
+	record, err := dao.FindFirstRecordByData(IDEMPOTENCY_KEYS_COLLECTION, "idempotency_key", key)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if record == nil {
+		collection, err := dao.FindCollectionByNameOrId(IDEMPOTENCY_KEYS_COLLECTION)
+		if err != nil {
+			return nil, err
+		}
+
+		record = models.NewRecord(collection)
+		record.Set("idempotency_key", key)
+		record.Set("operation", operation)
+		record.Set("status", IDEMPOTENCY_STATUS_PENDING)
+		if err := dao.SaveRecord(record); err != nil {
+			// lost the race against a concurrent reservation of the same key
+			return nil, ErrIdempotencyKeyInFlight
+		}
+		return nil, nil
+	}
+
+	if record.GetString("operation") != operation {
+		return nil, ErrIdempotencyKeyReused
+	}
+
+	switch record.GetString("status") {
+	case IDEMPOTENCY_STATUS_COMPLETED:
+		var response json.RawMessage
+		if raw := record.Get("response"); raw != nil {
+			response, _ = json.Marshal(raw)
+		}
+		return &IdempotencyRecord{Key: key, Operation: operation, Response: response}, nil
+	case IDEMPOTENCY_STATUS_UNKNOWN:
+		return nil, ErrIdempotencyOutcomeUnknown
+	}
+
+	if time.Since(record.GetDateTime("updated").Time()) < s.pendingTTL {
+		return nil, ErrIdempotencyKeyInFlight
+	}
+	// an abandoned call may have reached upstream, so it is not reclaimed
+	return nil, ErrIdempotencyOutcomeUnknown
+}
+
+func (s *pocketBaseIdempotencyStore) Complete(ctx context.Context, key string, response json.RawMessage) error {
+	record, err := s.app.Dao().FindFirstRecordByData(IDEMPOTENCY_KEYS_COLLECTION, "idempotency_key", key)
+	if err != nil {
+		return err
+	}
+
+	record.Set("status", IDEMPOTENCY_STATUS_COMPLETED)
+	record.Set("response", response)
+	return s.app.Dao().SaveRecord(record)
+}
+
+func (s *pocketBaseIdempotencyStore) MarkUnknown(ctx context.Context, key string) error {
+	record, err := s.app.Dao().FindFirstRecordByData(IDEMPOTENCY_KEYS_COLLECTION, "idempotency_key", key)
+	if err != nil {
+		return err
+	}
+
+	record.Set("status", IDEMPOTENCY_STATUS_UNKNOWN)
+	return s.app.Dao().SaveRecord(record)
+}
+
+func (s *pocketBaseIdempotencyStore) Release(ctx context.Context, key string) error {
+	record, err := s.app.Dao().FindFirstRecordByData(IDEMPOTENCY_KEYS_COLLECTION, "idempotency_key", key)
+	if err != nil {
+		return err
+	}
+
+	return s.app.Dao().DeleteRecord(record)
+}
+
+func (s *pocketBaseIdempotencyStore) Prune(ctx context.Context, before time.Time) error {
+	_, err := s.app.Dao().DB().Delete(IDEMPOTENCY_KEYS_COLLECTION, dbx.NewExp("updated < {:before}", dbx.Params{"before": FormatDateTime(before)})).Execute()
+	return err
+}
+
+// IdempotencyCleanupJob returns a job deleting the idempotency records older
+// than retention, to be scheduled with the PocketBase cron, e.g.
+// scheduler.MustAdd("idempotency-cleanup", "0 3 * * *", job). Keys replayed
+// after retention are sent upstream again.
+func (c *Client) IdempotencyCleanupJob(retention time.Duration) func() {
+	return func() {
+		ctx := context.Background()
+		store := c.config.IdempotencyStore
+		if store == nil {
+			return
+		}
+		if err := store.Prune(ctx, time.Now().Add(-retention)); err != nil {
+			c.logger.ErrorContext(ctx, "error pruning idempotency keys", "error", err)
+		}
+	}
+}
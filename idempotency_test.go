@@ -0,0 +1,166 @@
+package innpark
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type memoryIdempotencyStore struct {
+	records map[string]*IdempotencyRecord
+	done    map[string]bool
+	unknown map[string]bool
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[string]*IdempotencyRecord{}, done: map[string]bool{}, unknown: map[string]bool{}}
+}
+
+func (s *memoryIdempotencyStore) Reserve(ctx context.Context, key string, operation string) (*IdempotencyRecord, error) {
+	record, ok := s.records[key]
+	if !ok {
+		s.records[key] = &IdempotencyRecord{Key: key, Operation: operation}
+		return nil, nil
+	}
+	if record.Operation != operation {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if s.unknown[key] {
+		return nil, ErrIdempotencyOutcomeUnknown
+	}
+	if !s.done[key] {
+		return nil, ErrIdempotencyKeyInFlight
+	}
+	return record, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, key string, response json.RawMessage) error {
+	record, ok := s.records[key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	record.Response = response
+	s.done[key] = true
+	delete(s.unknown, key)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) MarkUnknown(ctx context.Context, key string) error {
+	s.unknown[key] = true
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	delete(s.records, key)
+	delete(s.unknown, key)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Prune(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+func TestDoIdempotent(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"Payable":{"id":"p1","last_payment_id":"pay1"}}`))
+	}))
+	defer server.Close()
+
+	store := newMemoryIdempotencyStore()
+	c := NewClient(Config{PaymentURL: server.URL, IdempotencyStore: store})
+	url := server.URL + "/v1/services/p1/payments/refund-partial-amount"
+
+	refund := func(ctx context.Context, amount int) error {
+		body, _ := jsonBody(RefundPartialRequest{Amount: amount})
+		return c.doIdempotent(ctx, BACKEND_PAYMENT, "RefundPartialPaymentFromService", "POST", url, body, nil)
+	}
+
+	// generated keys are not stored
+	if err := refund(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.records) != 0 {
+		t.Errorf("stored %d records for a generated key", len(store.records))
+	}
+
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	if err := refund(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := refund(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("got %d upstream calls, want the replay to be served locally", calls)
+	}
+
+	if err := refund(ctx, 200); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("reusing a key with another body: got %v, want ErrIdempotencyKeyReused", err)
+	}
+}
+
+func TestDoIdempotentUnknownOutcome(t *testing.T) {
+	calls, status := 0, http.StatusGatewayTimeout
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	store := newMemoryIdempotencyStore()
+	c := NewClient(Config{PaymentURL: server.URL, IdempotencyStore: store})
+	url := server.URL + "/v1/services/p1/payments/confirm"
+	confirm := func(ctx context.Context) error {
+		body, _ := jsonBody(EmptyRequest{})
+		return c.doIdempotent(ctx, BACKEND_PAYMENT, "ConfirmPreautorhization", "POST", url, body, nil)
+	}
+
+	// the timed out confirm may have been applied, so it is not resent
+	ctx := WithIdempotencyKey(context.Background(), "k1")
+	if err := confirm(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v, want ErrUnavailable", err)
+	}
+	status = http.StatusOK
+	if err := confirm(ctx); !errors.Is(err, ErrIdempotencyOutcomeUnknown) {
+		t.Errorf("retry after a timeout: got %v, want ErrIdempotencyOutcomeUnknown", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d upstream calls, want 1", calls)
+	}
+
+	if err := c.ResolveIdempotencyKey(ctx, "k1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := confirm(ctx); err != nil {
+		t.Errorf("retry once applied: got %v, want the replay", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d upstream calls, want the replay to be served locally", calls)
+	}
+
+	// a rejection frees the key
+	status = http.StatusUnprocessableEntity
+	ctx = WithIdempotencyKey(context.Background(), "k2")
+	if err := confirm(ctx); err == nil {
+		t.Fatal("rejected confirm succeeded")
+	}
+	status = http.StatusOK
+	if err := confirm(ctx); err != nil {
+		t.Errorf("retry after a rejection: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d upstream calls, want 3", calls)
+	}
+
+	if err := NewClient(Config{}).ResolveIdempotencyKey(ctx, "k1", true); !errors.Is(err, ErrNoIdempotencyStore) {
+		t.Errorf("no store: got %v, want ErrNoIdempotencyStore", err)
+	}
+}
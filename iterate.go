@@ -0,0 +1,94 @@
+package innpark
+
+import (
+	"context"
+	"iter"
+)
+
+// maxPerPage is the default page size of Iterate, the most PocketBase allows.
+const maxPerPage = 500
+
+// Iterate streams the records of an upstream /collections/<name>/records
+// endpoint matching the query, page by page. The page size is the query's
+// PerPage, 500 when unset, and iteration starts at its Page. The next page is
+// fetched while the current one is being consumed.
+//
+// An error ends the iteration; it is yielded with the zero T.
+func Iterate[T any](ctx context.Context, c *Client, service Backend, collection string, query Query) iter.Seq2[T, error] {
+	return iterate[T](ctx, c, service, "Iterate", collection, query)
+}
+
+// iterate is Iterate reporting the reads as the given operation.
+func iterate[T any](ctx context.Context, c *Client, service Backend, operation string, collection string, query Query) iter.Seq2[T, error] {
+	if query.perPage <= 0 {
+		query = query.PerPage(maxPerPage)
+	}
+
+	type result struct {
+		records *RecordsPage[T]
+		err     error
+	}
+
+	return func(yield func(T, error) bool) {
+		// cancels the prefetch when the consumer stops early
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		fetch := func(page int) <-chan result {
+			next := make(chan result, 1)
+			go func() {
+				records := &RecordsPage[T]{}
+				url, err := c.recordsURL(service, collection, query.Page(page))
+				if err == nil {
+					err = c.doJSON(ctx, service, operation, "GET", url, nil, records)
+				}
+				next <- result{records, err}
+			}()
+			return next
+		}
+
+		page := max(query.page, 1)
+		next := fetch(page)
+		for {
+			r := <-next
+			if r.err != nil {
+				var zero T
+				yield(zero, r.err)
+				return
+			}
+
+			perPage := query.perPage
+			if r.records.PerPage > 0 {
+				perPage = r.records.PerPage
+			}
+			// TotalPages is -1 when the query skips the total
+			last := len(r.records.Items) < perPage ||
+				(r.records.TotalPages >= 0 && page >= r.records.TotalPages)
+			if !last {
+				page++
+				next = fetch(page)
+			}
+
+			for _, item := range r.records.Items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+			if last {
+				return
+			}
+		}
+	}
+}
+
+// collect drains the sequence, stopping at the first error.
+func collect[T any](seq iter.Seq2[T, error]) ([]T, error) {
+	items := []T{}
+	for item, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
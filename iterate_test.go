@@ -0,0 +1,148 @@
+package innpark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type iterateRecord struct {
+	N int `json:"n"`
+}
+
+// recordsServer serves total records of any collection, paginated like
+// PocketBase. before, when set, runs first and may answer the request.
+func recordsServer(t *testing.T, total int, before func(w http.ResponseWriter, r *http.Request, page int) bool) (*Client, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("perPage"))
+		if before != nil && before(w, r, page) {
+			return
+		}
+
+		records := RecordsPage[iterateRecord]{Page: page, PerPage: perPage, TotalItems: total, TotalPages: (total + perPage - 1) / perPage}
+		if r.URL.Query().Get("skipTotal") != "" {
+			records.TotalItems, records.TotalPages = -1, -1
+		}
+		for n := (page - 1) * perPage; n < min(page*perPage, total); n++ {
+			records.Items = append(records.Items, iterateRecord{n})
+		}
+		json.NewEncoder(w).Encode(records)
+	}))
+	t.Cleanup(server.Close)
+
+	return NewClient(Config{OnstreetURL: server.URL, Retry: RetryPolicy{MaxAttempts: 1}}), &calls
+}
+
+func TestIterate(t *testing.T) {
+	tests := []struct {
+		name      string
+		total     int
+		query     Query
+		wantCalls int32
+	}{
+		{name: "partial last page", total: 7, query: NewQuery().PerPage(3), wantCalls: 3},
+		{name: "full last page", total: 6, query: NewQuery().PerPage(3), wantCalls: 2},
+		{name: "empty", total: 0, query: NewQuery().PerPage(3), wantCalls: 1},
+		{name: "from a later page", total: 7, query: NewQuery().PerPage(3).Page(2), wantCalls: 2},
+		// without the total a full last page is only known by the next one
+		{name: "skip total", total: 6, query: NewQuery().PerPage(3).SkipTotal(), wantCalls: 3},
+		{name: "skip total partial last page", total: 7, query: NewQuery().PerPage(3).SkipTotal(), wantCalls: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, calls := recordsServer(t, tt.total, nil)
+
+			want := 0
+			if tt.query.page > 1 {
+				want = (tt.query.page - 1) * tt.query.perPage
+			}
+			for record, err := range Iterate[iterateRecord](context.Background(), c, BACKEND_ONSTREET, "items", tt.query) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.N != want {
+					t.Fatalf("got record %d, want %d", record.N, want)
+				}
+				want++
+			}
+			if want != tt.total {
+				t.Errorf("got %d records, want %d", want, tt.total)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("got %d requests, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIterateBreakCancelsPrefetch(t *testing.T) {
+	prefetching := make(chan struct{})
+	cancelled := make(chan struct{})
+	c, _ := recordsServer(t, 10, func(w http.ResponseWriter, r *http.Request, page int) bool {
+		if page == 1 {
+			return false
+		}
+		close(prefetching)
+		<-r.Context().Done()
+		close(cancelled)
+		return true
+	})
+
+	for range Iterate[iterateRecord](context.Background(), c, BACKEND_ONSTREET, "items", NewQuery().PerPage(5)) {
+		<-prefetching
+		break
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the prefetch of the next page was not cancelled")
+	}
+}
+
+func TestIteratePageError(t *testing.T) {
+	c, calls := recordsServer(t, 10, func(w http.ResponseWriter, r *http.Request, page int) bool {
+		if page != 2 {
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	})
+
+	var records []iterateRecord
+	var errs []error
+	for record, err := range Iterate[iterateRecord](context.Background(), c, BACKEND_ONSTREET, "items", NewQuery().PerPage(5)) {
+		if err != nil {
+			errs = append(errs, err)
+			if record != (iterateRecord{}) {
+				t.Errorf("got %+v with the error, want the zero record", record)
+			}
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 5 {
+		t.Errorf("got %d records, want the 5 of the first page", len(records))
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrUnavailable) {
+		t.Errorf("got errors %v, want a single ErrUnavailable", errs)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("got %d requests, want the iteration to stop at the error", calls.Load())
+	}
+
+	if _, err := collect(Iterate[iterateRecord](context.Background(), c, BACKEND_ONSTREET, "items", NewQuery().PerPage(5))); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("collect: got %v, want ErrUnavailable", err)
+	}
+}
@@ -0,0 +1,106 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+// LedgerOutcome is what became upstream of the call recorded by a ledger
+// entry.
+type LedgerOutcome string
+
+const (
+	LEDGER_OUTCOME_PENDING LedgerOutcome = "pending" // sent, no answer yet
+	LEDGER_OUTCOME_APPLIED LedgerOutcome = "applied"
+	LEDGER_OUTCOME_FAILED  LedgerOutcome = "failed"  // rejected upstream, or before reaching it
+	LEDGER_OUTCOME_UNKNOWN LedgerOutcome = "unknown" // no usable answer, it may have been applied
+)
+
+// Uncertain reports whether the call may or may not have been applied.
+func (o LedgerOutcome) Uncertain() bool {
+	return o == LEDGER_OUTCOME_PENDING || o == LEDGER_OUTCOME_UNKNOWN
+}
+
+// Ledger records the upstream calls with a side effect that must be
+// accounted for, such as refunds and free bag decrements, with their
+// outcome. E is the entry type, keyed by the id of the refunded payable or
+// of the consumed list item.
+type Ledger[E any] interface {
+	// Append records a pending entry and returns its id.
+	Append(ctx context.Context, entry E) (string, error)
+	// Settle stores the upstream outcome of an appended entry.
+	Settle(ctx context.Context, id string, outcome LedgerOutcome, message string) error
+	// Entries returns the entries of the payable or list item, oldest
+	// first.
+	Entries(ctx context.Context, subjectId string) ([]E, error)
+}
+
+// appendAndCall records entry in the ledger, pending, before running call and
+// settles it with the outcome of call. Writing it first means a crash leaves
+// a pending entry behind rather than an untracked side effect.
+func appendAndCall[E any](c *Client, ctx context.Context, ledger Ledger[E], entry E, call func(ctx context.Context) error, logAttrs ...any) error {
+	id, err := ledger.Append(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	err = call(ctx)
+	settleLedgerEntry(c, ctx, ledger, id, err, logAttrs...)
+	return err
+}
+
+// settleLedgerEntry settles the entry with the outcome of callErr, logging
+// a failure to do so rather than masking the outcome of the call.
+func settleLedgerEntry[E any](c *Client, ctx context.Context, ledger Ledger[E], id string, callErr error, logAttrs ...any) {
+	outcome, message := LEDGER_OUTCOME_APPLIED, ""
+	if callErr != nil {
+		outcome, message = ledgerOutcomeOf(callErr), callErr.Error()
+	}
+
+	if err := ledger.Settle(context.WithoutCancel(ctx), id, outcome, message); err != nil {
+		c.logger.ErrorContext(ctx, "error settling ledger entry",
+			append(logAttrs,
+				"entry_id", id,
+				"outcome", string(outcome),
+				"error", err)...)
+	}
+}
+
+// ledgerOutcomeOf tells a call rejected, upstream or before reaching it,
+// apart from one whose fate is unknown.
+func ledgerOutcomeOf(err error) LedgerOutcome {
+	if isUpstreamRejection(err) || errors.Is(err, ErrInvalidPaymentTransition) || errors.Is(err, ErrPaymentTransitionPending) {
+		return LEDGER_OUTCOME_FAILED
+	}
+	return LEDGER_OUTCOME_UNKNOWN
+}
+
+// pocketBaseLedger holds what the PocketBase-backed ledgers share: entries
+// carry their outcome and error, settled in place.
+type pocketBaseLedger struct {
+	app        core.App
+	collection string
+}
+
+// ledgerFields are the fields every ledger collection has.
+func ledgerFields(fields ...*schema.SchemaField) []*schema.SchemaField {
+	return append(fields,
+		textField("idempotency_key", false),
+		textField("outcome", true),
+		textField("error", false),
+	)
+}
+
+func (l *pocketBaseLedger) Settle(ctx context.Context, id string, outcome LedgerOutcome, message string) error {
+	record, err := l.app.Dao().FindRecordById(l.collection, id)
+	if err != nil {
+		return err
+	}
+
+	record.Set("outcome", string(outcome))
+	record.Set("error", message)
+	return l.app.Dao().SaveRecord(record)
+}
@@ -0,0 +1,215 @@
+package innpark
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const REDACTED = "[REDACTED]"
+
+// DefaultRedactedKeys are the log attribute and query parameter names whose
+// values are replaced with REDACTED, compared case-insensitively.
+var DefaultRedactedKeys = []string{
+	"authorization",
+	"token",
+	"tokens",
+	"plate",
+	"vehicle_plate",
+	"email",
+	"payment_method_id",
+	"paymentMethodId",
+}
+
+// DefaultRedactedPatterns match the sensitive values that are not behind a
+// sensitive key: emails, Spanish plates and bearer tokens in log messages,
+// error strings, URL paths and query values.
+var DefaultRedactedPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	regexp.MustCompile(`(?i)\b[0-9]{4}[ -]?[BCDFGHJKLMNPRSTVWXYZ]{3}\b`),
+	regexp.MustCompile(`\b[A-Z]{1,2}[ -]?[0-9]{4}[ -]?[A-Z]{1,2}\b`),
+	regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+}
+
+// filterComparisonRegex matches the comparisons of a PocketBase filter
+// expression, e.g. plate='1234ABC'.
+var filterComparisonRegex = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_.]*)(\s*[!?]?[=~<>]+\s*)(\'[^\']*\'|"[^"]*")`)
+
+// newLogger wraps the caller supplied logger so every record it emits goes
+// through redaction. A nil logger discards everything.
+func newLogger(config Config) *slog.Logger {
+	if config.Logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return newRedactor(config).logger(config.Logger)
+}
+
+// redactor masks the values of sensitive keys and the matches of sensitive
+// patterns, in the logs and in the error text sent to other sinks such as
+// the tracing backend. A nil redactor leaves everything as is.
+type redactor struct {
+	keys     map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// newRedactor returns the redactor of the RedactedKeys and RedactedPatterns
+// of config, or nil when both are disabled.
+func newRedactor(config Config) *redactor {
+	keys := config.RedactedKeys
+	if keys == nil {
+		keys = DefaultRedactedKeys
+	}
+	patterns := config.RedactedPatterns
+	if patterns == nil {
+		patterns = DefaultRedactedPatterns
+	}
+	if len(keys) == 0 && len(patterns) == 0 {
+		return nil
+	}
+
+	r := &redactor{keys: map[string]bool{}, patterns: patterns}
+	for _, key := range keys {
+		r.keys[strings.ToLower(key)] = true
+	}
+	return r
+}
+
+// logger returns a logger redacting every record before handing it to
+// logger.
+func (r *redactor) logger(logger *slog.Logger) *slog.Logger {
+	if r == nil {
+		return logger
+	}
+	return slog.New(&redactingHandler{next: logger.Handler(), redactor: r})
+}
+
+// redactingHandler replaces the values of sensitive attributes and the
+// sensitive values found anywhere in the record, message included, before
+// handing it to the wrapped handler.
+type redactingHandler struct {
+	next slog.Handler
+	*redactor
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactText(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redact(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redact(attr)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+func (r *redactor) redact(attr slog.Attr) slog.Attr {
+	if r.keys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, REDACTED)
+	}
+
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, member := range group {
+			redacted[i] = r.redact(member)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindString:
+		return slog.String(attr.Key, r.redactText(value.String()))
+	case slog.KindAny:
+		// errors such as APIError embed the request URL in their message,
+		// and any other value may hold a plate or an email, so they are
+		// logged as their redacted text
+		if err, ok := value.Any().(error); ok {
+			return slog.String(attr.Key, r.redactText(err.Error()))
+		}
+		return slog.String(attr.Key, r.redactText(fmt.Sprintf("%+v", value.Any())))
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+// redactText redacts the sensitive query parameters of the URLs found in a
+// free form text, then every match of the patterns.
+func (r *redactor) redactText(text string) string {
+	if r == nil {
+		return text
+	}
+	if strings.Contains(text, "://") && strings.Contains(text, "?") {
+		words := strings.Split(text, " ")
+		for i, word := range words {
+			start := strings.Index(word, "http")
+			if start < 0 || !strings.Contains(word, "://") {
+				continue
+			}
+			end := len(word) - len(strings.TrimRight(word, "),"))
+			words[i] = word[:start] + r.redactURL(word[start:len(word)-end]) + word[len(word)-end:]
+		}
+		text = strings.Join(words, " ")
+	}
+	return r.redactPatterns(text)
+}
+
+func (r *redactor) redactPatterns(text string) string {
+	for _, pattern := range r.patterns {
+		text = pattern.ReplaceAllLiteralString(text, REDACTED)
+	}
+	return text
+}
+
+// redactURL redacts the sensitive query parameters of a URL, the values
+// compared with a sensitive field in a PocketBase filter expression and the
+// matches of the patterns in the decoded query values.
+func (r *redactor) redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.RawQuery == "" {
+		return raw
+	}
+
+	query := u.Query()
+	for name, values := range query {
+		for i, value := range values {
+			if r.keys[strings.ToLower(name)] {
+				values[i] = REDACTED
+				continue
+			}
+			values[i] = r.redactPatterns(r.redactFilter(value))
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redactFilter redacts the operands of the comparisons with a sensitive
+// field of a PocketBase filter expression.
+func (r *redactor) redactFilter(filter string) string {
+	return filterComparisonRegex.ReplaceAllStringFunc(filter, func(comparison string) string {
+		match := filterComparisonRegex.FindStringSubmatch(comparison)
+		field := strings.ToLower(match[1])
+		if !r.keys[field] && !r.keys[field[strings.LastIndex(field, ".")+1:]] {
+			return comparison
+		}
+		quote := match[3][:1]
+		return match[1] + match[2] + quote + REDACTED + quote
+	})
+}
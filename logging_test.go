@@ -0,0 +1,151 @@
+package innpark
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestRedactingHandler(t *testing.T) {
+	type vehicle struct {
+		Plate string
+		Owner string
+	}
+
+	tests := []struct {
+		name  string
+		log   func(logger *slog.Logger)
+		leaks []string
+		keeps []string
+	}{
+		{
+			name:  "sensitive key",
+			log:   func(l *slog.Logger) { l.Info("vehicle", "plate", "whatever") },
+			leaks: []string{"whatever"},
+		},
+		{
+			name:  "plate and email in message",
+			log:   func(l *slog.Logger) { l.Info("vehicle 1234 BCD of jane@example.com not found") },
+			leaks: []string{"1234 BCD", "jane@example.com"},
+			keeps: []string{"not found"},
+		},
+		{
+			name:  "old provincial plate",
+			log:   func(l *slog.Logger) { l.Info("lookup", "value", "M 1234 AB") },
+			leaks: []string{"M 1234 AB"},
+		},
+		{
+			name:  "upstream error",
+			log:   func(l *slog.Logger) { l.Error("call failed", "error", errors.New("vehicle 1234BCD already exists")) },
+			leaks: []string{"1234BCD"},
+			keeps: []string{"already exists"},
+		},
+		{
+			name:  "URL path",
+			log:   func(l *slog.Logger) { l.Info("request", "url", "https://api.test/v1/vehicles/1234BCD/delete") },
+			leaks: []string{"1234BCD"},
+			keeps: []string{"/v1/vehicles/"},
+		},
+		{
+			name: "filter query value",
+			log: func(l *slog.Logger) {
+				l.Info("request", "url", "https://api.test/v1/vehicles?filter=vehicle.plate%3D%27XYZ%27+%26%26+status%3D%27active%27")
+			},
+			leaks: []string{"XYZ"},
+			keeps: []string{"active"},
+		},
+		{
+			name:  "query value mentioning a key",
+			log:   func(l *slog.Logger) { l.Info("request", "url", "https://api.test/v1/parkings?name=token+plaza") },
+			keeps: []string{"token+plaza"},
+		},
+		{
+			name: "sensitive query parameter",
+			log: func(l *slog.Logger) {
+				l.Info("request", "url", "https://api.test/v1/users?email=jane%40example.com&page=2")
+			},
+			leaks: []string{"jane"},
+			keeps: []string{"page=2"},
+		},
+		{
+			name:  "bearer token",
+			log:   func(l *slog.Logger) { l.Info("request", "header", "Bearer abc.def.ghi") },
+			leaks: []string{"abc.def.ghi"},
+		},
+		{
+			name: "struct value",
+			log: func(l *slog.Logger) {
+				l.Info("vehicle", "vehicle", vehicle{Plate: "1234BCD", Owner: "jane@example.com"})
+			},
+			leaks: []string{"1234BCD", "jane@example.com"},
+		},
+		{
+			name: "group",
+			log: func(l *slog.Logger) {
+				l.Info("vehicle", slog.Group("vehicle", "id", "abc123", "note", "owner jane@example.com"))
+			},
+			leaks: []string{"jane@example.com"},
+			keeps: []string{"abc123"},
+		},
+		{
+			name:  "with attrs",
+			log:   func(l *slog.Logger) { l.With("email", "jane@example.com").Info("vehicle") },
+			leaks: []string{"jane@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tt.log(newLogger(Config{Logger: slog.New(slog.NewTextHandler(&out, nil))}))
+
+			for _, leak := range tt.leaks {
+				if strings.Contains(out.String(), leak) {
+					t.Errorf("%q leaked in %s", leak, out.String())
+				}
+			}
+			for _, keep := range tt.keeps {
+				if !strings.Contains(out.String(), keep) {
+					t.Errorf("%q missing from %s", keep, out.String())
+				}
+			}
+		})
+	}
+}
+
+// loggingApp is the part of core.App the deprecated wrappers use.
+type loggingApp struct {
+	core.App
+	logger *slog.Logger
+}
+
+func (a loggingApp) Logger() *slog.Logger { return a.logger }
+
+func TestDeprecatedWrappersRedactLogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	previous := Default()
+	SetDefault(NewClient(Config{OnstreetURL: server.URL, Retry: RetryPolicy{MaxAttempts: 1}}))
+	t.Cleanup(func() { SetDefault(previous) })
+
+	var out bytes.Buffer
+	app := loggingApp{logger: slog.New(slog.NewTextHandler(&out, nil))}
+	GetUnusedAccessPassesByPlateAndParking(app, "1234 BCD", "parking1")
+	GetActiveAccessPassesByPlateAndParkingAndDateTime(app, "1234 BCD", "parking1", "2026-10-18 10:00:00")
+
+	if !strings.Contains(out.String(), "parking1") {
+		t.Fatalf("nothing logged: %s", out.String())
+	}
+	if strings.Contains(out.String(), "1234BCD") || strings.Contains(out.String(), "1234 BCD") {
+		t.Errorf("the plate leaked in %s", out.String())
+	}
+}
@@ -0,0 +1,407 @@
+package innpark
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// DEFAULT_CURRENCY is the currency of the bare cents amounts of the payment
+// API, such as Payable.GetAmount.
+const DEFAULT_CURRENCY = "EUR"
+
+var (
+	ErrCurrencyMismatch = errors.New("innpark: currency mismatch")
+	ErrInvalidCurrency  = errors.New("innpark: invalid currency")
+	ErrMoneyOverflow    = errors.New("innpark: money overflow")
+	ErrInvalidTaxRate   = errors.New("innpark: invalid tax rate")
+)
+
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// currencyExponents lists the currencies whose minor unit is not a
+// hundredth of the major one.
+var currencyExponents = map[string]int{
+	"JPY": 0, "KRW": 0, "CLP": 0, "ISK": 0,
+	"BHD": 3, "KWD": 3, "JOD": 3, "OMR": 3, "TND": 3,
+}
+
+// Money is an amount in the minor units of an ISO 4217 currency, cents for
+// euros. Its arithmetic fails on mixed currencies and on overflow rather
+// than returning a wrong amount.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney returns amount minor units of the currency, which is upper
+// cased and must be an ISO 4217 code.
+func NewMoney(amount int64, currency string) (Money, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if !currencyRegex.MatchString(currency) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidCurrency, currency)
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// Cents returns an amount in cents of DEFAULT_CURRENCY, the unit of the
+// bare ints of the payment API.
+func Cents(cents int) Money {
+	return Money{Amount: int64(cents), Currency: DEFAULT_CURRENCY}
+}
+
+// Exponent returns the number of decimals of the minor unit of the
+// currency.
+func (m Money) Exponent() int {
+	if exponent, ok := currencyExponents[m.Currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// Cents returns the amount as the bare int of the payment API. It fails
+// for currencies other than DEFAULT_CURRENCY.
+func (m Money) Cents() (int, error) {
+	if m.Currency != DEFAULT_CURRENCY {
+		return 0, fmt.Errorf("%w: %s is not %s", ErrCurrencyMismatch, m.Currency, DEFAULT_CURRENCY)
+	}
+	if m.Amount > math.MaxInt || m.Amount < math.MinInt {
+		return 0, ErrMoneyOverflow
+	}
+	return int(m.Amount), nil
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return Money{}, err
+	}
+	sum := m.Amount + o.Amount
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Amount == math.MinInt64 {
+		return Money{}, ErrMoneyOverflow
+	}
+	return m.Add(Money{Amount: -o.Amount, Currency: o.Currency})
+}
+
+func (m Money) Neg() (Money, error) {
+	if m.Amount == math.MinInt64 {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: -m.Amount, Currency: m.Currency}, nil
+}
+
+// Cmp compares two amounts of the same currency, returning -1, 0 or 1.
+func (m Money) Cmp(o Money) (int, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (m Money) Mul(n int64) (Money, error) {
+	return m.MulRat(n, 1, ROUND_HALF_UP)
+}
+
+// MulRat multiplies the amount by num/den, rounding the result to a minor
+// unit with the given mode.
+func (m Money) MulRat(num int64, den int64, mode RoundingMode) (Money, error) {
+	if den == 0 {
+		return Money{}, fmt.Errorf("innpark: multiplying %s by %d/0", m, num)
+	}
+
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(num))
+	amount := roundRat(product, big.NewInt(den), mode)
+	if !amount.IsInt64() {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: amount.Int64(), Currency: m.Currency}, nil
+}
+
+// String formats the amount in major units, e.g. "12.34 EUR".
+func (m Money) String() string {
+	exponent := m.Exponent()
+	if exponent == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+
+	digits := strconv.FormatUint(absInt64(m.Amount), 10)
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	sign := ""
+	if m.Amount < 0 {
+		sign = "-"
+	}
+	return fmt.Sprintf("%s%s.%s %s", sign, digits[:len(digits)-exponent], digits[len(digits)-exponent:], m.Currency)
+}
+
+func (m Money) sameCurrency(o Money) error {
+	if m.Currency != o.Currency {
+		return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	return nil
+}
+
+func absInt64(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
+
+// RoundingMode decides how amounts falling between two minor units are
+// rounded.
+type RoundingMode int
+
+const (
+	ROUND_HALF_UP   RoundingMode = iota // to the nearest, halves away from zero
+	ROUND_HALF_EVEN                     // to the nearest, halves to the even unit
+	ROUND_DOWN                          // towards zero
+	ROUND_UP                            // away from zero
+)
+
+// roundRat returns n/d rounded to an integer with the given mode.
+func roundRat(n *big.Int, d *big.Int, mode RoundingMode) *big.Int {
+	if d.Sign() < 0 {
+		n, d = new(big.Int).Neg(n), new(big.Int).Neg(d)
+	}
+
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+
+	away := false
+	switch mode {
+	case ROUND_DOWN:
+	case ROUND_UP:
+		away = true
+	default:
+		// compare twice the remainder with the divisor
+		switch new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(d) {
+		case 1:
+			away = true
+		case 0:
+			away = mode == ROUND_HALF_UP || q.Bit(0) == 1
+		}
+	}
+
+	if away {
+		return q.Add(q, big.NewInt(int64(n.Sign())))
+	}
+	return q
+}
+
+// TaxRate is a VAT rate in hundredths of a percent: 2100 is 21%.
+type TaxRate int
+
+// ParseTaxRate reads a rate given as a percentage, as a number or a
+// string, e.g. 21, "21", "10.5" or "21%".
+func ParseTaxRate(value any) (TaxRate, error) {
+	var percent float64
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case TaxRate:
+		return v, nil
+	case int:
+		percent = float64(v)
+	case int64:
+		percent = float64(v)
+	case float64:
+		percent = v
+	case string:
+		s := strings.TrimSuffix(strings.TrimSpace(v), "%")
+		if s == "" {
+			return 0, nil
+		}
+		p, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(s), ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidTaxRate, v)
+		}
+		percent = p
+	default:
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTaxRate, value)
+	}
+
+	if percent < 0 || percent > 100 || math.IsNaN(percent) {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTaxRate, value)
+	}
+	return TaxRate(math.Round(percent * 100)), nil
+}
+
+// OrganizationTaxRate reads the taxe of an organization, the info given to
+// BuildOrganizationMap. Organizations without one are taxed at 0%.
+func OrganizationTaxRate(info types.JsonMap) (TaxRate, error) {
+	return ParseTaxRate(info.Get("taxe"))
+}
+
+// OrganizationTaxRates gives the VAT rate of each organization, typically
+// OrganizationTaxRate of its info. TaxRate returns ErrNotFound for the
+// organizations it does not know.
+type OrganizationTaxRates interface {
+	TaxRate(ctx context.Context, organizationId string) (TaxRate, error)
+}
+
+type pocketBaseOrganizationTaxRates struct {
+	app        core.App
+	collection string
+}
+
+// NewPocketBaseOrganizationTaxRates returns OrganizationTaxRates reading the
+// taxe of the info field of the records of collection, the info given to
+// BuildOrganizationMap.
+func NewPocketBaseOrganizationTaxRates(app core.App, collection string) OrganizationTaxRates {
+	return &pocketBaseOrganizationTaxRates{app: app, collection: collection}
+}
+
+func (r *pocketBaseOrganizationTaxRates) TaxRate(ctx context.Context, organizationId string) (TaxRate, error) {
+	record, err := r.app.Dao().FindRecordById(r.collection, organizationId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: organization %s", ErrNotFound, organizationId)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// organizations without info are taxed at 0%, as without a taxe
+	var info types.JsonMap
+	if raw, ok := record.Get("info").(types.JsonRaw); ok && len(raw) > 0 {
+		if err := json.Unmarshal(raw, &info); err != nil {
+			return 0, err
+		}
+	}
+	return OrganizationTaxRate(info)
+}
+
+// Percent returns the rate as a percentage.
+func (r TaxRate) Percent() float64 {
+	return float64(r) / 100
+}
+
+// TaxBreakdown splits an amount into its net part and its VAT. Net plus
+// Tax is always Gross.
+type TaxBreakdown struct {
+	Net   Money   `json:"net"`
+	Tax   Money   `json:"tax"`
+	Gross Money   `json:"gross"`
+	Rate  TaxRate `json:"rate"`
+}
+
+// FromGross splits a VAT inclusive amount, as charged to the user. The net
+// part is rounded half up and the VAT is what is left.
+func (r TaxRate) FromGross(gross Money) (TaxBreakdown, error) {
+	net, err := gross.MulRat(10000, 10000+int64(r), ROUND_HALF_UP)
+	if err != nil {
+		return TaxBreakdown{}, err
+	}
+	tax, err := gross.Sub(net)
+	if err != nil {
+		return TaxBreakdown{}, err
+	}
+	return TaxBreakdown{Net: net, Tax: tax, Gross: gross, Rate: r}, nil
+}
+
+// FromNet adds VAT to a net amount, rounding the VAT half up.
+func (r TaxRate) FromNet(net Money) (TaxBreakdown, error) {
+	tax, err := net.MulRat(int64(r), 10000, ROUND_HALF_UP)
+	if err != nil {
+		return TaxBreakdown{}, err
+	}
+	gross, err := net.Add(tax)
+	if err != nil {
+		return TaxBreakdown{}, err
+	}
+	return TaxBreakdown{Net: net, Tax: tax, Gross: gross, Rate: r}, nil
+}
+
+// Taxed is implemented by the payees, or payables, whose amounts include
+// another VAT rate than the one of their organization, see
+// Config.OrganizationTaxRates.
+type Taxed interface {
+	GetTaxRate() TaxRate
+}
+
+// Priced is implemented by the payables whose amount is Money. The payment
+// calls use GetPrice instead of GetAmount for them, failing for currencies
+// the payment API does not take.
+type Priced interface {
+	GetPrice() Money
+}
+
+// amountOf returns the amount of the payable in cents, from GetPrice when
+// it is Priced.
+func amountOf(payable Payable) (int, error) {
+	if priced, ok := payable.(Priced); ok {
+		return priced.GetPrice().Cents()
+	}
+	return payable.GetAmount(), nil
+}
+
+// taxBreakdown returns the breakdown of cents sent with the payment calls,
+// by the rate of the payee or else of the payable when they are Taxed, or
+// else of the organization of the payee. It is nil when no rate is known or
+// OmitTaxBreakdown is set.
+func (c *Client) taxBreakdown(ctx context.Context, cents int, payee Payee, payable Payable) (*TaxBreakdown, error) {
+	if c.config.OmitTaxBreakdown {
+		return nil, nil
+	}
+
+	rate, ok := taxRateOf(payee, payable)
+	if rates := c.config.OrganizationTaxRates; !ok && payee != nil && rates != nil {
+		organizationRate, err := rates.TaxRate(ctx, payee.GetOrganizationId())
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		rate, ok = organizationRate, err == nil
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	breakdown, err := rate.FromGross(Cents(cents))
+	if err != nil {
+		return nil, err
+	}
+	return &breakdown, nil
+}
+
+// taxRateOf returns the rate of the first of holders implementing Taxed.
+func taxRateOf(holders ...any) (TaxRate, bool) {
+	for _, holder := range holders {
+		if taxed, ok := holder.(Taxed); ok {
+			return taxed.GetTaxRate(), true
+		}
+	}
+	return 0, false
+}
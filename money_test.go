@@ -0,0 +1,206 @@
+package innpark
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func TestMoneyMulRat(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int64
+		num    int64
+		den    int64
+		mode   RoundingMode
+		want   int64
+	}{
+		{name: "exact", amount: 100, num: 1, den: 4, mode: ROUND_HALF_UP, want: 25},
+		{name: "half up", amount: 5, num: 1, den: 2, mode: ROUND_HALF_UP, want: 3},
+		{name: "negative half up", amount: -5, num: 1, den: 2, mode: ROUND_HALF_UP, want: -3},
+		{name: "half even down", amount: 5, num: 1, den: 2, mode: ROUND_HALF_EVEN, want: 2},
+		{name: "half even up", amount: 7, num: 1, den: 2, mode: ROUND_HALF_EVEN, want: 4},
+		{name: "below half", amount: 10, num: 1, den: 3, mode: ROUND_HALF_UP, want: 3},
+		{name: "above half", amount: 20, num: 1, den: 3, mode: ROUND_HALF_UP, want: 7},
+		{name: "down", amount: 20, num: 1, den: 3, mode: ROUND_DOWN, want: 6},
+		{name: "negative down", amount: -20, num: 1, den: 3, mode: ROUND_DOWN, want: -6},
+		{name: "up", amount: 10, num: 1, den: 3, mode: ROUND_UP, want: 4},
+		{name: "negative up", amount: -10, num: 1, den: 3, mode: ROUND_UP, want: -4},
+		{name: "negative divisor", amount: 5, num: 1, den: -2, mode: ROUND_HALF_UP, want: -3},
+		{name: "no intermediate overflow", amount: math.MaxInt64, num: 3, den: 3, mode: ROUND_HALF_UP, want: math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Cents(0).Add(Money{Amount: tt.amount, Currency: DEFAULT_CURRENCY})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = got.MulRat(tt.num, tt.den, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Amount != tt.want {
+				t.Errorf("got %d, want %d", got.Amount, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyErrors(t *testing.T) {
+	eur := Cents(100)
+	usd := Money{Amount: 100, Currency: "USD"}
+	max := Money{Amount: math.MaxInt64, Currency: DEFAULT_CURRENCY}
+	min := Money{Amount: math.MinInt64, Currency: DEFAULT_CURRENCY}
+
+	if _, err := eur.Add(usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("adding currencies: got %v", err)
+	}
+	if _, err := eur.Cmp(usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("comparing currencies: got %v", err)
+	}
+	if _, err := usd.Cents(); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("cents of USD: got %v", err)
+	}
+	if _, err := max.Add(Cents(1)); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("adding past the maximum: got %v", err)
+	}
+	if _, err := min.Sub(Cents(1)); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("subtracting past the minimum: got %v", err)
+	}
+	if _, err := eur.Sub(min); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("subtracting the minimum: got %v", err)
+	}
+	if _, err := min.Neg(); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("negating the minimum: got %v", err)
+	}
+	if _, err := max.Mul(2); !errors.Is(err, ErrMoneyOverflow) {
+		t.Errorf("multiplying past the maximum: got %v", err)
+	}
+	if _, err := NewMoney(1, "euro"); !errors.Is(err, ErrInvalidCurrency) {
+		t.Errorf("invalid currency: got %v", err)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{Cents(1234), "12.34 EUR"},
+		{Cents(5), "0.05 EUR"},
+		{Cents(-5), "-0.05 EUR"},
+		{Cents(0), "0.00 EUR"},
+		{Money{Amount: 1234, Currency: "JPY"}, "1234 JPY"},
+		{Money{Amount: 1234, Currency: "KWD"}, "1.234 KWD"},
+		{Money{Amount: math.MinInt64, Currency: DEFAULT_CURRENCY}, "-92233720368547758.08 EUR"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestParseTaxRate(t *testing.T) {
+	tests := []struct {
+		value any
+		want  TaxRate
+		err   bool
+	}{
+		{value: nil, want: 0},
+		{value: 21, want: 2100},
+		{value: 10.5, want: 1050},
+		{value: "21", want: 2100},
+		{value: " 21% ", want: 2100},
+		{value: "10,5", want: 1050},
+		{value: "", want: 0},
+		{value: -1, err: true},
+		{value: 101, err: true},
+		{value: "abc", err: true},
+		{value: true, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTaxRate(tt.value)
+		if tt.err {
+			if !errors.Is(err, ErrInvalidTaxRate) {
+				t.Errorf("%v: got %v, want ErrInvalidTaxRate", tt.value, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+
+	rate, err := OrganizationTaxRate(types.JsonMap{"taxe": "21"})
+	if err != nil || rate != 2100 {
+		t.Errorf("organization taxe: got %d, %v", rate, err)
+	}
+}
+
+func TestTaxBreakdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  TaxRate
+		gross int64
+		net   int64
+		tax   int64
+	}{
+		{name: "21% exact", rate: 2100, gross: 121, net: 100, tax: 21},
+		{name: "21% net rounded up", rate: 2100, gross: 100, net: 83, tax: 17},
+		{name: "21% net rounded down", rate: 2100, gross: 1000, net: 826, tax: 174},
+		{name: "21% exact large", rate: 2100, gross: 1815, net: 1500, tax: 315},
+		{name: "10%", rate: 1000, gross: 999, net: 908, tax: 91},
+		{name: "zero rate", rate: 0, gross: 999, net: 999, tax: 0},
+		{name: "one cent", rate: 2100, gross: 1, net: 1, tax: 0},
+		{name: "negative", rate: 2100, gross: -100, net: -83, tax: -17},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breakdown, err := tt.rate.FromGross(Money{Amount: tt.gross, Currency: DEFAULT_CURRENCY})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if breakdown.Net.Amount != tt.net || breakdown.Tax.Amount != tt.tax {
+				t.Errorf("got net %d and tax %d, want %d and %d", breakdown.Net.Amount, breakdown.Tax.Amount, tt.net, tt.tax)
+			}
+			if breakdown.Net.Amount+breakdown.Tax.Amount != breakdown.Gross.Amount {
+				t.Errorf("net %d plus tax %d is not gross %d", breakdown.Net.Amount, breakdown.Tax.Amount, breakdown.Gross.Amount)
+			}
+
+		})
+	}
+}
+
+func TestTaxBreakdownFromNet(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  TaxRate
+		net   int64
+		tax   int64
+		gross int64
+	}{
+		{name: "21% exact", rate: 2100, net: 100, tax: 21, gross: 121},
+		{name: "21% tax rounded down", rate: 2100, net: 826, tax: 173, gross: 999},
+		{name: "21% tax half up", rate: 2100, net: 50, tax: 11, gross: 61},
+		{name: "10.5%", rate: 1050, net: 1000, tax: 105, gross: 1105},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breakdown, err := tt.rate.FromNet(Money{Amount: tt.net, Currency: DEFAULT_CURRENCY})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if breakdown.Tax.Amount != tt.tax || breakdown.Gross.Amount != tt.gross {
+				t.Errorf("got tax %d and gross %d, want %d and %d", breakdown.Tax.Amount, breakdown.Gross.Amount, tt.tax, tt.gross)
+			}
+		})
+	}
+}
@@ -2,11 +2,7 @@ package innpark
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"os"
-	"strings"
 
 	novu "github.com/novuhq/go-novu/lib"
 )
@@ -19,6 +15,15 @@ type CredentialsRequest struct {
 	} `json:"credentials"`
 }
 
+// TriggerForOrganizationRequest is the body of the payment API's
+// /v1/notifications/trigger-for-organization.
+type TriggerForOrganizationRequest struct {
+	WorkflowName   string                 `json:"workflow_name"`
+	UserId         string                 `json:"user_id"`
+	OrganizationId string                 `json:"organization_id"`
+	Payload        map[string]interface{} `json:"payload"`
+}
+
 const (
 	FIREBASE_CLOUD_MESSAGING = "firebase-cloud-messaging-PZsqbhqPe"
 )
@@ -33,6 +38,7 @@ const (
 	WORKFLOW_NEW_PAYMENT_METHOD                 = "new-payment-method-email"
 	WORKFLOW_PAYMENT_METHOD_EXPIRATION_REMINDER = "payment-method-expiration-reminder"
 	WORKFLOW_SERVICES_EMAIL                     = "services-email"
+	WORKFLOW_PREAUTHORIZATION_EXPIRING          = "preauthorization-expiring"
 
 	// Onstreet
 	WORKFLOW_ONSTREET_STAY_REMINDER  = "onstreet-stay-reminder"
@@ -47,58 +53,45 @@ const (
 	WORKFLOW_NEW_COMPLAINT = "new-complaint"
 )
 
-func UpdateSubscriberCredentials(
+func (c *Client) UpdateSubscriberCredentials(
+	ctx context.Context,
 	userId string,
 	tokens []string,
 ) error {
 
-	url := fmt.Sprintf("https://api.novu.co/v1/subscribers/%s/credentials", userId)
+	url := fmt.Sprintf("%s/v1/subscribers/%s/credentials", c.config.NovuURL, userId)
 
 	request := CredentialsRequest{
 		ProviderId:            "fcm",
-		IntegrationIdentifier: os.Getenv("NOVU_FCM_ID"),
+		IntegrationIdentifier: c.config.NovuFCMIntegrationId,
 	}
 
 	request.Credentials.DeviceTokens = append(request.Credentials.DeviceTokens, tokens...)
 
-	j, err := json.Marshal(request)
+	body, err := jsonBody(request)
 	if err != nil {
 		return err
 	}
-	payload := strings.NewReader(string(j))
-
-	req, _ := http.NewRequest("PUT", url, payload)
-
-	req.Header.Add("Authorization", "ApiKey "+os.Getenv("NOVU_TOKEN"))
-	req.Header.Add("Content-Type", "application/json")
-
-	res, _ := http.DefaultClient.Do(req)
-
-	if res.StatusCode != 200 {
-		errorBody := make([]byte, res.ContentLength)
-		res.Body.Read(errorBody)
-		return fmt.Errorf("error updating subscriber credentials: %s", string(errorBody))
-	}
 
-	defer res.Body.Close()
-
-	return nil
+	return c.doJSON(ctx, BACKEND_NOVU, "UpdateSubscriberCredentials", "PUT", url, body, nil)
 }
 
-func CreateSubscriber(userID string, email string) error {
-	novuClient := novu.NewAPIClient(os.Getenv("NOVU_TOKEN"), &novu.Config{})
-	_, err := novuClient.SubscriberApi.Identify(context.Background(), userID, map[string]interface{}{
+func (c *Client) CreateSubscriber(ctx context.Context, userID string, email string) (err error) {
+	ctx, end := c.startCall(ctx, BACKEND_NOVU, "CreateSubscriber")
+	defer func() { end(err) }()
+
+	_, err = c.novu.SubscriberApi.Identify(ctx, userID, map[string]interface{}{
 		"subscriberId": userID,
 		"email":        email,
 		"locale":       "ca",
 	})
 
-	return err
+	return newNovuError("SubscriberApi.Identify", err)
 }
 
-func TriggerWorkflow(workflowName string, subscriberId string, payload map[string]interface{}) error {
-	ctx := context.Background()
-	novuClient := novu.NewAPIClient(os.Getenv("NOVU_TOKEN"), &novu.Config{})
+func (c *Client) TriggerWorkflow(ctx context.Context, workflowName string, subscriberId string, payload map[string]interface{}) (err error) {
+	ctx, end := c.startCall(ctx, BACKEND_NOVU, "TriggerWorkflow")
+	defer func() { end(err) }()
 
 	payloadOptions := novu.ITriggerPayloadOptions{
 		To: map[string]interface{}{
@@ -106,10 +99,10 @@ func TriggerWorkflow(workflowName string, subscriberId string, payload map[strin
 		},
 		Payload: payload,
 	}
-	_, err := novuClient.EventApi.Trigger(ctx, workflowName, payloadOptions)
+	_, err = c.novu.EventApi.Trigger(ctx, workflowName, payloadOptions)
 
 	if err != nil {
-		return err
+		return newNovuError("EventApi.Trigger", err)
 	}
 
 	return nil
@@ -117,42 +110,18 @@ func TriggerWorkflow(workflowName string, subscriberId string, payload map[strin
 
 // TriggerWorkflowForOrganization triggers a workflow via the payment API,
 // which will restrict FCM delivery to tokens registered under the given organization.
-func TriggerWorkflowForOrganization(workflowName string, userId string, organizationId string, payload map[string]interface{}) error {
-	body := struct {
-		WorkflowName   string                 `json:"workflow_name"`
-		UserId         string                 `json:"user_id"`
-		OrganizationId string                 `json:"organization_id"`
-		Payload        map[string]interface{} `json:"payload"`
-	}{
+func (c *Client) TriggerWorkflowForOrganization(ctx context.Context, workflowName string, userId string, organizationId string, payload map[string]interface{}) error {
+	body, err := jsonBody(TriggerForOrganizationRequest{
 		WorkflowName:   workflowName,
 		UserId:         userId,
 		OrganizationId: organizationId,
 		Payload:        payload,
-	}
-
-	j, err := json.Marshal(body)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", os.Getenv("API_PAYMENT")+"/v1/notifications/trigger-for-organization", strings.NewReader(string(j)))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", os.Getenv("API_PAYMENT_TOKEN"))
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
+	})
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("trigger-for-organization failed: %d", resp.StatusCode)
-	}
 
-	return nil
+	return c.doIdempotent(ctx, BACKEND_PAYMENT, "TriggerWorkflowForOrganization", "POST", c.config.PaymentURL+"/v1/notifications/trigger-for-organization", body, nil)
 }
 
 type Subscriber struct {
@@ -162,11 +131,13 @@ type Subscriber struct {
 	Email        string `json:"email"`
 }
 
-func GetSubscriber(userID string) (Subscriber, error) {
-	novuClient := novu.NewAPIClient(os.Getenv("NOVU_TOKEN"), &novu.Config{})
-	resp, err := novuClient.SubscriberApi.Get(context.Background(), userID)
+func (c *Client) GetSubscriber(ctx context.Context, userID string) (_ Subscriber, err error) {
+	ctx, end := c.startCall(ctx, BACKEND_NOVU, "GetSubscriber")
+	defer func() { end(err) }()
+
+	resp, err := c.novu.SubscriberApi.Get(ctx, userID)
 	if err != nil {
-		return Subscriber{}, err
+		return Subscriber{}, newNovuError("SubscriberApi.Get", err)
 	}
 
 	data, ok := resp.Data.(map[string]any)
@@ -182,8 +153,10 @@ func GetSubscriber(userID string) (Subscriber, error) {
 	}, nil
 }
 
-func DeleteSubscriber(userID string) error {
-	novuClient := novu.NewAPIClient(os.Getenv("NOVU_TOKEN"), &novu.Config{})
-	_, err := novuClient.SubscriberApi.Delete(context.Background(), userID)
-	return err
+func (c *Client) DeleteSubscriber(ctx context.Context, userID string) (err error) {
+	ctx, end := c.startCall(ctx, BACKEND_NOVU, "DeleteSubscriber")
+	defer func() { end(err) }()
+
+	_, err = c.novu.SubscriberApi.Delete(ctx, userID)
+	return newNovuError("SubscriberApi.Delete", err)
 }
@@ -1,139 +1,289 @@
 package innpark
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
-	"os"
+	"slices"
 	"strings"
+
+	"github.com/studiogenesisprojects/lib-innpark/plate"
 )
 
-var offstreetUrl = os.Getenv("API_OFFSTREET_URL")
+// ErrNoVehiclesCollection is returned by the vehicle reads of a client
+// configured without an OffstreetVehiclesCollection.
+var ErrNoVehiclesCollection = errors.New("innpark: no offstreet vehicles collection configured")
 
-func CreateVehicle(plate string, vehicleId string, userId string) (string, error) {
-	// Create vehicle
-	url := fmt.Sprintf("%s/v1/vehicles/create", offstreetUrl)
+// CreateVehicleRequest is the body of /v1/vehicles/create.
+type CreateVehicleRequest struct {
+	Plate       string      `json:"plate"`
+	VehicleId   string      `json:"vehicle_id"`
+	UserId      string      `json:"user_id"`
+	VehicleType VehicleType `json:"vehicle_type,omitempty"`
+}
 
-	body := strings.NewReader(fmt.Sprintf(`{	
-		"plate": "%s",
-		"vehicle_id": "%s",
-		"user_id": "%s"
-	}`, plate, vehicleId, userId))
+// DeleteVehicleRequest is the body of /v1/vehicles/delete.
+type DeleteVehicleRequest struct {
+	Plate  string `json:"plate"`
+	UserId string `json:"user_id"`
+}
 
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return "", err
-	}
+// UpdateVehicleRequest is the body of /v1/vehicles/update. Plate and
+// VehicleType change the vehicle when not empty, Alias renames it when not
+// nil, an empty alias clears it.
+type UpdateVehicleRequest struct {
+	Id          string      `json:"id"`
+	UserId      string      `json:"user_id"`
+	Plate       string      `json:"plate,omitempty"`
+	Alias       *string     `json:"alias,omitempty"`
+	VehicleType VehicleType `json:"vehicle_type,omitempty"`
+}
 
-	req.Header.Set("Content-Type", "application/json")
+// TransferVehicleRequest is the body of /v1/vehicles/transfer.
+type TransferVehicleRequest struct {
+	Id         string `json:"id"`
+	FromUserId string `json:"from_user_id"`
+	ToUserId   string `json:"to_user_id"`
+}
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+// CreateVehicle registers the vehicle for the user and returns its offstreet
+// id. The plate is normalized, see plate.Clean. A zero
+// vehicleType is inferred from the plate when its format tells.
+func (c *Client) CreateVehicle(ctx context.Context, vehiclePlate string, vehicleId string, userId string, vehicleType VehicleType) (string, error) {
+	// Create vehicle
+	url := fmt.Sprintf("%s/v1/vehicles/create", c.config.OffstreetURL)
 
+	vehiclePlate, err := plate.Clean(vehiclePlate)
 	if err != nil {
 		return "", err
 	}
+	if vehicleType == "" {
+		vehicleType = InferVehicleType(vehiclePlate)
+	}
+	if vehicleType != "" && !vehicleType.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrInvalidVehicleType, vehicleType)
+	}
 
-	if response.StatusCode != 200 {
-		return "", fmt.Errorf("api-offstreet-error: %d", response.StatusCode)
+	body, err := jsonBody(CreateVehicleRequest{
+		Plate:       vehiclePlate,
+		VehicleId:   vehicleId,
+		UserId:      userId,
+		VehicleType: vehicleType,
+	})
+	if err != nil {
+		return "", err
 	}
 
 	createVehicleResponse := &CreateVehicleResponse{}
-	err = json.NewDecoder(response.Body).Decode(createVehicleResponse)
-	if err != nil {
-		return "", fmt.Errorf("api-offstreet-error: %s", err.Error())
+	if err := c.doIdempotent(ctx, BACKEND_OFFSTREET, "CreateVehicle", "POST", url, body, createVehicleResponse); err != nil {
+		return "", err
 	}
 
 	return createVehicleResponse.Id, nil
 }
 
-func DeleteVehicle(plate string, userId string) error {
-	// delete vehicle
-	url := fmt.Sprintf("%s/v1/vehicles/delete", offstreetUrl)
+// DeleteVehicle removes the vehicle of the user. The plate is normalized;
+// vehicles registered before plates were normalized are stored as they were
+// given, so when the normalized plate is not found the plate is retried as
+// stored, when the OffstreetVehiclesCollection tells, or else as given.
+func (c *Client) DeleteVehicle(ctx context.Context, vehiclePlate string, userId string) error {
+	normalized := plate.Normalize(vehiclePlate)
+	err := c.deleteVehicle(ctx, normalized, userId)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
 
-	body := strings.NewReader(fmt.Sprintf(`{	
-		"plate": "%s",
-		"user_id": "%s"
-	}`, plate, userId))
+	stored := strings.TrimSpace(vehiclePlate)
+	if vehicle, lookupErr := c.GetVehicleByPlate(ctx, vehiclePlate, userId); lookupErr == nil {
+		stored = vehicle.Plate
+	}
+	if stored == normalized {
+		return err
+	}
 
-	req, err := http.NewRequest("POST", url, body)
+	// the retry is another request, so it cannot reuse the caller's key
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		ctx = WithIdempotencyKey(ctx, key+"/"+stored)
+	}
+	return c.deleteVehicle(ctx, stored, userId)
+}
+
+func (c *Client) deleteVehicle(ctx context.Context, vehiclePlate string, userId string) error {
+	url := fmt.Sprintf("%s/v1/vehicles/delete", c.config.OffstreetURL)
+
+	body, err := jsonBody(DeleteVehicleRequest{
+		Plate:  vehiclePlate,
+		UserId: userId,
+	})
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	return c.doIdempotent(ctx, BACKEND_OFFSTREET, "DeleteVehicle", "POST", url, body, nil)
+}
+
+// ListVehicles returns every vehicle of the user, read from the
+// OffstreetVehiclesCollection.
+func (c *Client) ListVehicles(ctx context.Context, userId string) ([]Vehicle, error) {
+	collection, err := c.vehiclesCollection()
+	if err != nil {
+		return nil, err
+	}
+	query := NewQuery().Where(Eq("user_id", userId)).Sort("created")
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+	return collect(iterate[Vehicle](ctx, c, BACKEND_OFFSTREET, "ListVehicles", collection, query))
+}
 
+// GetVehicle returns the vehicle with the given offstreet id, read from the
+// OffstreetVehiclesCollection.
+func (c *Client) GetVehicle(ctx context.Context, id string) (Vehicle, error) {
+	collection, err := c.vehiclesCollection()
 	if err != nil {
-		return err
+		return Vehicle{}, err
+	}
+	url, err := c.recordURL(BACKEND_OFFSTREET, collection, id)
+	if err != nil {
+		return Vehicle{}, err
 	}
 
-	if response.StatusCode != 200 {
-		return fmt.Errorf("api-offstreet-error: %d", response.StatusCode)
+	var vehicle Vehicle
+	if err := c.doJSON(ctx, BACKEND_OFFSTREET, "GetVehicle", "GET", url, nil, &vehicle); err != nil {
+		return Vehicle{}, err
 	}
 
-	return nil
+	return vehicle, nil
 }
 
-func GetParkings(organizationId string, clusterId string) []Parking {
-	url := fmt.Sprintf("%s/collections/parkings/records", offstreetUrl)
+// GetVehicleByPlate returns the vehicle of the user with the given plate,
+// read from the OffstreetVehiclesCollection. Plates are compared normalized,
+// so vehicles registered before plates were normalized are found too. It
+// fails with ErrNotFound when the user has no such vehicle.
+func (c *Client) GetVehicleByPlate(ctx context.Context, vehiclePlate string, userId string) (Vehicle, error) {
+	vehicles, err := c.ListVehicles(ctx, userId)
+	if err != nil {
+		return Vehicle{}, err
+	}
 
-	var filters []string
-	if organizationId != "" {
-		filters = append(filters, fmt.Sprintf("organization_id='%s'", organizationId))
+	normalized := plate.Normalize(vehiclePlate)
+	for _, vehicle := range vehicles {
+		if plate.Normalize(vehicle.Plate) == normalized {
+			return vehicle, nil
+		}
 	}
-	if clusterId != "" {
-		filters = append(filters, fmt.Sprintf("cluster_id='%s'", clusterId))
+	return Vehicle{}, fmt.Errorf("%w: vehicle %s", ErrNotFound, vehiclePlate)
+}
+
+// UpdateVehicle changes the plate, alias or type of a vehicle and returns it
+// updated. A new plate is normalized, see plate.Clean.
+func (c *Client) UpdateVehicle(ctx context.Context, request UpdateVehicleRequest) (Vehicle, error) {
+	url := fmt.Sprintf("%s/v1/vehicles/update", c.config.OffstreetURL)
+
+	if request.Plate != "" {
+		vehiclePlate, err := plate.Clean(request.Plate)
+		if err != nil {
+			return Vehicle{}, err
+		}
+		request.Plate = vehiclePlate
 	}
-	if len(filters) > 0 {
-		url += fmt.Sprintf("?filter=(%s)", strings.Join(filters, " && "))
+	if request.VehicleType != "" && !request.VehicleType.Valid() {
+		return Vehicle{}, fmt.Errorf("%w: %q", ErrInvalidVehicleType, request.VehicleType)
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	body, err := jsonBody(request)
 	if err != nil {
-		return []Parking{}
+		return Vehicle{}, err
+	}
+
+	var vehicle Vehicle
+	if err := c.doIdempotent(ctx, BACKEND_OFFSTREET, "UpdateVehicle", "POST", url, body, &vehicle); err != nil {
+		return Vehicle{}, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	return vehicle, nil
+}
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+// TransferVehicle moves a vehicle from one user to another and returns it
+// as owned by the new user.
+func (c *Client) TransferVehicle(ctx context.Context, id string, fromUserId string, toUserId string) (Vehicle, error) {
+	url := fmt.Sprintf("%s/v1/vehicles/transfer", c.config.OffstreetURL)
 
+	body, err := jsonBody(TransferVehicleRequest{
+		Id:         id,
+		FromUserId: fromUserId,
+		ToUserId:   toUserId,
+	})
 	if err != nil {
-		return []Parking{}
+		return Vehicle{}, err
 	}
 
-	if response.StatusCode != 200 {
-		return []Parking{}
+	var vehicle Vehicle
+	if err := c.doIdempotent(ctx, BACKEND_OFFSTREET, "TransferVehicle", "POST", url, body, &vehicle); err != nil {
+		return Vehicle{}, err
 	}
 
-	var parkingsResponse ParkingResponse
-	err = json.NewDecoder(response.Body).Decode(&parkingsResponse)
-	if err != nil {
-		return []Parking{}
+	return vehicle, nil
+}
+
+func (c *Client) vehiclesCollection() (string, error) {
+	if c.config.OffstreetVehiclesCollection == "" {
+		return "", ErrNoVehiclesCollection
+	}
+	return c.config.OffstreetVehiclesCollection, nil
+}
+
+// GetParkings returns the parkings of the organization and cluster, walking
+// all pages. Empty ids are not filtered on.
+func (c *Client) GetParkings(ctx context.Context, organizationId string, clusterId string) ([]Parking, error) {
+	var filters []Filter
+	if organizationId != "" {
+		filters = append(filters, Eq("organization_id", organizationId))
+	}
+	if clusterId != "" {
+		filters = append(filters, Eq("cluster_id", clusterId))
 	}
 
-	return parkingsResponse.Items
+	return collect(iterate[Parking](ctx, c, BACKEND_OFFSTREET, "GetParkings", "parkings", NewQuery().Where(And(filters...))))
 }
 
 type ParkingResponse struct {
 	Items []Parking `json:"items"`
 }
 
-type VehicleResponse struct {
-	Id     string `json:"id"`
-	UserId string `json:"user_id"`
-	Plate  string `json:"plate"`
+// Vehicle is a vehicle as known by offstreet. VehicleId is the id the app
+// gave it on CreateVehicle.
+type Vehicle struct {
+	Id          string      `json:"id"`
+	UserId      string      `json:"user_id"`
+	Plate       string      `json:"plate"`
+	VehicleId   string      `json:"vehicle_id"`
+	VehicleType VehicleType `json:"vehicle_type"`
+	Alias       string      `json:"alias"`
+	Created     DateTime    `json:"created"`
+	Updated     DateTime    `json:"updated"`
+}
+
+func (v Vehicle) GetVehicleType() VehicleType {
+	return v.VehicleType
 }
 
+// Deprecated: use Vehicle.
+type VehicleResponse = Vehicle
+
 type CreateVehicleResponse struct {
 	Id string `json:"id"`
 }
+
+// Parking is an offstreet parking. VehicleTypes lists the vehicle types it
+// admits, empty when it admits any.
 type Parking struct {
-	Id             string `json:"id"`
-	OrganizationId string `json:"organization_id"`
-	ClusterId      string `json:"cluster_id"`
-	Name           string `json:"name"`
+	Id             string        `json:"id"`
+	OrganizationId string        `json:"organization_id"`
+	ClusterId      string        `json:"cluster_id"`
+	Name           string        `json:"name"`
+	VehicleTypes   []VehicleType `json:"vehicle_types"`
+}
+
+// Admits reports whether vehicles of the given type can park.
+func (p Parking) Admits(vehicleType VehicleType) bool {
+	return len(p.VehicleTypes) == 0 || slices.Contains(p.VehicleTypes, vehicleType)
 }
@@ -0,0 +1,154 @@
+package innpark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/studiogenesisprojects/lib-innpark/plate"
+)
+
+func TestCreateVehicle(t *testing.T) {
+	var got CreateVehicleRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"id":"v1"}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(Config{OffstreetURL: server.URL})
+
+	tests := []struct {
+		plate       string
+		want        string
+		vehicleType VehicleType
+	}{
+		{plate: "1234 bcd", want: "1234BCD"},
+		{plate: "zh 123456", want: "ZH123456"},
+		{plate: "WA-12345", want: "WA12345"},
+		{plate: "C-1234-BCD", want: "C1234BCD", vehicleType: VEHICLE_TYPE_MOPED},
+	}
+
+	for _, tt := range tests {
+		got = CreateVehicleRequest{}
+		if _, err := c.CreateVehicle(context.Background(), tt.plate, "vehicle", "user", ""); err != nil {
+			t.Errorf("%q: %v", tt.plate, err)
+			continue
+		}
+		if got.Plate != tt.want || got.VehicleType != tt.vehicleType {
+			t.Errorf("%q: sent plate %q of type %q, want %q of type %q", tt.plate, got.Plate, got.VehicleType, tt.want, tt.vehicleType)
+		}
+	}
+
+	if _, err := c.CreateVehicle(context.Background(), " - ", "vehicle", "user", ""); !errors.Is(err, plate.ErrInvalid) {
+		t.Errorf("empty plate: got %v, want plate.ErrInvalid", err)
+	}
+}
+
+func TestVehiclesStoredBeforeNormalization(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/collections/vehicles/records":
+			w.Write([]byte(`{"page":1,"perPage":500,"totalItems":2,"totalPages":1,"items":[
+				{"id":"v1","user_id":"u1","plate":"5678BCD"},
+				{"id":"v2","user_id":"u1","plate":"1234 bcd"}
+			]}`))
+		case "/v1/vehicles/delete":
+			var request DeleteVehicleRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			deleted = append(deleted, request.Plate)
+			if request.Plate != "1234 bcd" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(Config{OffstreetURL: server.URL, OffstreetVehiclesCollection: "vehicles"})
+
+	vehicle, err := c.GetVehicleByPlate(context.Background(), "1234-BCD", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vehicle.Id != "v2" {
+		t.Errorf("got vehicle %s, want v2", vehicle.Id)
+	}
+
+	if _, err := c.GetVehicleByPlate(context.Background(), "9999BCD", "u1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing vehicle: got %v, want ErrNotFound", err)
+	}
+
+	if err := c.DeleteVehicle(context.Background(), "1234BCD", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0] != "1234BCD" || deleted[1] != "1234 bcd" {
+		t.Errorf("got deletes of %q, want the normalized plate and then the stored one", deleted)
+	}
+}
+
+func TestVehicleReadsWithoutCollection(t *testing.T) {
+	c := NewClient(Config{OffstreetURL: "http://offstreet.test"})
+	if _, err := c.ListVehicles(context.Background(), "u1"); !errors.Is(err, ErrNoVehiclesCollection) {
+		t.Errorf("got %v, want ErrNoVehiclesCollection", err)
+	}
+}
+
+func TestUpdateAndTransferVehicle(t *testing.T) {
+	bodies := map[string]map[string]any{}
+	keys := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies[r.URL.Path] = body
+		keys[r.URL.Path] = r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+		w.Write([]byte(`{"id":"v1","user_id":"u2","plate":"1234BCD","alias":"work"}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(Config{OffstreetURL: server.URL})
+	ctx := context.Background()
+
+	alias := "work"
+	vehicle, err := c.UpdateVehicle(ctx, UpdateVehicleRequest{Id: "v1", UserId: "u1", Plate: "1234 bcd", Alias: &alias})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vehicle.Alias != "work" {
+		t.Errorf("got %+v", vehicle)
+	}
+	updated := bodies["/v1/vehicles/update"]
+	if updated["plate"] != "1234BCD" || updated["alias"] != "work" || updated["id"] != "v1" {
+		t.Errorf("update sent %v", updated)
+	}
+	if _, ok := updated["vehicle_type"]; ok {
+		t.Errorf("update sent an unchanged vehicle type: %v", updated)
+	}
+
+	if _, err := c.UpdateVehicle(ctx, UpdateVehicleRequest{Id: "v1", UserId: "u1", VehicleType: "SPACESHIP"}); !errors.Is(err, ErrInvalidVehicleType) {
+		t.Errorf("invalid type: got %v, want ErrInvalidVehicleType", err)
+	}
+
+	vehicle, err = c.TransferVehicle(ctx, "v1", "u1", "u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vehicle.UserId != "u2" {
+		t.Errorf("got %+v", vehicle)
+	}
+	transferred := bodies["/v1/vehicles/transfer"]
+	if transferred["id"] != "v1" || transferred["from_user_id"] != "u1" || transferred["to_user_id"] != "u2" {
+		t.Errorf("transfer sent %v", transferred)
+	}
+
+	for path, key := range keys {
+		if key == "" {
+			t.Errorf("%s sent without an idempotency key", path)
+		}
+	}
+}
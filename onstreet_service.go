@@ -1,291 +1,153 @@
 package innpark
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"time"
 
-	"github.com/pocketbase/pocketbase/core"
+	"github.com/studiogenesisprojects/lib-innpark/plate"
 )
 
-var onstreetUrl = os.Getenv("API_ONSTREET_URL")
-var onstreetToken = os.Getenv("API_ONSTREET_TOKEN")
-
-var VEHICLE_TYPE_CAR = "CAR"
-var VEHICLE_TYPE_MOTORBIKE = "MOTORBIKE"
-
-func GetPlateLists(plate string, startDateTime string) []ListItem {
-	url := fmt.Sprintf(
-		"%s/v1/lists/get-plate-lists?plate=%s&startDateTime=%s", onstreetUrl, plate, startDateTime)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return []ListItem{}
-	}
-	req.Header.Set("Authorization", onstreetToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	response, err := client.Do(req)
+// GetPlateLists returns the list items the plate belongs to at the given
+// time.
+func (c *Client) GetPlateLists(ctx context.Context, vehiclePlate string, at time.Time) ([]ListItem, error) {
+	return c.getPlateLists(ctx, vehiclePlate, FormatDateTime(at))
+}
 
-	if err != nil {
-		return []ListItem{}
-	}
-
-	if response.StatusCode != 200 {
-		responseBody := make([]byte, response.ContentLength)
-		response.Body.Read(responseBody)
-		return []ListItem{}
-	}
+// getPlateLists takes startDateTime as sent upstream, so the deprecated
+// wrappers can pass their callers' value through.
+func (c *Client) getPlateLists(ctx context.Context, vehiclePlate string, startDateTime string) ([]ListItem, error) {
+	query := url.Values{"plate": {plate.Normalize(vehiclePlate)}, "startDateTime": {startDateTime}}
+	url := fmt.Sprintf("%s/v1/lists/get-plate-lists?%s", c.config.OnstreetURL, query.Encode())
 
 	lists := []ListItem{}
-	err = json.NewDecoder(response.Body).Decode(&lists)
-	if err != nil {
-		return []ListItem{}
+	if err := c.doJSON(ctx, BACKEND_ONSTREET, "GetPlateLists", "GET", url, nil, &lists); err != nil {
+		return nil, err
 	}
 
-	return lists
-
+	return lists, nil
 }
 
-func GetEnrichedPlateLists(plate string, startDateTime string) []EnrichedListItem {
-	url := fmt.Sprintf(
-		"%s/v1/lists/get-enriched-plate-lists?plate=%s&startDateTime=%s", onstreetUrl, plate, startDateTime)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return []EnrichedListItem{}
-	}
-	req.Header.Set("Authorization", onstreetToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	response, err := client.Do(req)
-
-	if err != nil {
-		return []EnrichedListItem{}
-	}
+// GetEnrichedPlateLists is GetPlateLists including the free bag of each
+// list item.
+func (c *Client) GetEnrichedPlateLists(ctx context.Context, vehiclePlate string, at time.Time) ([]EnrichedListItem, error) {
+	return c.getEnrichedPlateLists(ctx, vehiclePlate, FormatDateTime(at))
+}
 
-	if response.StatusCode != 200 {
-		responseBody := make([]byte, response.ContentLength)
-		response.Body.Read(responseBody)
-		return []EnrichedListItem{}
-	}
+func (c *Client) getEnrichedPlateLists(ctx context.Context, vehiclePlate string, startDateTime string) ([]EnrichedListItem, error) {
+	query := url.Values{"plate": {plate.Normalize(vehiclePlate)}, "startDateTime": {startDateTime}}
+	url := fmt.Sprintf("%s/v1/lists/get-enriched-plate-lists?%s", c.config.OnstreetURL, query.Encode())
 
 	lists := []EnrichedListItem{}
-	err = json.NewDecoder(response.Body).Decode(&lists)
-	if err != nil {
-		return []EnrichedListItem{}
+	if err := c.doJSON(ctx, BACKEND_ONSTREET, "GetEnrichedPlateLists", "GET", url, nil, &lists); err != nil {
+		return nil, err
 	}
 
-	return lists
+	return lists, nil
 }
 
-func GetPlatesInList(
-	app core.App,
-	listId string) []string {
-
-	var plates []string
-	page := 1
-	perPage := 500 // Máximo permitido por pocketbase
+// GetPlatesInList returns every plate of the list, walking all pages.
+func (c *Client) GetPlatesInList(ctx context.Context, listId string) ([]string, error) {
+	query := NewQuery().Where(Eq("list_id", listId)).Fields("value")
 
-	for {
-		url := fmt.Sprintf(
-			"%s/collections/list_items/records?filter=(list_id='%s')&page=%d&perPage=%d&fields=value", onstreetUrl, listId, page, perPage)
-
-		req, err := http.NewRequest("GET", url, nil)
+	plates := []string{}
+	for item, err := range iterate[Plates](ctx, c, BACKEND_ONSTREET, "GetPlatesInList", "list_items", query) {
 		if err != nil {
-			app.Logger().Error("error creating request", "error", err)
-			return []string{}
+			return nil, err
 		}
-		req.Header.Set("Authorization", onstreetToken)
-		req.Header.Set("Content-Type", "application/json")
-
-		client := &http.Client{}
-		response, err := client.Do(req)
-
-		if err != nil {
-			app.Logger().Error("error getting plates in list", "error", err)
-			return []string{}
-		}
-
-		if response.StatusCode != 200 {
-			responseBody := make([]byte, response.ContentLength)
-			response.Body.Read(responseBody)
-
-			app.Logger().Error("error getting plates in list",
-				"url", url,
-				"request", req,
-				"response", response,
-				"list_id", listId,
-				"body", string(responseBody),
-				"status", response.StatusCode)
-			return []string{}
-		}
-
-		listItemsResponse := &struct {
-			Items      []Plates `json:"items"`
-			Page       int      `json:"page"`
-			PerPage    int      `json:"perPage"`
-			TotalItems int      `json:"totalItems"`
-			TotalPages int      `json:"totalPages"`
-		}{}
-		err = json.NewDecoder(response.Body).Decode(listItemsResponse)
-		if err != nil {
-			app.Logger().Error("error decoding response in list", "error", err)
-			return []string{}
-		}
-
-		for _, item := range listItemsResponse.Items {
-			plates = append(plates, item.Value)
-		}
-
-		if page >= listItemsResponse.TotalPages {
-			break
-		}
-		page++
+		plates = append(plates, item.Value)
 	}
 
-	return plates
+	return plates, nil
 }
 
-func DecrementFreeBagSeconds(app core.App, listItemId string, secondsToDecrement int) {
-	url := fmt.Sprintf(
-		"%s/v1/subscriptions/decrement-free-bag-seconds?list_item_id=%s&seconds=%d", onstreetUrl, listItemId, secondsToDecrement)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		app.Logger().Error("error creating request", "error", err)
-		return
-	}
-	req.Header.Set("Authorization", onstreetToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	response, err := client.Do(req)
-
-	if err != nil {
-		app.Logger().Error("error making request", "error", err)
-		return
-	}
-
-	if response.StatusCode != 200 {
-		app.Logger().Error("unexpected status code", "status", response.StatusCode)
-		return
-	}
+// DecrementFreeBagSeconds consumes seconds from the free bag of the list
+// item. The call is keyed for idempotency, see WithIdempotencyKey, and
+// recorded in the FreeBagLedger; use ConsumeFreeBag to record the stay and
+// plate too.
+func (c *Client) DecrementFreeBagSeconds(ctx context.Context, listItemId string, secondsToDecrement int) error {
+	return c.ConsumeFreeBag(ctx, FreeBagConsumption{ListItemId: listItemId, Seconds: secondsToDecrement})
 }
 
-func GetActiveAccessPassesByPlateAndParkingAndDateTime(app core.App, plate string, parkingId string, startDateTime string) AccessPassItem {
-	url := fmt.Sprintf(
-		"%s/v1/active-access-passes-items?plate=%s&parkingId=%s&startDateTime=%s", onstreetUrl, plate, parkingId, startDateTime)
+func (c *Client) decrementFreeBagSeconds(ctx context.Context, listItemId string, secondsToDecrement int) error {
+	query := url.Values{"list_item_id": {listItemId}, "seconds": {strconv.Itoa(secondsToDecrement)}}
+	url := fmt.Sprintf("%s/v1/subscriptions/decrement-free-bag-seconds?%s", c.config.OnstreetURL, query.Encode())
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		app.Logger().Error("error creating request", "error", err)
-		return AccessPassItem{}
-	}
-	req.Header.Set("Authorization", onstreetToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	response, err := client.Do(req)
+	// the endpoint mutates state behind a GET, so it must not be retried
+	return c.doIdempotent(withoutRetries(ctx), BACKEND_ONSTREET, "DecrementFreeBagSeconds", "GET", url, nil, nil)
+}
 
-	if err != nil {
-		app.Logger().Error("error making request", "error", err)
-		return AccessPassItem{}
-	}
+// GetActiveAccessPassesByPlateAndParkingAndDateTime returns the access pass
+// covering the plate at the parking at the given time. A zero AccessPassItem
+// with a nil error means there is no such pass.
+func (c *Client) GetActiveAccessPassesByPlateAndParkingAndDateTime(ctx context.Context, vehiclePlate string, parkingId string, at time.Time) (AccessPassItem, error) {
+	return c.getActiveAccessPass(ctx, vehiclePlate, parkingId, FormatDateTime(at))
+}
 
-	if response.StatusCode != 200 {
-		app.Logger().Error("unexpected status code", "status", response.StatusCode)
-		return AccessPassItem{}
-	}
+func (c *Client) getActiveAccessPass(ctx context.Context, vehiclePlate string, parkingId string, startDateTime string) (AccessPassItem, error) {
+	query := url.Values{"plate": {plate.Normalize(vehiclePlate)}, "parkingId": {parkingId}, "startDateTime": {startDateTime}}
+	url := fmt.Sprintf("%s/v1/active-access-passes-items?%s", c.config.OnstreetURL, query.Encode())
 
 	var accessPass AccessPassItem
-	err = json.NewDecoder(response.Body).Decode(&accessPass)
-	if err != nil {
-		app.Logger().Error("error decoding response", "error", err)
-		return AccessPassItem{}
+	if err := c.doJSON(ctx, BACKEND_ONSTREET, "GetActiveAccessPassesByPlateAndParkingAndDateTime", "GET", url, nil, &accessPass); err != nil {
+		return AccessPassItem{}, err
 	}
 
-	return accessPass
+	return accessPass, nil
 }
 
-func GetUnusedAccessPassesByPlateAndParking(app core.App, plate string, parkingId string) []AccessPassItem {
-	url := fmt.Sprintf(
-		"%s/v1/unused-access-passes-items?plate=%s&parkingId=%s", onstreetUrl, plate, parkingId)
+// GetUnusedAccessPassesByPlateAndParking returns the passes of the plate at
+// the parking that have not been activated yet.
+func (c *Client) GetUnusedAccessPassesByPlateAndParking(ctx context.Context, vehiclePlate string, parkingId string) ([]AccessPassItem, error) {
+	query := url.Values{"plate": {plate.Normalize(vehiclePlate)}, "parkingId": {parkingId}}
+	url := fmt.Sprintf("%s/v1/unused-access-passes-items?%s", c.config.OnstreetURL, query.Encode())
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		app.Logger().Error("error creating request", "error", err)
-		return []AccessPassItem{}
+	accessPasses := []AccessPassItem{}
+	if err := c.doJSON(ctx, BACKEND_ONSTREET, "GetUnusedAccessPassesByPlateAndParking", "GET", url, nil, &accessPasses); err != nil {
+		return nil, err
 	}
-	req.Header.Set("Authorization", onstreetToken)
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	response, err := client.Do(req)
-
-	if err != nil {
-		app.Logger().Error("error making request", "error", err)
-		return []AccessPassItem{}
-	}
-
-	if response.StatusCode != 200 {
-		app.Logger().Error("unexpected status code", "status", response.StatusCode)
-		return []AccessPassItem{}
-	}
-
-	var accessPasses []AccessPassItem
-	err = json.NewDecoder(response.Body).Decode(&accessPasses)
-	if err != nil {
-		app.Logger().Error("error decoding response", "error", err)
-		return []AccessPassItem{}
-	}
-
-	return accessPasses
+	return accessPasses, nil
 }
 
-func ActivateAccessPass(app core.App, accessPasssItemId string, startDateTime string) (AccessPassItem, error) {
-	url := fmt.Sprintf(
-		"%s/v1/access-passes-items/activate?accessPassItemId=%s&startDateTime=%s", onstreetUrl, accessPasssItemId, startDateTime)
-
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		app.Logger().Error("error creating request", "error", err)
-		return AccessPassItem{}, err
-	}
-	req.Header.Set("Authorization", onstreetToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	response, err := client.Do(req)
-
-	if err != nil {
-		app.Logger().Error("error making request", "error", err)
-		return AccessPassItem{}, err
-	}
+// ActivateAccessPass starts the unused access pass item at startAt.
+func (c *Client) ActivateAccessPass(ctx context.Context, accessPasssItemId string, startAt time.Time) (AccessPassItem, error) {
+	return c.activateAccessPass(ctx, accessPasssItemId, FormatDateTime(startAt))
+}
 
-	if response.StatusCode != 200 {
-		app.Logger().Error("unexpected status code", "status", response.StatusCode)
-		return AccessPassItem{}, fmt.Errorf("unexpected status code: %d", response.StatusCode)
-	}
+func (c *Client) activateAccessPass(ctx context.Context, accessPasssItemId string, startDateTime string) (AccessPassItem, error) {
+	query := url.Values{"accessPassItemId": {accessPasssItemId}, "startDateTime": {startDateTime}}
+	url := fmt.Sprintf("%s/v1/access-passes-items/activate?%s", c.config.OnstreetURL, query.Encode())
 
 	var accessPass AccessPassItem
-	err = json.NewDecoder(response.Body).Decode(&accessPass)
-	if err != nil {
-		app.Logger().Error("error decoding response", "error", err)
+	if err := c.doIdempotent(ctx, BACKEND_ONSTREET, "ActivateAccessPass", "POST", url, nil, &accessPass); err != nil {
 		return AccessPassItem{}, err
 	}
 
 	return accessPass, nil
 }
 
+// ListItem is an entry of a plate list. ParkingId restricts it to a parking,
+// empty when it applies to every parking of the list.
 type ListItem struct {
-	Id       string `json:"id"`
-	ListId   string `json:"list_id"`
-	FromDate string `json:"from_date"`
-	ToDate   string `json:"to_date"`
+	Id          string      `json:"id"`
+	ListId      string      `json:"list_id"`
+	ParkingId   string      `json:"parking_id"`
+	FromDate    DateTime    `json:"from_date"`
+	ToDate      DateTime    `json:"to_date"`
+	VehicleType VehicleType `json:"vehicle_type"`
+}
+
+func (l ListItem) GetVehicleType() VehicleType {
+	return l.VehicleType
+}
+
+// ActiveAt reports whether the item covers t. A zero FromDate or ToDate
+// leaves that end open, a date only ToDate includes its whole day.
+func (l ListItem) ActiveAt(t time.Time) bool {
+	return activeAt(l.FromDate.Time, l.ToDate.End(), t)
 }
 
 type FreeBag struct {
@@ -294,13 +156,50 @@ type FreeBag struct {
 	RemainingSeconds int `json:"remaining_seconds"`
 }
 
+// AccessPassItem is an access pass of a plate. Metadata is the raw JSON the
+// pass was sold with, see ParsedMetadata.
 type AccessPassItem struct {
-	Id               string `json:"id"`
-	AccessPassPlanId string `db:"access_pass_plan_id" json:"access_pass_plan_id"`
-	AccessPassPackId string `db:"access_pass_pack_id" json:"access_pass_pack_id"`
-	Metadata         string `db:"metadata" json:"metadata"`
-	FromDate         string `json:"from_date"`
-	ToDate           string `json:"to_date"`
+	Id               string           `json:"id"`
+	AccessPassPlanId string           `db:"access_pass_plan_id" json:"access_pass_plan_id"`
+	AccessPassPackId string           `db:"access_pass_pack_id" json:"access_pass_pack_id"`
+	UserId           string           `db:"user_id" json:"user_id"`
+	Plate            string           `db:"plate" json:"plate"`
+	Status           AccessPassStatus `db:"status" json:"status"`
+	Metadata         string           `db:"metadata" json:"metadata"`
+	FromDate         DateTime         `json:"from_date"`
+	ToDate           DateTime         `json:"to_date"`
+	VehicleType      VehicleType      `db:"vehicle_type" json:"vehicle_type"`
+}
+
+func (a AccessPassItem) GetVehicleType() VehicleType {
+	return a.VehicleType
+}
+
+// ActiveAt reports whether the pass covers t. A date only ToDate includes
+// its whole day.
+func (a AccessPassItem) ActiveAt(t time.Time) bool {
+	return !a.FromDate.IsZero() && activeAt(a.FromDate.Time, a.ToDate.End(), t)
+}
+
+// Remaining returns how long the pass still covers from t on, the whole
+// pass when it has not started yet and 0 once it has ended. It is elapsed
+// time, so a pass spanning a daylight saving change is an hour shorter or
+// longer than its wall clock span. A pass without ToDate never ends, which
+// is reported with ok false.
+func (a AccessPassItem) Remaining(t time.Time) (remaining time.Duration, ok bool) {
+	if a.ToDate.IsZero() {
+		return 0, false
+	}
+	from := t
+	if a.FromDate.After(t) {
+		from = a.FromDate.Time
+	}
+	return max(a.ToDate.End().Sub(from), 0), true
+}
+
+// activeAt reports whether t is in [from, to), zero ends being open.
+func activeAt(from time.Time, to time.Time, t time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
 }
 
 type EnrichedListItem struct {
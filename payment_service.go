@@ -1,13 +1,11 @@
 package innpark
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"os"
-	"strings"
 
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/studiogenesisprojects/lib-innpark/plate"
 )
 
 const (
@@ -16,23 +14,30 @@ const (
 )
 
 type PayableMetadata struct {
-	Type          string `json:"type"`
-	LocationType  string `json:"location_type"`
-	LocationId    string `json:"location_id"`
-	LocationName  string `json:"location_name"`
-	ClusterName   string `json:"cluster_name"`
-	ClusterId     string `json:"cluster_id"`
-	VehicleId     string `json:"vehicle_id"`
-	VehiclePlate  string `json:"vehicle_plate"`
-	VehicleName   string `json:"vehicle_name"`
-	StartDateTime string `json:"start_date_time"`
-	EndDateTime   string `json:"end_date_time"`
-	Code          string `json:"code"`
-	PlanId        string `json:"plan_id"`
-	PlanName      string `json:"plan_name"`
-	CreatedAt     string `json:"created_at"`
+	Type          string   `json:"type"`
+	LocationType  string   `json:"location_type"`
+	LocationId    string   `json:"location_id"`
+	LocationName  string   `json:"location_name"`
+	ClusterName   string   `json:"cluster_name"`
+	ClusterId     string   `json:"cluster_id"`
+	VehicleId     string   `json:"vehicle_id"`
+	VehiclePlate  string   `json:"vehicle_plate"`
+	VehicleName   string   `json:"vehicle_name"`
+	StartDateTime DateTime `json:"start_date_time"`
+	EndDateTime   DateTime `json:"end_date_time"`
+	Code          string   `json:"code"`
+	PlanId        string   `json:"plan_id"`
+	PlanName      string   `json:"plan_name"`
+	CreatedAt     DateTime `json:"created_at"`
+
+	// Breakdown splits the amount into net and VAT. The payment calls fill
+	// it in when left nil, see Config.OrganizationTaxRates.
+	Breakdown *TaxBreakdown `json:"breakdown,omitempty"`
 }
 
+// Payable is something a user pays for. GetAmount is in cents of
+// DEFAULT_CURRENCY, VAT included; payables that also implement Priced give
+// it as Money instead.
 type Payable interface {
 	GetId() string
 	GetAmount() int
@@ -50,98 +55,210 @@ type Payment interface {
 	GetPayableId() string
 }
 
-var apiUrl = os.Getenv("API_PAYMENT")
-var apiToken = os.Getenv("API_PAYMENT_TOKEN")
+// CreateServiceRequest is the body of /v1/services/create. Metadata is only
+// sent by CreateServiceWithMetadata. Amounts are in cents of
+// DEFAULT_CURRENCY and Breakdown is sent when the VAT rate of the payee is
+// known, see Config.OrganizationTaxRates.
+type CreateServiceRequest struct {
+	OrganizationId string           `json:"organization_id"`
+	UserId         string           `json:"user_id"`
+	ServiceId      string           `json:"service_id"`
+	Amount         int              `json:"amount"`
+	Breakdown      *TaxBreakdown    `json:"breakdown,omitempty"`
+	Metadata       *PayableMetadata `json:"metadata,omitempty"`
+}
 
-func CreateService(payable Payable, payee Payee) error {
+// UpdateServiceRequest is the body of /v1/services/{id}/update.
+type UpdateServiceRequest struct {
+	Amount    int             `json:"amount"`
+	Breakdown *TaxBreakdown   `json:"breakdown,omitempty"`
+	Metadata  PayableMetadata `json:"metadata"`
+}
 
-	body := strings.NewReader(fmt.Sprintf(`{
-		"organization_id": "%s",
-		"user_id": "%s",
-		"service_id": "%s",
-		"amount": %d
-	}`, payee.GetOrganizationId(), payable.GetUserId(), payable.GetId(), payable.GetAmount()))
+// RefundPartialRequest is the body of
+// /v1/services/{id}/payments/refund-partial-amount.
+type RefundPartialRequest struct {
+	Amount    int           `json:"amount"`
+	Breakdown *TaxBreakdown `json:"breakdown,omitempty"`
+}
 
-	_, err := makeRequest("POST", apiUrl+"/v1/services/create", body)
+// CreatePaymentRequest is the body of /v1/services/{id}/payments/create.
+// PaymentMethodId charges a stored payment method instead of starting a new
+// one.
+type CreatePaymentRequest struct {
+	PaymentType     string `json:"payment_type"`
+	TpvId           string `json:"tpv_id"`
+	PaymentMethodId string `json:"payment_method_id,omitempty"`
+}
 
-	return err
+// RedirectPaymentRequest is the body of
+// /v1/services/{id}/redirect-payments/create.
+type RedirectPaymentRequest struct {
+	UrlOk           string `json:"url_ok"`
+	UrlKo           string `json:"url_ko"`
+	UrlNotification string `json:"url_notification"`
+	TpvId           string `json:"tpv_id"`
 }
 
-func RefundPartialPaymentFromService(payable Payable, amount int) error {
+// EmptyRequest is the body of the payment endpoints that take no
+// parameters, such as confirm, cancel and refund.
+type EmptyRequest struct{}
 
-	body := strings.NewReader(fmt.Sprintf(`{
-		"amount": %d
-	}`, amount))
+func (c *Client) CreateService(ctx context.Context, payable Payable, payee Payee) error {
+	amount, err := amountOf(payable)
+	if err != nil {
+		return err
+	}
+	breakdown, err := c.taxBreakdown(ctx, amount, payee, payable)
+	if err != nil {
+		return err
+	}
 
-	_, err := makeRequest("POST", fmt.Sprintf("%s/v1/services/%s/payments/refund-partial-amount", apiUrl, payable.GetId()), body)
-	return err
+	request := CreateServiceRequest{
+		OrganizationId: payee.GetOrganizationId(),
+		UserId:         payable.GetUserId(),
+		ServiceId:      payable.GetId(),
+		Amount:         amount,
+		Breakdown:      breakdown,
+	}
+
+	return c.transitionPayment(ctx, payable.GetId(), "CreateService", PAYMENT_STATE_CREATED, 0, func(ctx context.Context) (string, error) {
+		_, err := c.makeRequest(ctx, "CreateService", "POST", c.config.PaymentURL+"/v1/services/create", request)
+		return "", err
+	})
 }
 
-func CreateServiceWithMetadata(app core.App, payable Payable, payee Payee) error {
-	request := map[string]interface{}{
-		"organization_id": payee.GetOrganizationId(),
-		"user_id":         payable.GetUserId(),
-		"metadata":        payable.GetMetadata(app),
-		"amount":          payable.GetAmount(),
-		"service_id":      payable.GetId(),
+// RefundPartialPaymentFromService refunds amount of the payable, see
+// IssueRefund.
+func (c *Client) RefundPartialPaymentFromService(ctx context.Context, payable Payable, payee Payee, amount Money) error {
+	cents, err := amount.Cents()
+	if err != nil {
+		return err
+	}
+	if cents <= 0 {
+		return fmt.Errorf("%w: refunding %s of payable %s", ErrInvalidRefundAmount, amount, payable.GetId())
 	}
-	requestJson, _ := json.Marshal(request)
-	body := strings.NewReader(string(requestJson))
-
-	_, err := makeRequest("POST", apiUrl+"/v1/services/create", body)
 
-	return err
+	return c.refund(ctx, payable, payee, Refund{Amount: cents}, "RefundPartialPaymentFromService")
 }
 
-func UpdateService(app core.App, payable Payable, amount int) error {
+func (c *Client) CreateServiceWithMetadata(ctx context.Context, app core.App, payable Payable, payee Payee) error {
+	amount, err := amountOf(payable)
+	if err != nil {
+		return err
+	}
+	breakdown, err := c.taxBreakdown(ctx, amount, payee, payable)
+	if err != nil {
+		return err
+	}
+
+	metadata := normalizeMetadata(payable.GetMetadata(app), breakdown)
+	request := CreateServiceRequest{
+		OrganizationId: payee.GetOrganizationId(),
+		UserId:         payable.GetUserId(),
+		ServiceId:      payable.GetId(),
+		Amount:         amount,
+		Breakdown:      breakdown,
+		Metadata:       &metadata,
+	}
 
-	request := map[string]interface{}{
-		"amount":   amount,
-		"metadata": payable.GetMetadata(app),
+	return c.transitionPayment(ctx, payable.GetId(), "CreateServiceWithMetadata", PAYMENT_STATE_CREATED, 0, func(ctx context.Context) (string, error) {
+		_, err := c.makeRequest(ctx, "CreateServiceWithMetadata", "POST", c.config.PaymentURL+"/v1/services/create", request)
+		return "", err
+	})
+}
+
+// UpdateService changes the amount of a service that has not been captured
+// yet. The breakdown is taken from the payee, or else the payable, as in
+// CreateService; payee may be nil for callers that do not know it.
+func (c *Client) UpdateService(ctx context.Context, app core.App, payable Payable, payee Payee, amount Money) error {
+	cents, err := amount.Cents()
+	if err != nil {
+		return err
+	}
+	breakdown, err := c.taxBreakdown(ctx, cents, payee, payable)
+	if err != nil {
+		return err
 	}
-	requestJson, _ := json.Marshal(request)
-	body := strings.NewReader(string(requestJson))
 
-	_, err := makeRequest("PATCH", fmt.Sprintf("%s/v1/services/%s/update", apiUrl, payable.GetId()), body)
+	request := UpdateServiceRequest{
+		Amount:    cents,
+		Breakdown: breakdown,
+		Metadata:  normalizeMetadata(payable.GetMetadata(app), breakdown),
+	}
 
-	return err
+	return c.updatePayment(ctx, payable.GetId(), "UpdateService", func(ctx context.Context) (string, error) {
+		_, err := c.makeRequest(ctx, "UpdateService", "PATCH", fmt.Sprintf("%s/v1/services/%s/update", c.config.PaymentURL, payable.GetId()), request)
+		return "", err
+	}, PAYMENT_STATE_CREATED, PAYMENT_STATE_FAILED, PAYMENT_STATE_PREAUTHORIZED)
 }
 
-func CreatePayment(payable Payable, payee Payee, payment_type string) (*PaymentResponse, error) {
+func (c *Client) CreatePayment(ctx context.Context, payable Payable, payee Payee, payment_type string) (*PaymentResponse, error) {
+	amount, err := amountOf(payable)
+	if err != nil {
+		return nil, err
+	}
 
-	body := strings.NewReader(fmt.Sprintf(`{
-		"payment_type": "%s",
-		"tpv_id": "%s"
-	}`, payment_type, payee.GetTpvId()))
+	request := CreatePaymentRequest{
+		PaymentType: payment_type,
+		TpvId:       payee.GetTpvId(),
+	}
 
-	r, err := makeRequest("POST", fmt.Sprintf("%s/v1/services/%s/payments/create", apiUrl, payable.GetId()), body)
+	var r *PaymentResponse
+	err = c.transitionPayment(ctx, payable.GetId(), "CreatePayment", paymentStateOf(payment_type), amount, func(ctx context.Context) (string, error) {
+		var err error
+		r, err = c.makeRequest(ctx, "CreatePayment", "POST", fmt.Sprintf("%s/v1/services/%s/payments/create", c.config.PaymentURL, payable.GetId()), request)
+		return paymentIdOf(r), err
+	})
+	if err == nil && payment_type == PAYMENT_TYPE_PREAUTHORIZATION {
+		c.trackPreauthorization(ctx, payable, payee, amount, r)
+	}
 
 	return r, err
 
 }
 
-func CreatePaymentByMethodId(payable Payable, payee Payee, payment_type string, paymentMethodId string) (*PaymentResponse, error) {
+func (c *Client) CreatePaymentByMethodId(ctx context.Context, payable Payable, payee Payee, payment_type string, paymentMethodId string) (*PaymentResponse, error) {
+	amount, err := amountOf(payable)
+	if err != nil {
+		return nil, err
+	}
 
-	body := strings.NewReader(fmt.Sprintf(`{
-		"payment_type": "%s",
-		"tpv_id": "%s",
-		"payment_method_id": "%s"
-	}`, payment_type, payee.GetTpvId(), paymentMethodId))
+	request := CreatePaymentRequest{
+		PaymentType:     payment_type,
+		TpvId:           payee.GetTpvId(),
+		PaymentMethodId: paymentMethodId,
+	}
 
-	r, err := makeRequest("POST", fmt.Sprintf("%s/v1/services/%s/payments/create", apiUrl, payable.GetId()), body)
+	var r *PaymentResponse
+	err = c.transitionPayment(ctx, payable.GetId(), "CreatePaymentByMethodId", paymentStateOf(payment_type), amount, func(ctx context.Context) (string, error) {
+		var err error
+		r, err = c.makeRequest(ctx, "CreatePaymentByMethodId", "POST", fmt.Sprintf("%s/v1/services/%s/payments/create", c.config.PaymentURL, payable.GetId()), request)
+		return paymentIdOf(r), err
+	})
+	if err == nil && payment_type == PAYMENT_TYPE_PREAUTHORIZATION {
+		c.trackPreauthorization(ctx, payable, payee, amount, r)
+	}
 
 	return r, err
 }
 
-func CreateRedirectPayment(payable Payable, payee Payee, returnUrlOk string, returnUrlKo string, returnUrlNotification string) (*RedirectPaymentResponse, error) {
-	body := strings.NewReader(fmt.Sprintf(`{
-		"url_ok": "%s",
-		"url_ko": "%s",
-		"url_notification": "%s",
-		"tpv_id": "%s"
-	}`, returnUrlOk, returnUrlKo, returnUrlNotification, payee.GetTpvId()))
+// CreateRedirectPayment starts a payment on the Redsys page. Its outcome
+// arrives at returnUrlNotification and is not tracked until the caller
+// records it with RecordPaymentState.
+func (c *Client) CreateRedirectPayment(ctx context.Context, payable Payable, payee Payee, returnUrlOk string, returnUrlKo string, returnUrlNotification string) (*RedirectPaymentResponse, error) {
+	if err := c.requirePaymentState(ctx, payable.GetId(), "CreateRedirectPayment", PAYMENT_STATE_CREATED, PAYMENT_STATE_FAILED); err != nil {
+		return nil, err
+	}
+
+	request := RedirectPaymentRequest{
+		UrlOk:           returnUrlOk,
+		UrlKo:           returnUrlKo,
+		UrlNotification: returnUrlNotification,
+		TpvId:           payee.GetTpvId(),
+	}
 
-	response, err := makeRedirectRequest("POST", fmt.Sprintf("%s/v1/services/%s/redirect-payments/create", apiUrl, payable.GetId()), body)
+	response, err := c.makeRedirectRequest(ctx, "CreateRedirectPayment", "POST", fmt.Sprintf("%s/v1/services/%s/redirect-payments/create", c.config.PaymentURL, payable.GetId()), request)
 	if err != nil {
 		return nil, err
 	}
@@ -149,80 +266,90 @@ func CreateRedirectPayment(payable Payable, payee Payee, returnUrlOk string, ret
 	return response, nil
 }
 
-func ConfirmPreautorhization(payable Payable) error {
+func (c *Client) ConfirmPreautorhization(ctx context.Context, payable Payable) error {
+	amount, err := amountOf(payable)
+	if err != nil {
+		return err
+	}
 
-	body := strings.NewReader(`{}`)
+	err = c.transitionPayment(ctx, payable.GetId(), "ConfirmPreautorhization", PAYMENT_STATE_CAPTURED, amount, func(ctx context.Context) (string, error) {
+		r, err := c.makeRequest(ctx, "ConfirmPreautorhization", "POST", fmt.Sprintf("%s/v1/services/%s/payments/confirm", c.config.PaymentURL, payable.GetId()), EmptyRequest{})
+		return paymentIdOf(r), err
+	})
+	if err == nil {
+		c.closePreauthorization(ctx, payable.GetId(), PREAUTHORIZATION_STATUS_CAPTURED)
+	}
 
-	_, err := makeRequest("POST", fmt.Sprintf("%s/v1/services/%s/payments/confirm", apiUrl, payable.GetId()), body)
 	return err
 }
 
-func CancelPreautorhization(payable Payable) error {
+func (c *Client) CancelPreautorhization(ctx context.Context, payable Payable) error {
 
-	body := strings.NewReader(`{}`)
+	err := c.transitionPayment(ctx, payable.GetId(), "CancelPreautorhization", PAYMENT_STATE_CANCELLED, 0, func(ctx context.Context) (string, error) {
+		r, err := c.makeRequest(ctx, "CancelPreautorhization", "POST", fmt.Sprintf("%s/v1/services/%s/payments/cancel", c.config.PaymentURL, payable.GetId()), EmptyRequest{})
+		return paymentIdOf(r), err
+	})
+	if err == nil {
+		c.closePreauthorization(ctx, payable.GetId(), PREAUTHORIZATION_STATUS_CANCELLED)
+	}
 
-	_, err := makeRequest("POST", fmt.Sprintf("%s/v1/services/%s/payments/cancel", apiUrl, payable.GetId()), body)
 	return err
 }
 
-func RefundPayment(payable Payable) error {
-	body := strings.NewReader(`{}`)
+// RefundPayment refunds everything left of the payable, see IssueRefund.
+func (c *Client) RefundPayment(ctx context.Context, payable Payable) error {
+	return c.refund(ctx, payable, nil, Refund{}, "RefundPayment")
+}
 
-	_, err := makeRequest("POST", fmt.Sprintf("%s/v1/services/%s/payments/refund", apiUrl, payable.GetId()), body)
-	return err
+// paymentStateOf returns the state a payment of the given type lands in.
+func paymentStateOf(paymentType string) PaymentState {
+	if paymentType == PAYMENT_TYPE_PREAUTHORIZATION {
+		return PAYMENT_STATE_PREAUTHORIZED
+	}
+	return PAYMENT_STATE_CAPTURED
 }
 
-func makeRequest(method string, url string, body *strings.Reader) (*PaymentResponse, error) {
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, err
+func paymentIdOf(r *PaymentResponse) string {
+	if r == nil {
+		return ""
 	}
-	req.Header.Set("Authorization", apiToken)
-	req.Header.Set("Content-Type", "application/json")
+	return r.GetPaymentId()
+}
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+// normalizeMetadata normalizes the vehicle plate so the payment API sees the
+// same plate for every spelling of it, and sets the breakdown of the amount,
+// if any, unless the payable already did.
+func normalizeMetadata(metadata PayableMetadata, breakdown *TaxBreakdown) PayableMetadata {
+	metadata.VehiclePlate = plate.Normalize(metadata.VehiclePlate)
+	if metadata.Breakdown == nil {
+		metadata.Breakdown = breakdown
+	}
+	return metadata
+}
 
+func (c *Client) makeRequest(ctx context.Context, operation string, method string, url string, request any) (*PaymentResponse, error) {
+	body, err := jsonBody(request)
 	if err != nil {
 		return nil, err
 	}
 
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("api-payment-error: %d", response.StatusCode)
-	}
-
 	paymentResponse := &PaymentResponse{}
-	err = json.NewDecoder(response.Body).Decode(paymentResponse)
-	if err != nil {
-		return nil, fmt.Errorf("api-payment-error: %s", err.Error())
+	if err := c.doIdempotent(ctx, BACKEND_PAYMENT, operation, method, url, body, paymentResponse); err != nil {
+		return nil, err
 	}
 
 	return paymentResponse, nil
 }
 
-func makeRedirectRequest(method string, url string, body *strings.Reader) (*RedirectPaymentResponse, error) {
-	req, err := http.NewRequest(method, url, body)
+func (c *Client) makeRedirectRequest(ctx context.Context, operation string, method string, url string, request any) (*RedirectPaymentResponse, error) {
+	body, err := jsonBody(request)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", apiToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	response, err := client.Do(req)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("api-payment-error: %d", response.StatusCode)
-	}
 
 	paymentResponse := &RedirectPaymentResponse{}
-	err = json.NewDecoder(response.Body).Decode(paymentResponse)
-	if err != nil {
-		return nil, fmt.Errorf("api-payment-error: %s", err.Error())
+	if err := c.doIdempotent(ctx, BACKEND_PAYMENT, operation, method, url, body, paymentResponse); err != nil {
+		return nil, err
 	}
 
 	return paymentResponse, nil
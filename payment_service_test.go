@@ -0,0 +1,191 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type taxedPayee struct {
+	testPayee
+	rate TaxRate
+}
+
+func (p taxedPayee) GetTaxRate() TaxRate { return p.rate }
+
+type taxedPayable struct {
+	testPayable
+	rate TaxRate
+}
+
+func (p taxedPayable) GetTaxRate() TaxRate { return p.rate }
+
+type pricedPayable struct {
+	testPayable
+	price Money
+}
+
+func (p pricedPayable) GetPrice() Money { return p.price }
+
+func requireBreakdown(t *testing.T, name string, breakdown *TaxBreakdown, net int64, tax int64, rate TaxRate) {
+	t.Helper()
+	if breakdown == nil {
+		t.Errorf("%s: no breakdown", name)
+		return
+	}
+	if breakdown.Net.Amount != net || breakdown.Tax.Amount != tax || breakdown.Rate != rate {
+		t.Errorf("%s: got %+v, want net %d and tax %d at %d", name, breakdown, net, tax, rate)
+	}
+}
+
+type organizationTaxRates map[string]TaxRate
+
+func (r organizationTaxRates) TaxRate(ctx context.Context, organizationId string) (TaxRate, error) {
+	rate, ok := r[organizationId]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return rate, nil
+}
+
+func TestTaxBreakdownFromOrganization(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{OrganizationTaxRates: organizationTaxRates{"o1": 2100}})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1210}
+
+	if err := c.CreateService(ctx, payable, testPayee{}); err != nil {
+		t.Fatal(err)
+	}
+	var created CreateServiceRequest
+	server.body(t, "create", &created)
+	requireBreakdown(t, "create", created.Breakdown, 1000, 210, 2100)
+
+	if err := c.UpdateService(ctx, nil, payable, testPayee{}, Cents(605)); err != nil {
+		t.Fatal(err)
+	}
+	var updated UpdateServiceRequest
+	server.body(t, "update", &updated)
+	requireBreakdown(t, "update", updated.Breakdown, 500, 105, 2100)
+	requireBreakdown(t, "update metadata", updated.Metadata.Breakdown, 500, 105, 2100)
+
+	// without a payee, or a known organization, there is no rate to split by
+	if err := c.UpdateService(ctx, nil, payable, nil, Cents(605)); err != nil {
+		t.Fatal(err)
+	}
+	var untaxed map[string]any
+	server.body(t, "update", &untaxed)
+	if _, ok := untaxed["breakdown"]; ok {
+		t.Errorf("update without payee sent a breakdown: %v", untaxed)
+	}
+
+	unknown := NewClient(Config{PaymentURL: c.config.PaymentURL, OrganizationTaxRates: organizationTaxRates{}})
+	if err := unknown.CreateService(ctx, payable, testPayee{}); err != nil {
+		t.Fatal(err)
+	}
+	var unknownCreated map[string]any
+	server.body(t, "create", &unknownCreated)
+	if _, ok := unknownCreated["breakdown"]; ok {
+		t.Errorf("create for an unknown organization sent a breakdown: %v", unknownCreated)
+	}
+}
+
+func TestOmitTaxBreakdown(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{OrganizationTaxRates: organizationTaxRates{"o1": 2100}, OmitTaxBreakdown: true})
+	ctx := context.Background()
+	payee := taxedPayee{rate: 2100}
+	payable := taxedPayable{testPayable{id: "p1", amount: 1210}, 1000}
+
+	if err := c.CreateService(ctx, payable, payee); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateService(ctx, nil, payable, payee, Cents(605)); err != nil {
+		t.Fatal(err)
+	}
+
+	var created map[string]any
+	server.body(t, "create", &created)
+	if _, ok := created["breakdown"]; ok {
+		t.Errorf("create sent a breakdown: %v", created)
+	}
+	var updated struct {
+		Breakdown *TaxBreakdown  `json:"breakdown"`
+		Metadata  map[string]any `json:"metadata"`
+	}
+	server.body(t, "update", &updated)
+	if _, ok := updated.Metadata["breakdown"]; updated.Breakdown != nil || ok {
+		t.Errorf("update sent a breakdown: %+v", updated)
+	}
+}
+
+func TestTaxBreakdownUsesPayee(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{OrganizationTaxRates: organizationTaxRates{"o1": 500}})
+	ctx := context.Background()
+	// the payee rate wins over the payable one, and both over the rate of
+	// the organization, everywhere
+	payee := taxedPayee{rate: 2100}
+	payable := taxedPayable{testPayable{id: "p1", amount: 1210}, 1000}
+
+	if err := c.CreateService(ctx, payable, payee); err != nil {
+		t.Fatal(err)
+	}
+	var created CreateServiceRequest
+	server.body(t, "create", &created)
+	requireBreakdown(t, "create", created.Breakdown, 1000, 210, 2100)
+
+	if err := c.UpdateService(ctx, nil, payable, payee, Cents(605)); err != nil {
+		t.Fatal(err)
+	}
+	var updated UpdateServiceRequest
+	server.body(t, "update", &updated)
+	if updated.Amount != 605 {
+		t.Errorf("update: got amount %d, want 605", updated.Amount)
+	}
+	requireBreakdown(t, "update", updated.Breakdown, 500, 105, 2100)
+	requireBreakdown(t, "update metadata", updated.Metadata.Breakdown, 500, 105, 2100)
+
+	if _, err := c.CreatePayment(ctx, payable, payee, PAYMENT_TYPE_PAYMENT); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RefundPartialPaymentFromService(ctx, payable, payee, Cents(121)); err != nil {
+		t.Fatal(err)
+	}
+	var refunded RefundPartialRequest
+	server.body(t, "refund-partial-amount", &refunded)
+	requireBreakdown(t, "refund", refunded.Breakdown, 100, 21, 2100)
+
+	// without a payee the payable rate applies
+	if err := c.IssueRefund(ctx, payable, nil, Refund{Amount: 110}); err != nil {
+		t.Fatal(err)
+	}
+	server.body(t, "refund-partial-amount", &refunded)
+	requireBreakdown(t, "refund without payee", refunded.Breakdown, 100, 10, 1000)
+}
+
+func TestPricedPayable(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{})
+	ctx := context.Background()
+
+	payable := pricedPayable{testPayable{id: "p1", amount: 1}, Cents(2500)}
+	if err := c.CreateService(ctx, payable, testPayee{}); err != nil {
+		t.Fatal(err)
+	}
+	var created CreateServiceRequest
+	server.body(t, "create", &created)
+	if created.Amount != 2500 {
+		t.Errorf("got amount %d, want the price 2500", created.Amount)
+	}
+
+	dollars := pricedPayable{testPayable{id: "p2", amount: 1}, Money{Amount: 2500, Currency: "USD"}}
+	if err := c.CreateService(ctx, dollars, testPayee{}); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("priced in USD: got %v, want ErrCurrencyMismatch", err)
+	}
+	if err := c.UpdateService(ctx, nil, payable, nil, Money{Amount: 100, Currency: "USD"}); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("update in USD: got %v, want ErrCurrencyMismatch", err)
+	}
+	if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Money{Amount: 100, Currency: "USD"}); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("refund in USD: got %v, want ErrCurrencyMismatch", err)
+	}
+	if calls := server.count("create") + server.count("update") + server.count("refund-partial-amount"); calls != 1 {
+		t.Errorf("got %d calls upstream, want only the first create", calls)
+	}
+}
@@ -0,0 +1,491 @@
+package innpark
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+const PAYMENT_TRANSITIONS_COLLECTION = "payment_transitions"
+
+// PaymentState is the lifecycle state of the payment of a Payable.
+type PaymentState string
+
+const (
+	// PAYMENT_STATE_UNKNOWN is the state of payables with no recorded
+	// transition, e.g. created before the client had a PaymentStateStore.
+	// They are not checked, any transition is accepted from it.
+	PAYMENT_STATE_UNKNOWN            PaymentState = ""
+	PAYMENT_STATE_CREATED            PaymentState = "created"
+	PAYMENT_STATE_PREAUTHORIZED      PaymentState = "preauthorized"
+	PAYMENT_STATE_CAPTURED           PaymentState = "captured"
+	PAYMENT_STATE_PARTIALLY_REFUNDED PaymentState = "partially_refunded"
+	PAYMENT_STATE_REFUNDED           PaymentState = "refunded"
+	PAYMENT_STATE_CANCELLED          PaymentState = "cancelled"
+	PAYMENT_STATE_FAILED             PaymentState = "failed" // rejected upstream, the payment can be retried
+)
+
+// paymentTransitions lists the states each state can move to.
+var paymentTransitions = map[PaymentState][]PaymentState{
+	PAYMENT_STATE_CREATED:            {PAYMENT_STATE_PREAUTHORIZED, PAYMENT_STATE_CAPTURED, PAYMENT_STATE_CANCELLED, PAYMENT_STATE_FAILED},
+	PAYMENT_STATE_FAILED:             {PAYMENT_STATE_PREAUTHORIZED, PAYMENT_STATE_CAPTURED, PAYMENT_STATE_CANCELLED, PAYMENT_STATE_FAILED},
+	PAYMENT_STATE_PREAUTHORIZED:      {PAYMENT_STATE_CAPTURED, PAYMENT_STATE_CANCELLED},
+	PAYMENT_STATE_CAPTURED:           {PAYMENT_STATE_PARTIALLY_REFUNDED, PAYMENT_STATE_REFUNDED},
+	PAYMENT_STATE_PARTIALLY_REFUNDED: {PAYMENT_STATE_PARTIALLY_REFUNDED, PAYMENT_STATE_REFUNDED},
+}
+
+// CanTransitionTo reports whether a payment in s may move to the state to.
+func (s PaymentState) CanTransitionTo(to PaymentState) bool {
+	if s == PAYMENT_STATE_UNKNOWN {
+		return to != PAYMENT_STATE_UNKNOWN
+	}
+	return slices.Contains(paymentTransitions[s], to)
+}
+
+// Final reports whether no transition leaves s.
+func (s PaymentState) Final() bool {
+	return s != PAYMENT_STATE_UNKNOWN && len(paymentTransitions[s]) == 0
+}
+
+var (
+	// ErrInvalidPaymentTransition is returned, before any upstream call,
+	// for operations the current state of the payment does not allow.
+	ErrInvalidPaymentTransition = errors.New("innpark: invalid payment transition")
+	// ErrPaymentTransitionPending is returned, before any upstream call,
+	// for operations on a payment whose last transition is still waiting
+	// for its upstream call, see ResolvePaymentTransition.
+	ErrPaymentTransitionPending = errors.New("innpark: payment transition pending")
+	// ErrNoPaymentStateStore is returned by the payment state reads of a
+	// client configured without a PaymentStateStore.
+	ErrNoPaymentStateStore = errors.New("innpark: no payment state store configured")
+)
+
+// PaymentTransition is an entry of the audit trail of a payment. The To of
+// the last transition is the current state of the payment, unless it is
+// Pending: transitions are recorded before their upstream call, so that
+// concurrent operations cannot both reach the payment API, and settled
+// once it answers.
+type PaymentTransition struct {
+	Id        string
+	PayableId string
+	// Sequence numbers the transitions of a payable from 1.
+	Sequence  int
+	From      PaymentState
+	To        PaymentState
+	Operation string
+	PaymentId string
+	// Amount is what the transition moved, in cents: authorized or
+	// captured by a payment, refunded by a refund. Zero for the others.
+	Amount         int
+	IdempotencyKey string
+	Pending        bool
+	Created        time.Time
+}
+
+// State returns the state the payment is in after the transition, its From
+// while it is pending.
+func (t PaymentTransition) State() PaymentState {
+	if t.Pending {
+		return t.From
+	}
+	return t.To
+}
+
+// PaymentStateStore persists the state of every payment and the
+// transitions that led to it.
+type PaymentStateStore interface {
+	// Last returns the last transition of the payable, the zero
+	// PaymentTransition when it has none.
+	Last(ctx context.Context, payableId string) (PaymentTransition, error)
+	// Append records the transition if the payable is still in its From
+	// state, otherwise it returns ErrInvalidPaymentTransition. It returns
+	// ErrPaymentTransitionPending when the last transition is pending.
+	Append(ctx context.Context, transition PaymentTransition) error
+	// Settle replaces the pending transition with the same PayableId and
+	// Sequence with the given one, to store the outcome of its upstream
+	// call. It returns ErrInvalidPaymentTransition when there is no such
+	// pending transition.
+	Settle(ctx context.Context, transition PaymentTransition) error
+	// Release deletes the pending transition of the payable with the given
+	// sequence, leaving the payment in its From state.
+	Release(ctx context.Context, payableId string, sequence int) error
+	// History returns the transitions of the payable, oldest first.
+	History(ctx context.Context, payableId string) ([]PaymentTransition, error)
+}
+
+// GetPaymentState returns the current state of the payment of the payable.
+func (c *Client) GetPaymentState(ctx context.Context, payableId string) (PaymentState, error) {
+	store := c.config.PaymentStateStore
+	if store == nil {
+		return PAYMENT_STATE_UNKNOWN, ErrNoPaymentStateStore
+	}
+
+	last, err := store.Last(ctx, payableId)
+	if err != nil {
+		return PAYMENT_STATE_UNKNOWN, err
+	}
+	return last.State(), nil
+}
+
+// GetPaymentHistory returns the audit trail of the payment of the payable,
+// oldest first.
+func (c *Client) GetPaymentHistory(ctx context.Context, payableId string) ([]PaymentTransition, error) {
+	store := c.config.PaymentStateStore
+	if store == nil {
+		return nil, ErrNoPaymentStateStore
+	}
+	return store.History(ctx, payableId)
+}
+
+// RecordPaymentState moves the payment of the payable to the state to
+// without calling upstream, for outcomes learnt elsewhere such as the Redsys
+// notification of a redirect payment. amount is what the outcome moved, in
+// cents, see PaymentTransition.Amount; refunds can only be issued on
+// payments captured with an amount. Without a PaymentStateStore it does
+// nothing.
+func (c *Client) RecordPaymentState(ctx context.Context, payableId string, to PaymentState, operation string, paymentId string, amount int) error {
+	return c.transitionPayment(ctx, payableId, operation, to, amount, func(ctx context.Context) (string, error) {
+		return paymentId, nil
+	})
+}
+
+// ResolvePaymentTransition settles the pending transition of the payable
+// once the outcome of its upstream call is known, e.g. from the payment API
+// after a timeout: applied moves the payment to the To of the transition,
+// otherwise the transition is dropped. Pending transitions are only settled
+// this way, retrying the operation fails with ErrPaymentTransitionPending.
+// The idempotency key of the transition is resolved with it, see
+// ResolveIdempotencyKey, so that a retry with it replays or resends the
+// call accordingly.
+func (c *Client) ResolvePaymentTransition(ctx context.Context, payableId string, applied bool, paymentId string) error {
+	store := c.config.PaymentStateStore
+	if store == nil {
+		return ErrNoPaymentStateStore
+	}
+
+	last, err := store.Last(ctx, payableId)
+	if err != nil {
+		return err
+	}
+	if !last.Pending {
+		return fmt.Errorf("%w: payable %s has no pending transition", ErrInvalidPaymentTransition, payableId)
+	}
+
+	if !applied {
+		err = store.Release(ctx, payableId, last.Sequence)
+	} else {
+		settled := last
+		settled.Pending = false
+		settled.PaymentId = paymentId
+		err = store.Settle(ctx, settled)
+	}
+	if err != nil || c.config.IdempotencyStore == nil || last.IdempotencyKey == "" {
+		return err
+	}
+
+	// generated keys were never stored
+	err = c.ResolveIdempotencyKey(ctx, last.IdempotencyKey, applied)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// transitionPayment runs call, the upstream side of an operation moving the
+// payment to the state to moving amount, if the current state allows it.
+// The transition is recorded pending before call, which makes it the single
+// winner among concurrent operations on the payable, and settled after it.
+// Payments rejected upstream move to PAYMENT_STATE_FAILED when their state
+// allows it and back to their previous state otherwise; calls whose outcome
+// is unknown stay pending, see ResolvePaymentTransition.
+func (c *Client) transitionPayment(ctx context.Context, payableId string, operation string, to PaymentState, amount int, call func(ctx context.Context) (string, error)) error {
+	return c.reservePayment(ctx, payableId, operation, amount, call, func(from PaymentState) (PaymentState, error) {
+		if !from.CanTransitionTo(to) {
+			return "", fmt.Errorf("%w: %s of payable %s from %q to %q", ErrInvalidPaymentTransition, operation, payableId, from, to)
+		}
+		return to, nil
+	})
+}
+
+// updatePayment runs call, the upstream side of an operation changing the
+// payment without moving it to another state, if the payment is in one of
+// the given states. It reserves a transition from the state to itself, as
+// transitionPayment does, so it cannot race the other operations. Payments
+// in PAYMENT_STATE_UNKNOWN are not tracked, call runs unreserved.
+func (c *Client) updatePayment(ctx context.Context, payableId string, operation string, call func(ctx context.Context) (string, error), states ...PaymentState) error {
+	return c.reservePayment(ctx, payableId, operation, 0, call, func(from PaymentState) (PaymentState, error) {
+		if from != PAYMENT_STATE_UNKNOWN && !slices.Contains(states, from) {
+			return "", fmt.Errorf("%w: %s of payable %s in %q", ErrInvalidPaymentTransition, operation, payableId, from)
+		}
+		return from, nil
+	})
+}
+
+// reservePayment records a pending transition of the payable to the state
+// next returns for its current one, runs call and settles the transition
+// with its outcome.
+func (c *Client) reservePayment(ctx context.Context, payableId string, operation string, amount int, call func(ctx context.Context) (string, error), next func(from PaymentState) (PaymentState, error)) error {
+	store := c.config.PaymentStateStore
+	if store == nil {
+		_, err := call(ctx)
+		return err
+	}
+
+	last, err := store.Last(ctx, payableId)
+	if err != nil {
+		return err
+	}
+
+	key, ok := IdempotencyKeyFromContext(ctx)
+	if !ok {
+		key = NewIdempotencyKey()
+		ctx = WithIdempotencyKey(ctx, key)
+	}
+
+	// whether the pending call was applied is unknown, so not even a retry
+	// with its own key may resend it
+	if last.Pending {
+		return fmt.Errorf("%w: %s of payable %s while %s is pending", ErrPaymentTransitionPending, operation, payableId, last.Operation)
+	}
+	// a retry of the call that made the last transition is let through so
+	// the idempotency store can replay it
+	if last.IdempotencyKey == key && last.Operation == operation {
+		_, err := call(ctx)
+		return err
+	}
+
+	to, err := next(last.To)
+	if err != nil {
+		return err
+	}
+	if to == PAYMENT_STATE_UNKNOWN {
+		_, err := call(ctx)
+		return err
+	}
+
+	reservation := PaymentTransition{
+		PayableId:      payableId,
+		Sequence:       last.Sequence + 1,
+		From:           last.To,
+		To:             to,
+		Operation:      operation,
+		Amount:         amount,
+		IdempotencyKey: key,
+		Pending:        true,
+	}
+	if err := store.Append(ctx, reservation); err != nil {
+		return err
+	}
+
+	paymentId, err := call(ctx)
+	c.settlePaymentTransition(ctx, store, reservation, paymentId, err)
+	return err
+}
+
+// requirePaymentState fails with ErrInvalidPaymentTransition unless the
+// payment of the payable is in one of the given states. Payments in
+// PAYMENT_STATE_UNKNOWN always pass.
+func (c *Client) requirePaymentState(ctx context.Context, payableId string, operation string, states ...PaymentState) error {
+	store := c.config.PaymentStateStore
+	if store == nil {
+		return nil
+	}
+
+	last, err := store.Last(ctx, payableId)
+	if err != nil {
+		return err
+	}
+	if last.Pending {
+		return fmt.Errorf("%w: %s of payable %s while %s is pending", ErrPaymentTransitionPending, operation, payableId, last.Operation)
+	}
+	if last.To != PAYMENT_STATE_UNKNOWN && !slices.Contains(states, last.To) {
+		return fmt.Errorf("%w: %s of payable %s in %q", ErrInvalidPaymentTransition, operation, payableId, last.To)
+	}
+	return nil
+}
+
+// settlePaymentTransition stores the outcome of the call of a pending
+// transition: applied, rejected upstream, which moves the payment to
+// PAYMENT_STATE_FAILED when the transition is a payment that allows it and
+// drops the transition otherwise, or unknown, which keeps it pending. It only logs
+// failures: the caller gets the error of the call.
+func (c *Client) settlePaymentTransition(ctx context.Context, store PaymentStateStore, pending PaymentTransition, paymentId string, callErr error) {
+	settled := pending
+	settled.Pending = false
+	settled.PaymentId = paymentId
+
+	var err error
+	switch {
+	case callErr == nil:
+		err = store.Settle(context.WithoutCancel(ctx), settled)
+	case !isUpstreamRejection(callErr):
+		return
+	case pending.From.CanTransitionTo(PAYMENT_STATE_FAILED) && pending.To != PAYMENT_STATE_CREATED && pending.To != pending.From:
+		settled.To, settled.Amount = PAYMENT_STATE_FAILED, 0
+		err = store.Settle(context.WithoutCancel(ctx), settled)
+	default:
+		err = store.Release(context.WithoutCancel(ctx), pending.PayableId, pending.Sequence)
+	}
+	if err != nil {
+		c.logger.ErrorContext(ctx, "error settling payment transition",
+			"payable_id", pending.PayableId,
+			"operation", pending.Operation,
+			"from", string(pending.From),
+			"to", string(settled.To),
+			"error", err)
+	}
+}
+
+// isUpstreamRejection tells a call rejected upstream, or never sent, apart
+// from one whose fate is unknown.
+func isUpstreamRejection(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= http.StatusBadRequest && apiErr.StatusCode < http.StatusInternalServerError {
+		return true
+	}
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrIdempotencyKeyInFlight)
+}
+
+type pocketBasePaymentStateStore struct {
+	app core.App
+}
+
+// NewPocketBasePaymentStateStore returns a PaymentStateStore backed by the
+// PAYMENT_TRANSITIONS_COLLECTION, creating the collection if needed.
+func NewPocketBasePaymentStateStore(app core.App) (PaymentStateStore, error) {
+	err := ensureCollection(app, PAYMENT_TRANSITIONS_COLLECTION,
+		[]*schema.SchemaField{
+			textField("payable_id", true),
+			numberField("sequence"),
+			textField("from_state", false),
+			textField("to_state", true),
+			textField("operation", false),
+			textField("payment_id", false),
+			numberField("amount"),
+			textField("idempotency_key", false),
+			boolField("pending"),
+		},
+		// the unique sequence turns concurrent transitions from the same
+		// state into a single winner
+		"CREATE UNIQUE INDEX idx_payment_transitions_sequence ON "+PAYMENT_TRANSITIONS_COLLECTION+" (payable_id, sequence)",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pocketBasePaymentStateStore{app: app}, nil
+}
+
+func (s *pocketBasePaymentStateStore) Last(ctx context.Context, payableId string) (PaymentTransition, error) {
+	records, err := s.app.Dao().FindRecordsByFilter(PAYMENT_TRANSITIONS_COLLECTION, "payable_id = {:id}", "-sequence", 1, 0, dbx.Params{"id": payableId})
+	if err != nil {
+		return PaymentTransition{}, err
+	}
+	if len(records) == 0 {
+		return PaymentTransition{PayableId: payableId}, nil
+	}
+	return paymentTransitionOf(records[0]), nil
+}
+
+func (s *pocketBasePaymentStateStore) Append(ctx context.Context, transition PaymentTransition) error {
+	last, err := s.Last(ctx, transition.PayableId)
+	if err != nil {
+		return err
+	}
+	if last.Pending {
+		return fmt.Errorf("%w: payable %s is moving to %q", ErrPaymentTransitionPending, transition.PayableId, last.To)
+	}
+	if last.To != transition.From || last.Sequence+1 != transition.Sequence {
+		return fmt.Errorf("%w: payable %s moved to %q", ErrInvalidPaymentTransition, transition.PayableId, last.To)
+	}
+
+	collection, err := s.app.Dao().FindCollectionByNameOrId(PAYMENT_TRANSITIONS_COLLECTION)
+	if err != nil {
+		return err
+	}
+
+	record := models.NewRecord(collection)
+	setPaymentTransition(record, transition)
+	if err := s.app.Dao().SaveRecord(record); err != nil {
+		return fmt.Errorf("%w: payable %s: %w", ErrInvalidPaymentTransition, transition.PayableId, err)
+	}
+
+	return nil
+}
+
+func (s *pocketBasePaymentStateStore) Settle(ctx context.Context, transition PaymentTransition) error {
+	record, err := s.findPending(transition.PayableId, transition.Sequence)
+	if err != nil {
+		return err
+	}
+
+	setPaymentTransition(record, transition)
+	return s.app.Dao().SaveRecord(record)
+}
+
+func (s *pocketBasePaymentStateStore) Release(ctx context.Context, payableId string, sequence int) error {
+	record, err := s.findPending(payableId, sequence)
+	if err != nil {
+		return err
+	}
+
+	return s.app.Dao().DeleteRecord(record)
+}
+
+func (s *pocketBasePaymentStateStore) findPending(payableId string, sequence int) (*models.Record, error) {
+	record, err := s.app.Dao().FindFirstRecordByFilter(PAYMENT_TRANSITIONS_COLLECTION, "payable_id = {:id} && sequence = {:sequence} && pending = true", dbx.Params{"id": payableId, "sequence": sequence})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: payable %s has no pending transition %d", ErrInvalidPaymentTransition, payableId, sequence)
+	}
+	return record, err
+}
+
+func (s *pocketBasePaymentStateStore) History(ctx context.Context, payableId string) ([]PaymentTransition, error) {
+	records, err := s.app.Dao().FindRecordsByFilter(PAYMENT_TRANSITIONS_COLLECTION, "payable_id = {:id}", "sequence", 0, 0, dbx.Params{"id": payableId})
+	if err != nil {
+		return nil, err
+	}
+
+	transitions := make([]PaymentTransition, 0, len(records))
+	for _, record := range records {
+		transitions = append(transitions, paymentTransitionOf(record))
+	}
+	return transitions, nil
+}
+
+func setPaymentTransition(record *models.Record, transition PaymentTransition) {
+	record.Set("payable_id", transition.PayableId)
+	record.Set("sequence", transition.Sequence)
+	record.Set("from_state", string(transition.From))
+	record.Set("to_state", string(transition.To))
+	record.Set("operation", transition.Operation)
+	record.Set("payment_id", transition.PaymentId)
+	record.Set("amount", transition.Amount)
+	record.Set("idempotency_key", transition.IdempotencyKey)
+	record.Set("pending", transition.Pending)
+}
+
+func paymentTransitionOf(record *models.Record) PaymentTransition {
+	return PaymentTransition{
+		Id:             record.Id,
+		PayableId:      record.GetString("payable_id"),
+		Sequence:       record.GetInt("sequence"),
+		From:           PaymentState(record.GetString("from_state")),
+		To:             PaymentState(record.GetString("to_state")),
+		Operation:      record.GetString("operation"),
+		PaymentId:      record.GetString("payment_id"),
+		Amount:         record.GetInt("amount"),
+		IdempotencyKey: record.GetString("idempotency_key"),
+		Pending:        record.GetBool("pending"),
+		Created:        record.GetDateTime("created").Time(),
+	}
+}
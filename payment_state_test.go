@@ -0,0 +1,387 @@
+package innpark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+type testPayable struct {
+	id     string
+	amount int
+}
+
+func (p testPayable) GetId() string                        { return p.id }
+func (p testPayable) GetAmount() int                       { return p.amount }
+func (p testPayable) GetUserId() string                    { return "u1" }
+func (p testPayable) GetMetadata(core.App) PayableMetadata { return PayableMetadata{} }
+
+type memoryPaymentStateStore struct {
+	mu          sync.Mutex
+	transitions map[string][]PaymentTransition
+}
+
+func newMemoryPaymentStateStore() *memoryPaymentStateStore {
+	return &memoryPaymentStateStore{transitions: map[string][]PaymentTransition{}}
+}
+
+func (s *memoryPaymentStateStore) Last(ctx context.Context, payableId string) (PaymentTransition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last(payableId), nil
+}
+
+func (s *memoryPaymentStateStore) last(payableId string) PaymentTransition {
+	transitions := s.transitions[payableId]
+	if len(transitions) == 0 {
+		return PaymentTransition{PayableId: payableId}
+	}
+	return transitions[len(transitions)-1]
+}
+
+func (s *memoryPaymentStateStore) Append(ctx context.Context, transition PaymentTransition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.last(transition.PayableId)
+	if last.Pending {
+		return ErrPaymentTransitionPending
+	}
+	if last.To != transition.From || last.Sequence+1 != transition.Sequence {
+		return ErrInvalidPaymentTransition
+	}
+	s.transitions[transition.PayableId] = append(s.transitions[transition.PayableId], transition)
+	return nil
+}
+
+func (s *memoryPaymentStateStore) Settle(ctx context.Context, transition PaymentTransition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transitions := s.transitions[transition.PayableId]
+	for i := range transitions {
+		if transitions[i].Sequence == transition.Sequence && transitions[i].Pending {
+			transitions[i] = transition
+			return nil
+		}
+	}
+	return ErrInvalidPaymentTransition
+}
+
+func (s *memoryPaymentStateStore) Release(ctx context.Context, payableId string, sequence int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transitions := s.transitions[payableId]
+	for i := range transitions {
+		if transitions[i].Sequence == sequence && transitions[i].Pending {
+			s.transitions[payableId] = append(transitions[:i:i], transitions[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInvalidPaymentTransition
+}
+
+func (s *memoryPaymentStateStore) History(ctx context.Context, payableId string) ([]PaymentTransition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PaymentTransition(nil), s.transitions[payableId]...), nil
+}
+
+// paymentServer answers every payment call with the status of the last path
+// segment found in statuses, 200 by default, counting the calls per path and
+// keeping the last body of each.
+type paymentServer struct {
+	mu       sync.Mutex
+	calls    map[string]int
+	bodies   map[string][]byte
+	statuses map[string]int
+	// received, when set, is signalled on every call, which then waits for
+	// release
+	received chan string
+	release  chan struct{}
+}
+
+func newPaymentServer(t *testing.T, config Config) (*paymentServer, *Client, *memoryPaymentStateStore) {
+	s := &paymentServer{calls: map[string]int{}, bodies: map[string][]byte{}, statuses: map[string]int{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.calls[action]++
+		s.bodies[action] = body
+		status, ok := s.statuses[action]
+		s.mu.Unlock()
+
+		if s.received != nil {
+			s.received <- action
+			<-s.release
+		}
+		if ok {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"message":"%s"}`, http.StatusText(status))
+			return
+		}
+		w.Write([]byte(`{"Payable":{"id":"p1","last_payment_id":"pay1"}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	store := newMemoryPaymentStateStore()
+	config.PaymentURL = server.URL
+	config.PaymentStateStore = store
+	return s, NewClient(config), store
+}
+
+func (s *paymentServer) count(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[action]
+}
+
+// body decodes the last body received for action into v.
+func (s *paymentServer) body(t *testing.T, action string, v any) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := json.Unmarshal(s.bodies[action], v); err != nil {
+		t.Fatalf("%s body %q: %v", action, s.bodies[action], err)
+	}
+}
+
+func requireState(t *testing.T, c *Client, payableId string, want PaymentState) {
+	t.Helper()
+	state, err := c.GetPaymentState(context.Background(), payableId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != want {
+		t.Errorf("state: got %q, want %q", state, want)
+	}
+}
+
+func TestTransitionPaymentReservesBeforeCalling(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+
+	if err := c.RecordPaymentState(ctx, payable.id, PAYMENT_STATE_PREAUTHORIZED, "CreatePayment", "pay1", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	server.received = make(chan string)
+	server.release = make(chan struct{})
+	confirmed := make(chan error)
+	go func() {
+		confirmed <- c.ConfirmPreautorhization(ctx, payable)
+	}()
+	<-server.received
+
+	// the confirm is in flight upstream, so the cancel must not reach it
+	if err := c.CancelPreautorhization(ctx, payable); !errors.Is(err, ErrPaymentTransitionPending) {
+		t.Errorf("concurrent cancel: got %v, want ErrPaymentTransitionPending", err)
+	}
+	if err := c.UpdateService(ctx, nil, payable, nil, Cents(500)); !errors.Is(err, ErrPaymentTransitionPending) {
+		t.Errorf("concurrent update: got %v, want ErrPaymentTransitionPending", err)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_PREAUTHORIZED)
+
+	close(server.release)
+	if err := <-confirmed; err != nil {
+		t.Fatal(err)
+	}
+
+	if server.count("cancel") != 0 {
+		t.Errorf("cancel reached upstream %d times", server.count("cancel"))
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_CAPTURED)
+
+	history, err := c.GetPaymentHistory(ctx, payable.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := history[len(history)-1]; last.Pending || last.PaymentId != "pay1" || last.Sequence != 2 {
+		t.Errorf("got %+v", last)
+	}
+}
+
+func TestTransitionPaymentRejected(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+	server.statuses["create"] = http.StatusUnprocessableEntity
+	server.statuses["confirm"] = http.StatusUnprocessableEntity
+
+	if err := c.RecordPaymentState(ctx, payable.id, PAYMENT_STATE_CREATED, "CreateService", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// payments rejected upstream can be retried
+	if _, err := c.CreatePayment(ctx, payable, testPayee{}, PAYMENT_TYPE_PREAUTHORIZATION); err == nil {
+		t.Fatal("rejected payment succeeded")
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_FAILED)
+
+	delete(server.statuses, "create")
+	if _, err := c.CreatePayment(ctx, payable, testPayee{}, PAYMENT_TYPE_PREAUTHORIZATION); err != nil {
+		t.Fatal(err)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_PREAUTHORIZED)
+
+	// a rejected confirm leaves the hold as it was
+	if err := c.ConfirmPreautorhization(ctx, payable); err == nil {
+		t.Fatal("rejected confirm succeeded")
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_PREAUTHORIZED)
+
+	if err := c.CancelPreautorhization(ctx, payable); err != nil {
+		t.Fatal(err)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_CANCELLED)
+
+	if err := c.ConfirmPreautorhization(ctx, payable); !errors.Is(err, ErrInvalidPaymentTransition) {
+		t.Errorf("confirm after cancel: got %v, want ErrInvalidPaymentTransition", err)
+	}
+	if calls := server.count("confirm"); calls != 1 {
+		t.Errorf("confirm reached upstream %d times, want 1", calls)
+	}
+}
+
+func TestTransitionPaymentUnknownOutcome(t *testing.T) {
+	server, c, store := newPaymentServer(t, Config{IdempotencyStore: newMemoryIdempotencyStore()})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+	server.statuses["confirm"] = http.StatusInternalServerError
+
+	if err := c.RecordPaymentState(ctx, payable.id, PAYMENT_STATE_PREAUTHORIZED, "CreatePayment", "pay1", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	keyed := WithIdempotencyKey(ctx, "confirm-1")
+	if err := c.ConfirmPreautorhization(keyed, payable); err == nil {
+		t.Fatal("failed confirm succeeded")
+	}
+	last, _ := store.Last(ctx, payable.id)
+	if !last.Pending || last.To != PAYMENT_STATE_CAPTURED {
+		t.Fatalf("got %+v, want a pending capture", last)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_PREAUTHORIZED)
+
+	if err := c.CancelPreautorhization(ctx, payable); !errors.Is(err, ErrPaymentTransitionPending) {
+		t.Errorf("cancel while pending: got %v, want ErrPaymentTransitionPending", err)
+	}
+
+	// not even a retry with the same key may resend it
+	delete(server.statuses, "confirm")
+	if err := c.ConfirmPreautorhization(keyed, payable); !errors.Is(err, ErrPaymentTransitionPending) {
+		t.Errorf("retry while pending: got %v, want ErrPaymentTransitionPending", err)
+	}
+	if calls := server.count("confirm"); calls != 1 {
+		t.Fatalf("confirm reached upstream %d times, want 1", calls)
+	}
+
+	// once it is known not to have been applied, the key can be sent again
+	if err := c.ResolvePaymentTransition(ctx, payable.id, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConfirmPreautorhization(keyed, payable); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConfirmPreautorhization(keyed, payable); err != nil {
+		t.Fatal(err)
+	}
+	if calls := server.count("confirm"); calls != 2 {
+		t.Errorf("confirm reached upstream %d times, want 2", calls)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_CAPTURED)
+}
+
+func TestUpdateServiceReservesTransition(t *testing.T) {
+	server, c, store := newPaymentServer(t, Config{})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+
+	// untracked payments are updated without a transition
+	if err := c.UpdateService(ctx, nil, payable, nil, Cents(500)); err != nil {
+		t.Fatal(err)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_UNKNOWN)
+
+	if err := c.RecordPaymentState(ctx, payable.id, PAYMENT_STATE_FAILED, "CreatePayment", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateService(ctx, nil, payable, nil, Cents(600)); err != nil {
+		t.Fatal(err)
+	}
+	last, _ := store.Last(ctx, payable.id)
+	if last.Pending || last.Operation != "UpdateService" || last.From != PAYMENT_STATE_FAILED || last.To != PAYMENT_STATE_FAILED {
+		t.Errorf("got %+v, want a settled update", last)
+	}
+
+	// a rejected update leaves the payment as it was
+	server.statuses["update"] = http.StatusUnprocessableEntity
+	if err := c.UpdateService(ctx, nil, payable, nil, Cents(700)); err == nil {
+		t.Fatal("rejected update succeeded")
+	}
+	if history, _ := c.GetPaymentHistory(ctx, payable.id); len(history) != 2 {
+		t.Errorf("got %d transitions, want 2", len(history))
+	}
+
+	server.statuses["update"] = http.StatusGatewayTimeout
+	if err := c.UpdateService(ctx, nil, payable, nil, Cents(700)); err == nil {
+		t.Fatal("failed update succeeded")
+	}
+	if _, err := c.CreatePayment(ctx, payable, testPayee{}, PAYMENT_TYPE_PAYMENT); !errors.Is(err, ErrPaymentTransitionPending) {
+		t.Errorf("payment while the update is pending: got %v, want ErrPaymentTransitionPending", err)
+	}
+
+	if err := c.RecordPaymentState(ctx, "p2", PAYMENT_STATE_CAPTURED, "CreatePayment", "pay1", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateService(ctx, nil, testPayable{id: "p2"}, nil, Cents(500)); !errors.Is(err, ErrInvalidPaymentTransition) {
+		t.Errorf("update after capture: got %v, want ErrInvalidPaymentTransition", err)
+	}
+	if calls := server.count("update"); calls != 4 {
+		t.Errorf("update reached upstream %d times, want 4", calls)
+	}
+}
+
+func TestResolvePaymentTransition(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+	server.statuses["confirm"] = http.StatusInternalServerError
+
+	if err := c.ResolvePaymentTransition(ctx, payable.id, true, ""); !errors.Is(err, ErrInvalidPaymentTransition) {
+		t.Errorf("nothing pending: got %v, want ErrInvalidPaymentTransition", err)
+	}
+
+	if err := c.RecordPaymentState(ctx, payable.id, PAYMENT_STATE_PREAUTHORIZED, "CreatePayment", "pay1", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	c.ConfirmPreautorhization(ctx, payable)
+	if err := c.ResolvePaymentTransition(ctx, payable.id, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_PREAUTHORIZED)
+
+	c.ConfirmPreautorhization(ctx, payable)
+	if err := c.ResolvePaymentTransition(ctx, payable.id, true, "pay2"); err != nil {
+		t.Fatal(err)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_CAPTURED)
+}
+
+type testPayee struct{}
+
+func (testPayee) GetTpvId() string          { return "tpv1" }
+func (testPayee) GetOrganizationId() string { return "o1" }
@@ -0,0 +1,147 @@
+// Package plate normalizes and validates vehicle license plates.
+//
+// Plates are compared in their normalized form: upper case, without spaces,
+// hyphens or dots, so "1234 abc", "1234-ABC" and "1234ABC" are the same
+// plate.
+package plate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalid = errors.New("plate: invalid plate")
+
+// Format identifies the registration scheme a plate follows.
+type Format string
+
+const (
+	FORMAT_ES_CURRENT    Format = "es-current"    // 1234BCD, since 2000
+	FORMAT_ES_PROVINCIAL Format = "es-provincial" // M1234AB or M123456, before 2000
+	FORMAT_ES_MOPED      Format = "es-moped"      // C1234BCD
+	FORMAT_ES_HISTORIC   Format = "es-historic"   // H1234BCD
+	FORMAT_ES_TRAILER    Format = "es-trailer"    // R1234BCD
+	FORMAT_ES_SPECIAL    Format = "es-special"    // E1234BCD, agricultural and works vehicles
+	FORMAT_ES_TEMPORARY  Format = "es-temporary"  // P1234BCD
+	FORMAT_ES_DIPLOMATIC Format = "es-diplomatic" // CD12345, CC, OI and TA
+	FORMAT_EU            Format = "eu"            // see Plate.Country
+)
+
+// Kind is the kind of vehicle a plate is issued to, when the format tells.
+// Cars and motorbikes share the formats of every supported country, so only
+// mopeds can be told apart.
+type Kind string
+
+const (
+	KIND_UNKNOWN Kind = ""
+	KIND_MOPED   Kind = "MOPED"
+)
+
+// Plate is a parsed license plate.
+type Plate struct {
+	Value   string // normalized plate
+	Format  Format
+	Country string // ISO 3166-1 alpha-2 code
+	Kind    Kind
+}
+
+func (p Plate) String() string {
+	return p.Value
+}
+
+// spanish consonants used by the current scheme, vowels, Ñ and Q are never
+// issued
+const consonants = "[BCDFGHJKLMNPRSTVWXYZ]"
+
+var provinces = strings.Join([]string{
+	"A", "AB", "AL", "AV", "B", "BA", "BI", "BU", "C", "CA", "CC", "CE", "CO", "CR", "CS", "CU",
+	"GC", "GE", "GI", "GR", "GU", "H", "HU", "IB", "J", "L", "LE", "LO", "LU", "M", "MA", "ML",
+	"MU", "NA", "O", "OR", "OU", "P", "PM", "PO", "S", "SA", "SE", "SG", "SO", "SS", "T", "TE",
+	"TF", "TO", "V", "VA", "VI", "Z", "ZA",
+}, "|")
+
+type scheme struct {
+	format  Format
+	country string
+	kind    Kind
+	pattern *regexp.Regexp
+}
+
+// schemes are tried in order, the more specific ones first.
+var schemes = []scheme{
+	{FORMAT_ES_CURRENT, "ES", KIND_UNKNOWN, regexp.MustCompile(`^[0-9]{4}` + consonants + `{3}$`)},
+	{FORMAT_ES_MOPED, "ES", KIND_MOPED, regexp.MustCompile(`^C[0-9]{4}` + consonants + `{3}$`)},
+	{FORMAT_ES_HISTORIC, "ES", KIND_UNKNOWN, regexp.MustCompile(`^H[0-9]{4}` + consonants + `{3}$`)},
+	{FORMAT_ES_TRAILER, "ES", KIND_UNKNOWN, regexp.MustCompile(`^R[0-9]{4}` + consonants + `{3}$`)},
+	{FORMAT_ES_SPECIAL, "ES", KIND_UNKNOWN, regexp.MustCompile(`^E[0-9]{4}` + consonants + `{3}$`)},
+	{FORMAT_ES_TEMPORARY, "ES", KIND_UNKNOWN, regexp.MustCompile(`^P[0-9]{4}` + consonants + `{3}$`)},
+	{FORMAT_ES_DIPLOMATIC, "ES", KIND_UNKNOWN, regexp.MustCompile(`^(CD|CC|OI|TA)[0-9]{4,6}$`)},
+	{FORMAT_ES_PROVINCIAL, "ES", KIND_UNKNOWN, regexp.MustCompile(`^(` + provinces + `)([0-9]{4}[A-Z]{1,2}|[0-9]{1,6})$`)},
+
+	{FORMAT_EU, "PT", KIND_UNKNOWN, regexp.MustCompile(`^([A-Z]{2}[0-9]{2}[A-Z]{2}|[0-9]{2}[A-Z]{2}[0-9]{2}|[A-Z]{2}[0-9]{4}|[0-9]{4}[A-Z]{2})$`)},
+	{FORMAT_EU, "FR", KIND_UNKNOWN, regexp.MustCompile(`^[A-HJ-NP-TV-Z]{2}[0-9]{3}[A-HJ-NP-TV-Z]{2}$`)},
+	{FORMAT_EU, "IT", KIND_UNKNOWN, regexp.MustCompile(`^[A-HJ-NPR-TV-Z]{2}[0-9]{3}[A-HJ-NPR-TV-Z]{2}$`)},
+	{FORMAT_EU, "BE", KIND_UNKNOWN, regexp.MustCompile(`^[0-9][A-Z]{3}[0-9]{3}$`)},
+	{FORMAT_EU, "NL", KIND_UNKNOWN, regexp.MustCompile(`^([A-Z]{2}[0-9]{3}[A-Z]|[0-9][A-Z]{3}[0-9]{2}|[A-Z]{2}[0-9]{2}[A-Z]{2}|[0-9]{2}[A-Z]{3}[0-9])$`)},
+	{FORMAT_EU, "GB", KIND_UNKNOWN, regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z]{3}$`)},
+	{FORMAT_EU, "DE", KIND_UNKNOWN, regexp.MustCompile(`^[A-ZÄÖÜ]{1,3}[A-Z]{1,2}[0-9]{1,4}[EH]?$`)},
+}
+
+// Normalize returns the plate in upper case without whitespace, hyphens or
+// dots. It does not validate it.
+func Normalize(plate string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '-' || r == '.' || r == '·' {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, plate)
+}
+
+// Clean normalizes the plate and only fails, with ErrInvalid, when nothing
+// is left. Unlike Parse it accepts plates of formats it does not know, as
+// valid foreign plates are.
+func Clean(plate string) (string, error) {
+	value := Normalize(plate)
+	if value == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalid, plate)
+	}
+	return value, nil
+}
+
+// Parse normalizes the plate and identifies its format. It fails with
+// ErrInvalid when the plate matches none of the known formats.
+func Parse(plate string) (Plate, error) {
+	value := Normalize(plate)
+	for _, s := range schemes {
+		if s.pattern.MatchString(value) {
+			return Plate{
+				Value:   value,
+				Format:  s.format,
+				Country: s.country,
+				Kind:    s.kind,
+			}, nil
+		}
+	}
+	return Plate{}, fmt.Errorf("%w: %q", ErrInvalid, plate)
+}
+
+// Valid reports whether the plate follows one of the known formats.
+func Valid(plate string) bool {
+	_, err := Parse(plate)
+	return err == nil
+}
+
+// InferKind returns the kind of vehicle the plate is issued to, or
+// KIND_UNKNOWN when the format is shared by several kinds or the plate is
+// not valid.
+func InferKind(plate string) Kind {
+	p, err := Parse(plate)
+	if err != nil {
+		return KIND_UNKNOWN
+	}
+	return p.Kind
+}
@@ -0,0 +1,80 @@
+package plate
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"1234 abc":   "1234ABC",
+		"1234-abc":   "1234ABC",
+		" 1234ABC\t": "1234ABC",
+		"m-1234-ab":  "M1234AB",
+		"ab.123.cd":  "AB123CD",
+		"l·1234·a":   "L1234A",
+	}
+	for plate, want := range tests {
+		if got := Normalize(plate); got != want {
+			t.Errorf("%q: got %q, want %q", plate, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		plate   string
+		value   string
+		format  Format
+		country string
+		kind    Kind
+	}{
+		{plate: "1234 BCD", value: "1234BCD", format: FORMAT_ES_CURRENT, country: "ES"},
+		{plate: "c-1234-bcd", value: "C1234BCD", format: FORMAT_ES_MOPED, country: "ES", kind: KIND_MOPED},
+		{plate: "H1234BCD", value: "H1234BCD", format: FORMAT_ES_HISTORIC, country: "ES"},
+		{plate: "R1234BCD", value: "R1234BCD", format: FORMAT_ES_TRAILER, country: "ES"},
+		{plate: "E1234BCD", value: "E1234BCD", format: FORMAT_ES_SPECIAL, country: "ES"},
+		{plate: "P1234BCD", value: "P1234BCD", format: FORMAT_ES_TEMPORARY, country: "ES"},
+		{plate: "CD 12345", value: "CD12345", format: FORMAT_ES_DIPLOMATIC, country: "ES"},
+		{plate: "M-1234-AB", value: "M1234AB", format: FORMAT_ES_PROVINCIAL, country: "ES"},
+		{plate: "B-123456", value: "B123456", format: FORMAT_ES_PROVINCIAL, country: "ES"},
+		{plate: "AB-123-CD", value: "AB123CD", format: FORMAT_EU, country: "FR"},
+		{plate: "12-AB-34", value: "12AB34", format: FORMAT_EU, country: "PT"},
+		{plate: "1-ABC-123", value: "1ABC123", format: FORMAT_EU, country: "BE"},
+		{plate: "AB12 CDE", value: "AB12CDE", format: FORMAT_EU, country: "GB"},
+	}
+
+	for _, tt := range tests {
+		p, err := Parse(tt.plate)
+		if err != nil {
+			t.Errorf("%q: %v", tt.plate, err)
+			continue
+		}
+		if p.Value != tt.value || p.Format != tt.format || p.Country != tt.country || p.Kind != tt.kind {
+			t.Errorf("%q: got %+v", tt.plate, p)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	// vowels are never issued in the current Spanish scheme
+	for _, plate := range []string{"", "1234AEI", "12345", "ZH123456", "WA12345"} {
+		if _, err := Parse(plate); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q: got %v, want ErrInvalid", plate, err)
+		}
+	}
+}
+
+func TestInferKind(t *testing.T) {
+	tests := map[string]Kind{
+		"C1234BCD": KIND_MOPED,
+		"1234BCD":  KIND_UNKNOWN,
+		"M1234AB":  KIND_UNKNOWN,
+		"invalid!": KIND_UNKNOWN,
+	}
+	for plate, want := range tests {
+		if got := InferKind(plate); got != want {
+			t.Errorf("%q: got %q, want %q", plate, got, want)
+		}
+	}
+}
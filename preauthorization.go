@@ -0,0 +1,416 @@
+package innpark
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+const (
+	PREAUTHORIZATIONS_COLLECTION = "preauthorizations"
+
+	// DEFAULT_PREAUTHORIZATION_TTL is how long the bank is assumed to keep
+	// a hold when it is tracked by CreatePayment.
+	DEFAULT_PREAUTHORIZATION_TTL = 7 * 24 * time.Hour
+)
+
+// PreauthorizationPolicy is what the expiry job does with a hold about to
+// lapse.
+type PreauthorizationPolicy string
+
+const (
+	PREAUTHORIZATION_POLICY_CAPTURE PreauthorizationPolicy = "capture"
+	PREAUTHORIZATION_POLICY_CANCEL  PreauthorizationPolicy = "cancel"
+)
+
+// PreauthorizationStatus is the state of a tracked hold.
+type PreauthorizationStatus string
+
+const (
+	PREAUTHORIZATION_STATUS_OPEN      PreauthorizationStatus = "open"
+	PREAUTHORIZATION_STATUS_CAPTURED  PreauthorizationStatus = "captured"
+	PREAUTHORIZATION_STATUS_CANCELLED PreauthorizationStatus = "cancelled"
+	PREAUTHORIZATION_STATUS_LAPSED    PreauthorizationStatus = "lapsed" // released by the bank before being settled
+)
+
+// ErrNoPreauthorizationStore is returned by the preauthorization calls of a
+// client configured without a PreauthorizationStore.
+var ErrNoPreauthorizationStore = errors.New("innpark: no preauthorization store configured")
+
+// Preauthorization is an open hold on the card of a user, tracked until it
+// is captured, cancelled or lapses. Amount is the held amount in cents.
+// An empty Policy defers to the PreauthorizationExpiryOptions.
+type Preauthorization struct {
+	Id             string
+	PayableId      string
+	UserId         string
+	OrganizationId string
+	PaymentId      string
+	Amount         int
+	Policy         PreauthorizationPolicy
+	Status         PreauthorizationStatus
+	ExpiresAt      time.Time
+	NotifiedAt     time.Time
+	Created        time.Time
+}
+
+// PreauthorizationStore tracks the holds of preauthorization payments.
+type PreauthorizationStore interface {
+	// Track records the hold, replacing the one tracked for the same
+	// payable.
+	Track(ctx context.Context, preauthorization Preauthorization) error
+	// Close moves the hold of the payable out of
+	// PREAUTHORIZATION_STATUS_OPEN. Payables without a hold are ignored.
+	Close(ctx context.Context, payableId string, status PreauthorizationStatus) error
+	// MarkNotified records that the user was told the hold is about to
+	// lapse.
+	MarkNotified(ctx context.Context, payableId string, at time.Time) error
+	// Expiring returns the open holds expiring before the given time,
+	// soonest first.
+	Expiring(ctx context.Context, before time.Time) ([]Preauthorization, error)
+}
+
+// TrackPreauthorization starts tracking a hold. CreatePayment already
+// tracks the preauthorizations it makes for DEFAULT_PREAUTHORIZATION_TTL;
+// use it to set a different expiry or policy.
+func (c *Client) TrackPreauthorization(ctx context.Context, preauthorization Preauthorization) error {
+	store := c.config.PreauthorizationStore
+	if store == nil {
+		return ErrNoPreauthorizationStore
+	}
+
+	if preauthorization.Status == "" {
+		preauthorization.Status = PREAUTHORIZATION_STATUS_OPEN
+	}
+	return store.Track(ctx, preauthorization)
+}
+
+// trackPreauthorization tracks the hold made by a successful
+// preauthorization payment.
+func (c *Client) trackPreauthorization(ctx context.Context, payable Payable, payee Payee, amount int, r *PaymentResponse) {
+	if c.config.PreauthorizationStore == nil {
+		return
+	}
+
+	err := c.TrackPreauthorization(context.WithoutCancel(ctx), Preauthorization{
+		PayableId:      payable.GetId(),
+		UserId:         payable.GetUserId(),
+		OrganizationId: payee.GetOrganizationId(),
+		PaymentId:      paymentIdOf(r),
+		Amount:         amount,
+		ExpiresAt:      time.Now().Add(DEFAULT_PREAUTHORIZATION_TTL),
+	})
+	if err != nil {
+		c.logger.ErrorContext(ctx, "error tracking preauthorization",
+			"payable_id", payable.GetId(),
+			"error", err)
+	}
+}
+
+// closePreauthorization stops tracking the hold of a payable settled
+// upstream.
+func (c *Client) closePreauthorization(ctx context.Context, payableId string, status PreauthorizationStatus) {
+	store := c.config.PreauthorizationStore
+	if store == nil {
+		return
+	}
+
+	if err := store.Close(context.WithoutCancel(ctx), payableId, status); err != nil {
+		c.logger.ErrorContext(ctx, "error closing preauthorization",
+			"payable_id", payableId,
+			"status", string(status),
+			"error", err)
+	}
+}
+
+// PreauthorizationExpiryOptions configures SettleExpiringPreauthorizations.
+type PreauthorizationExpiryOptions struct {
+	// Policy applies to holds tracked without one. Defaults to
+	// PREAUTHORIZATION_POLICY_CANCEL.
+	Policy PreauthorizationPolicy
+	// NotifyBefore is how long before the expiry of a hold the user is
+	// sent Workflow. Defaults to 24 hours.
+	NotifyBefore time.Duration
+	// Workflow is the Novu workflow triggered for holds about to lapse.
+	// Defaults to WORKFLOW_PREAUTHORIZATION_EXPIRING.
+	Workflow string
+	// SettleBefore is how long before the expiry of a hold it is captured
+	// or cancelled. Defaults to 1 hour.
+	SettleBefore time.Duration
+	// Resolve returns the payable of a hold to capture, with the amount of
+	// the stay as GetAmount. When it differs from the held amount the
+	// service is updated first, with the metadata the payable reads from
+	// App, which is then required. A nil Resolve captures the held amount.
+	Resolve func(ctx context.Context, preauthorization Preauthorization) (Payable, error)
+	App     core.App
+	// Payee returns the payee of a hold whose service is updated, which
+	// gives the breakdown of the new amount as in UpdateService. When nil,
+	// the breakdown is left to the payable.
+	Payee func(ctx context.Context, preauthorization Preauthorization) (Payee, error)
+}
+
+// SettleExpiringPreauthorizations goes through the open holds: it notifies
+// the users of those about to lapse, captures or cancels, according to the
+// policy, those within SettleBefore of their expiry and marks the expired
+// ones as lapsed. Holds that fail are retried on the next run.
+func (c *Client) SettleExpiringPreauthorizations(ctx context.Context, options PreauthorizationExpiryOptions) error {
+	store := c.config.PreauthorizationStore
+	if store == nil {
+		return ErrNoPreauthorizationStore
+	}
+
+	if options.Resolve != nil && options.App == nil {
+		return errors.New("innpark: PreauthorizationExpiryOptions.App is required with Resolve")
+	}
+
+	if options.Policy == "" {
+		options.Policy = PREAUTHORIZATION_POLICY_CANCEL
+	}
+	if options.Workflow == "" {
+		options.Workflow = WORKFLOW_PREAUTHORIZATION_EXPIRING
+	}
+	if options.NotifyBefore == 0 {
+		options.NotifyBefore = 24 * time.Hour
+	}
+	if options.SettleBefore == 0 {
+		options.SettleBefore = time.Hour
+	}
+
+	now := time.Now()
+	holds, err := store.Expiring(ctx, now.Add(max(options.NotifyBefore, options.SettleBefore)))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, hold := range holds {
+		if hold.Policy == "" {
+			hold.Policy = options.Policy
+		}
+
+		switch {
+		case !now.Before(hold.ExpiresAt):
+			errs = append(errs, c.lapsePreauthorization(ctx, hold))
+		case !now.Before(hold.ExpiresAt.Add(-options.SettleBefore)):
+			err := c.settlePreauthorization(ctx, hold, options)
+			if err != nil && hold.NotifiedAt.IsZero() {
+				err = errors.Join(err, c.notifyPreauthorization(ctx, hold, options.Workflow))
+			}
+			errs = append(errs, err)
+		case !now.Before(hold.ExpiresAt.Add(-options.NotifyBefore)) && hold.NotifiedAt.IsZero():
+			errs = append(errs, c.notifyPreauthorization(ctx, hold, options.Workflow))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// PreauthorizationExpiryJob returns a job running
+// SettleExpiringPreauthorizations, to be scheduled with the PocketBase cron
+// more often than SettleBefore, e.g.
+// scheduler.MustAdd("preauthorization-expiry", "*/10 * * * *", job).
+func (c *Client) PreauthorizationExpiryJob(options PreauthorizationExpiryOptions) func() {
+	return func() {
+		ctx := context.Background()
+		if err := c.SettleExpiringPreauthorizations(ctx, options); err != nil {
+			c.logger.ErrorContext(ctx, "error settling expiring preauthorizations", "error", err)
+		}
+	}
+}
+
+func (c *Client) settlePreauthorization(ctx context.Context, hold Preauthorization, options PreauthorizationExpiryOptions) error {
+	if hold.Policy == PREAUTHORIZATION_POLICY_CANCEL {
+		if err := c.CancelPreautorhization(ctx, preauthorizedPayable{hold}); err != nil {
+			return fmt.Errorf("innpark: cancelling preauthorization of payable %s: %w", hold.PayableId, err)
+		}
+		return nil
+	}
+
+	var payable Payable = preauthorizedPayable{hold}
+	if options.Resolve != nil {
+		var err error
+		if payable, err = options.Resolve(ctx, hold); err != nil {
+			return fmt.Errorf("innpark: resolving preauthorization of payable %s: %w", hold.PayableId, err)
+		}
+	}
+
+	amount, err := amountOf(payable)
+	if err != nil {
+		return fmt.Errorf("innpark: resolving preauthorization of payable %s: %w", hold.PayableId, err)
+	}
+	if amount != hold.Amount {
+		var payee Payee
+		if options.Payee != nil {
+			if payee, err = options.Payee(ctx, hold); err != nil {
+				return fmt.Errorf("innpark: resolving payee of preauthorization of payable %s: %w", hold.PayableId, err)
+			}
+		}
+		if err := c.UpdateService(ctx, options.App, payable, payee, Cents(amount)); err != nil {
+			return fmt.Errorf("innpark: updating preauthorization of payable %s: %w", hold.PayableId, err)
+		}
+	}
+	if err := c.ConfirmPreautorhization(ctx, payable); err != nil {
+		return fmt.Errorf("innpark: capturing preauthorization of payable %s: %w", hold.PayableId, err)
+	}
+	return nil
+}
+
+func (c *Client) notifyPreauthorization(ctx context.Context, hold Preauthorization, workflow string) error {
+	payload := map[string]interface{}{
+		"payable_id": hold.PayableId,
+		"amount":     hold.Amount,
+		"policy":     string(hold.Policy),
+		"expires_at": FormatDateTime(hold.ExpiresAt),
+	}
+
+	var err error
+	if hold.OrganizationId != "" {
+		err = c.TriggerWorkflowForOrganization(ctx, workflow, hold.UserId, hold.OrganizationId, payload)
+	} else {
+		err = c.TriggerWorkflow(ctx, workflow, hold.UserId, payload)
+	}
+	if err != nil {
+		return fmt.Errorf("innpark: notifying preauthorization of payable %s: %w", hold.PayableId, err)
+	}
+
+	return c.config.PreauthorizationStore.MarkNotified(ctx, hold.PayableId, time.Now())
+}
+
+// lapsePreauthorization records a hold the bank already released.
+func (c *Client) lapsePreauthorization(ctx context.Context, hold Preauthorization) error {
+	c.logger.ErrorContext(ctx, "preauthorization lapsed",
+		"payable_id", hold.PayableId,
+		"payment_id", hold.PaymentId,
+		"expires_at", hold.ExpiresAt)
+
+	err := c.RecordPaymentState(ctx, hold.PayableId, PAYMENT_STATE_CANCELLED, "PreauthorizationLapsed", hold.PaymentId, 0)
+	if err != nil && !errors.Is(err, ErrInvalidPaymentTransition) {
+		return err
+	}
+
+	return c.config.PreauthorizationStore.Close(ctx, hold.PayableId, PREAUTHORIZATION_STATUS_LAPSED)
+}
+
+// preauthorizedPayable is the Payable of a tracked hold, for the calls that
+// only need its id and amount.
+type preauthorizedPayable struct {
+	Preauthorization
+}
+
+func (p preauthorizedPayable) GetId() string                        { return p.PayableId }
+func (p preauthorizedPayable) GetAmount() int                       { return p.Amount }
+func (p preauthorizedPayable) GetUserId() string                    { return p.UserId }
+func (p preauthorizedPayable) GetMetadata(core.App) PayableMetadata { return PayableMetadata{} }
+
+type pocketBasePreauthorizationStore struct {
+	app core.App
+}
+
+// NewPocketBasePreauthorizationStore returns a PreauthorizationStore backed
+// by the PREAUTHORIZATIONS_COLLECTION, creating the collection if needed.
+func NewPocketBasePreauthorizationStore(app core.App) (PreauthorizationStore, error) {
+	err := ensureCollection(app, PREAUTHORIZATIONS_COLLECTION,
+		[]*schema.SchemaField{
+			textField("payable_id", true),
+			textField("user_id", false),
+			textField("organization_id", false),
+			textField("payment_id", false),
+			numberField("amount"),
+			textField("policy", false),
+			textField("status", true),
+			dateField("expires_at"),
+			dateField("notified_at"),
+		},
+		"CREATE UNIQUE INDEX idx_preauthorizations_payable ON "+PREAUTHORIZATIONS_COLLECTION+" (payable_id)",
+		"CREATE INDEX idx_preauthorizations_expiry ON "+PREAUTHORIZATIONS_COLLECTION+" (status, expires_at)",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pocketBasePreauthorizationStore{app: app}, nil
+}
+
+func (s *pocketBasePreauthorizationStore) Track(ctx context.Context, preauthorization Preauthorization) error {
+	dao := s.app.Dao()
+
+	record, err := dao.FindFirstRecordByData(PREAUTHORIZATIONS_COLLECTION, "payable_id", preauthorization.PayableId)
+	if errors.Is(err, sql.ErrNoRows) {
+		collection, err := dao.FindCollectionByNameOrId(PREAUTHORIZATIONS_COLLECTION)
+		if err != nil {
+			return err
+		}
+		record = models.NewRecord(collection)
+	} else if err != nil {
+		return err
+	}
+
+	record.Set("payable_id", preauthorization.PayableId)
+	record.Set("user_id", preauthorization.UserId)
+	record.Set("organization_id", preauthorization.OrganizationId)
+	record.Set("payment_id", preauthorization.PaymentId)
+	record.Set("amount", preauthorization.Amount)
+	record.Set("policy", string(preauthorization.Policy))
+	record.Set("status", string(preauthorization.Status))
+	record.Set("expires_at", FormatDateTime(preauthorization.ExpiresAt))
+	record.Set("notified_at", FormatDateTime(preauthorization.NotifiedAt))
+	return dao.SaveRecord(record)
+}
+
+func (s *pocketBasePreauthorizationStore) Close(ctx context.Context, payableId string, status PreauthorizationStatus) error {
+	record, err := s.app.Dao().FindFirstRecordByData(PREAUTHORIZATIONS_COLLECTION, "payable_id", payableId)
+	if errors.Is(err, sql.ErrNoRows) {
+		// payables paid before the store existed have no hold
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	record.Set("status", string(status))
+	return s.app.Dao().SaveRecord(record)
+}
+
+func (s *pocketBasePreauthorizationStore) MarkNotified(ctx context.Context, payableId string, at time.Time) error {
+	record, err := s.app.Dao().FindFirstRecordByData(PREAUTHORIZATIONS_COLLECTION, "payable_id", payableId)
+	if err != nil {
+		return err
+	}
+
+	record.Set("notified_at", FormatDateTime(at))
+	return s.app.Dao().SaveRecord(record)
+}
+
+func (s *pocketBasePreauthorizationStore) Expiring(ctx context.Context, before time.Time) ([]Preauthorization, error) {
+	records, err := s.app.Dao().FindRecordsByFilter(PREAUTHORIZATIONS_COLLECTION,
+		"status = {:status} && expires_at < {:before}", "expires_at", 0, 0,
+		dbx.Params{"status": string(PREAUTHORIZATION_STATUS_OPEN), "before": FormatDateTime(before)})
+	if err != nil {
+		return nil, err
+	}
+
+	holds := make([]Preauthorization, 0, len(records))
+	for _, record := range records {
+		holds = append(holds, Preauthorization{
+			Id:             record.Id,
+			PayableId:      record.GetString("payable_id"),
+			UserId:         record.GetString("user_id"),
+			OrganizationId: record.GetString("organization_id"),
+			PaymentId:      record.GetString("payment_id"),
+			Amount:         record.GetInt("amount"),
+			Policy:         PreauthorizationPolicy(record.GetString("policy")),
+			Status:         PreauthorizationStatus(record.GetString("status")),
+			ExpiresAt:      record.GetDateTime("expires_at").Time(),
+			NotifiedAt:     record.GetDateTime("notified_at").Time(),
+			Created:        record.GetDateTime("created").Time(),
+		})
+	}
+	return holds, nil
+}
@@ -0,0 +1,131 @@
+package innpark
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryPreauthorizationStore struct {
+	mu    sync.Mutex
+	holds map[string]Preauthorization
+}
+
+func (s *memoryPreauthorizationStore) Track(ctx context.Context, preauthorization Preauthorization) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holds[preauthorization.PayableId] = preauthorization
+	return nil
+}
+
+func (s *memoryPreauthorizationStore) Close(ctx context.Context, payableId string, status PreauthorizationStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hold, ok := s.holds[payableId]; ok {
+		hold.Status = status
+		s.holds[payableId] = hold
+	}
+	return nil
+}
+
+func (s *memoryPreauthorizationStore) MarkNotified(ctx context.Context, payableId string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hold := s.holds[payableId]
+	hold.NotifiedAt = at
+	s.holds[payableId] = hold
+	return nil
+}
+
+func (s *memoryPreauthorizationStore) Expiring(ctx context.Context, before time.Time) ([]Preauthorization, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var holds []Preauthorization
+	for _, hold := range s.holds {
+		if hold.Status == PREAUTHORIZATION_STATUS_OPEN && hold.ExpiresAt.Before(before) {
+			holds = append(holds, hold)
+		}
+	}
+	return holds, nil
+}
+
+func TestSettleExpiringPreauthorizationsRequiresApp(t *testing.T) {
+	store := &memoryPreauthorizationStore{holds: map[string]Preauthorization{}}
+	c := NewClient(Config{PaymentURL: "http://127.0.0.1:0", PreauthorizationStore: store})
+
+	err := c.SettleExpiringPreauthorizations(context.Background(), PreauthorizationExpiryOptions{
+		Policy: PREAUTHORIZATION_POLICY_CAPTURE,
+		Resolve: func(ctx context.Context, preauthorization Preauthorization) (Payable, error) {
+			return testPayable{id: preauthorization.PayableId, amount: 700}, nil
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "App") {
+		t.Errorf("got %v, want an error asking for App", err)
+	}
+}
+
+func TestSettleExpiringPreauthorizations(t *testing.T) {
+	var mu sync.Mutex
+	var workflows []string
+	var confirmed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/v1/notifications/trigger-for-organization":
+			var request TriggerForOrganizationRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			workflows = append(workflows, request.WorkflowName)
+		case strings.HasSuffix(r.URL.Path, "/payments/confirm"):
+			confirmed = append(confirmed, r.URL.Path)
+		}
+		w.Write([]byte(`{"Payable":{"id":"p1","last_payment_id":"pay1"}}`))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	store := &memoryPreauthorizationStore{holds: map[string]Preauthorization{
+		"notify": {
+			PayableId:      "notify",
+			UserId:         "u1",
+			OrganizationId: "o1",
+			Amount:         1000,
+			Status:         PREAUTHORIZATION_STATUS_OPEN,
+			ExpiresAt:      now.Add(12 * time.Hour),
+		},
+		"capture": {
+			PayableId:      "capture",
+			UserId:         "u1",
+			OrganizationId: "o1",
+			Amount:         1000,
+			Policy:         PREAUTHORIZATION_POLICY_CAPTURE,
+			Status:         PREAUTHORIZATION_STATUS_OPEN,
+			ExpiresAt:      now.Add(30 * time.Minute),
+			NotifiedAt:     now.Add(-time.Hour),
+		},
+	}}
+	c := NewClient(Config{PaymentURL: server.URL, PreauthorizationStore: store})
+
+	err := c.SettleExpiringPreauthorizations(context.Background(), PreauthorizationExpiryOptions{Workflow: "hold-expiring"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(workflows) != 1 || workflows[0] != "hold-expiring" {
+		t.Errorf("got workflows %v, want the configured one once", workflows)
+	}
+	if store.holds["notify"].NotifiedAt.IsZero() {
+		t.Error("notified hold not marked")
+	}
+	if len(confirmed) != 1 || !strings.Contains(confirmed[0], "/capture/") {
+		t.Errorf("got confirms %v, want the capture hold", confirmed)
+	}
+	if status := store.holds["capture"].Status; status != PREAUTHORIZATION_STATUS_CAPTURED {
+		t.Errorf("got status %s, want captured", status)
+	}
+}
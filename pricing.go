@@ -0,0 +1,345 @@
+package innpark
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidTariff   = errors.New("innpark: invalid tariff")
+	ErrInvalidStay     = errors.New("innpark: invalid stay")
+	ErrMaxStayExceeded = errors.New("innpark: maximum stay exceeded")
+)
+
+// TariffRate is how a tariff band charges the minutes it covers.
+type TariffRate string
+
+const (
+	TARIFF_RATE_PER_MINUTE TariffRate = "per-minute"
+	TARIFF_RATE_STEPPED    TariffRate = "stepped"
+)
+
+// Tariff is an onstreet parking rate, restricted to a vehicle type when
+// VehicleType is not zero; FilterByVehicleType keeps the tariffs of a
+// vehicle. Only the minutes inside one of its bands are charged; the stay
+// limits and free minutes count those minutes too. A stay charged any
+// minute is charged at least MinStayMinutes, the missing minutes at the rate
+// of the last band window it was in.
+type Tariff struct {
+	Id          string      `json:"id"`
+	Name        string      `json:"name"`
+	VehicleType VehicleType `json:"vehicle_type"`
+
+	Bands          []TariffBand     `json:"bands"`
+	MinStayMinutes int              `json:"min_stay_minutes"`
+	MaxStayMinutes int              `json:"max_stay_minutes"` // 0 is unlimited
+	FreeMinutes    int              `json:"free_minutes"`
+	Modifiers      []TariffModifier `json:"modifiers"`
+}
+
+func (t Tariff) GetVehicleType() VehicleType {
+	return t.VehicleType
+}
+
+// TariffBand is a charged time window in Madrid local time. From and To are
+// "HH:MM", a To not after From wraps past midnight and "24:00" ends the day.
+// No Weekdays means every day. When bands overlap the first one applies.
+//
+// Per minute bands charge CentsPerHour pro rata. Stepped bands charge, for
+// each day the band window opens, the first step long enough for the
+// minutes spent in that window, and past the last step its price plus
+// CentsPerHour pro rata for the rest.
+type TariffBand struct {
+	Name         string         `json:"name"`
+	Weekdays     []time.Weekday `json:"weekdays"`
+	From         string         `json:"from"`
+	To           string         `json:"to"`
+	Rate         TariffRate     `json:"rate"`
+	CentsPerHour int            `json:"cents_per_hour"`
+	Steps        []TariffStep   `json:"steps"`
+}
+
+// TariffStep is the price of a stay of up to Minutes in a stepped band.
+type TariffStep struct {
+	Minutes int `json:"minutes"`
+	Cents   int `json:"cents"`
+}
+
+// TariffModifier changes the price of the charged minutes by Percent, a
+// negative one being a discount. It applies to stays matching every field
+// set; empty fields match any stay.
+type TariffModifier struct {
+	Name                string      `json:"name"`
+	VehicleType         VehicleType `json:"vehicle_type"`
+	EnvironmentalLabels []string    `json:"environmental_labels"` // DGT labels: "0", "ECO", "C", "B"
+	Percent             int         `json:"percent"`
+}
+
+// Stay is a parking interval to be priced.
+type Stay struct {
+	From               time.Time
+	To                 time.Time
+	VehicleType        VehicleType
+	EnvironmentalLabel string
+
+	// FreeBagSeconds is what is left of the plate's free bag, see
+	// Decision.RemainingFreeBagSeconds. It is consumed in whole minutes
+	// before charging.
+	FreeBagSeconds int
+}
+
+// Price is the itemized price of a stay. Total is in cents, ready to be used
+// as the amount of the payment service; FreeBagSeconds is what to pass to
+// DecrementFreeBagSeconds.
+type Price struct {
+	Lines          []PriceLine `json:"lines"`
+	ChargedMinutes int         `json:"charged_minutes"`
+	FreeMinutes    int         `json:"free_minutes"`
+	FreeBagSeconds int         `json:"free_bag_seconds"`
+	Total          int         `json:"total"`
+}
+
+// PriceLine is one item of a Price, in cents.
+type PriceLine struct {
+	Description string `json:"description"`
+	Minutes     int    `json:"minutes,omitempty"`
+	Cents       int    `json:"cents"`
+}
+
+// Price computes what the stay costs under the tariff. Stays are counted in
+// started minutes, so daylight saving changes are charged by the time that
+// actually elapsed.
+func (t Tariff) Price(stay Stay) (Price, error) {
+	if !stay.To.After(stay.From) {
+		return Price{}, fmt.Errorf("%w: it must end after it starts", ErrInvalidStay)
+	}
+
+	bands, err := t.parseBands()
+	if err != nil {
+		return Price{}, err
+	}
+
+	// the band window every started minute of the stay falls in, a band
+	// of -1 when none
+	total := int((stay.To.Sub(stay.From) + time.Minute - 1) / time.Minute)
+	minuteWindows := make([]bandWindow, 0, max(total, t.MinStayMinutes))
+	regulated := 0
+	last := bandWindow{band: -1}
+	for m := 0; m < total; m++ {
+		window := bandAt(bands, stay.From.Add(time.Duration(m)*time.Minute))
+		minuteWindows = append(minuteWindows, window)
+		if window.band >= 0 {
+			regulated++
+			last = window
+		}
+	}
+	if t.MaxStayMinutes > 0 && regulated > t.MaxStayMinutes {
+		return Price{}, fmt.Errorf("%w: %d minutes over %d", ErrMaxStayExceeded, regulated, t.MaxStayMinutes)
+	}
+
+	// stays without charged minutes owe no minimum; the others are topped
+	// up in the window they were last charged in, whatever comes after
+	for ; last.band >= 0 && regulated < t.MinStayMinutes; regulated++ {
+		minuteWindows = append(minuteWindows, last)
+	}
+
+	price := Price{}
+
+	// free minutes and then the free bag cover the first charged minutes
+	freeMinutes := min(t.FreeMinutes, regulated)
+	freeBagMinutes := min(max(stay.FreeBagSeconds, 0)/60, regulated-freeMinutes)
+	covered := freeMinutes + freeBagMinutes
+
+	// stepped bands price each window on its own, so the minutes charged
+	// are counted per window and not per band
+	var windows []bandWindow
+	windowMinutes := map[bandWindow]int{}
+	for _, window := range minuteWindows {
+		if window.band < 0 {
+			continue
+		}
+		if covered > 0 {
+			covered--
+			continue
+		}
+		if windowMinutes[window] == 0 {
+			windows = append(windows, window)
+		}
+		windowMinutes[window]++
+	}
+
+	bandMinutes := make([]int, len(bands))
+	bandCents := make([]int, len(bands))
+	for _, window := range windows {
+		bandMinutes[window.band] += windowMinutes[window]
+		bandCents[window.band] += bands[window.band].cents(windowMinutes[window])
+	}
+
+	if freeMinutes > 0 {
+		price.Lines = append(price.Lines, PriceLine{Description: "free minutes", Minutes: freeMinutes})
+	}
+	if freeBagMinutes > 0 {
+		price.Lines = append(price.Lines, PriceLine{Description: "free bag", Minutes: freeBagMinutes})
+	}
+
+	subtotal := 0
+	for i, minutes := range bandMinutes {
+		if minutes == 0 {
+			continue
+		}
+		cents := bandCents[i]
+		subtotal += cents
+		price.ChargedMinutes += minutes
+		price.Lines = append(price.Lines, PriceLine{Description: bands[i].description(i), Minutes: minutes, Cents: cents})
+	}
+
+	total = subtotal
+	for _, modifier := range t.Modifiers {
+		if !modifier.appliesTo(stay) {
+			continue
+		}
+		cents := roundDiv(subtotal*modifier.Percent, 100)
+		total += cents
+		price.Lines = append(price.Lines, PriceLine{Description: modifier.description(), Cents: cents})
+	}
+
+	price.FreeMinutes = freeMinutes
+	price.FreeBagSeconds = freeBagMinutes * 60
+	price.Total = max(total, 0)
+	return price, nil
+}
+
+// parsedBand is a TariffBand with its window in minutes of the day.
+type parsedBand struct {
+	TariffBand
+	from int
+	to   int
+}
+
+func (t Tariff) parseBands() ([]parsedBand, error) {
+	bands := make([]parsedBand, 0, len(t.Bands))
+	for i, band := range t.Bands {
+		from, err := parseClock(band.From)
+		if err != nil {
+			return nil, fmt.Errorf("%w: band %d: %w", ErrInvalidTariff, i, err)
+		}
+		to, err := parseClock(band.To)
+		if err != nil {
+			return nil, fmt.Errorf("%w: band %d: %w", ErrInvalidTariff, i, err)
+		}
+
+		switch band.Rate {
+		case TARIFF_RATE_PER_MINUTE, "":
+		case TARIFF_RATE_STEPPED:
+			if len(band.Steps) == 0 {
+				return nil, fmt.Errorf("%w: band %d: stepped without steps", ErrInvalidTariff, i)
+			}
+			if !slices.IsSortedFunc(band.Steps, func(a, b TariffStep) int { return a.Minutes - b.Minutes }) {
+				return nil, fmt.Errorf("%w: band %d: steps out of order", ErrInvalidTariff, i)
+			}
+		default:
+			return nil, fmt.Errorf("%w: band %d: unknown rate %q", ErrInvalidTariff, i, band.Rate)
+		}
+
+		bands = append(bands, parsedBand{band, from, to})
+	}
+	return bands, nil
+}
+
+// parseClock parses "HH:MM" into minutes of the day, "24:00" included.
+func parseClock(clock string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil ||
+		hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return hours*60 + minutes, nil
+}
+
+// bandWindow is a daily window of a band: the band index and the local
+// day, as days since the Unix epoch, the window opened.
+type bandWindow struct {
+	band int
+	day  int
+}
+
+// bandAt returns the window covering t, with a band of -1 when none does.
+func bandAt(bands []parsedBand, t time.Time) bandWindow {
+	local := t.In(Madrid)
+	minute := local.Hour()*60 + local.Minute()
+	day := int(time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400)
+	for i, band := range bands {
+		if opened, ok := band.covers(local.Weekday(), minute); ok {
+			return bandWindow{band: i, day: day - opened}
+		}
+	}
+	return bandWindow{band: -1}
+}
+
+// covers reports whether the band covers the minute of the weekday, and
+// how many days before the window covering it opened.
+func (b parsedBand) covers(weekday time.Weekday, minute int) (int, bool) {
+	if b.from < b.to {
+		return 0, (len(b.Weekdays) == 0 || slices.Contains(b.Weekdays, weekday)) && minute >= b.from && minute < b.to
+	}
+	// past midnight the minute belongs to the window opened the day before
+	opened := 0
+	if minute < b.to {
+		weekday = (weekday + 6) % 7
+		opened = 1
+	} else if minute < b.from {
+		return 0, false
+	}
+	return opened, len(b.Weekdays) == 0 || slices.Contains(b.Weekdays, weekday)
+}
+
+func (b parsedBand) cents(minutes int) int {
+	if b.Rate != TARIFF_RATE_STEPPED {
+		return roundDiv(minutes*b.CentsPerHour, 60)
+	}
+
+	for _, step := range b.Steps {
+		if minutes <= step.Minutes {
+			return step.Cents
+		}
+	}
+	last := b.Steps[len(b.Steps)-1]
+	return last.Cents + roundDiv((minutes-last.Minutes)*b.CentsPerHour, 60)
+}
+
+func (b parsedBand) description(i int) string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return fmt.Sprintf("band %d", i+1)
+}
+
+func (m TariffModifier) appliesTo(stay Stay) bool {
+	if m.VehicleType != "" && m.VehicleType != stay.VehicleType {
+		return false
+	}
+	if len(m.EnvironmentalLabels) > 0 && !slices.ContainsFunc(m.EnvironmentalLabels, func(label string) bool {
+		return strings.EqualFold(label, stay.EnvironmentalLabel)
+	}) {
+		return false
+	}
+	return true
+}
+
+func (m TariffModifier) description() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return fmt.Sprintf("%+d%%", m.Percent)
+}
+
+// roundDiv divides rounding half away from zero.
+func roundDiv(n int, d int) int {
+	if (n < 0) != (d < 0) {
+		return (n - d/2) / d
+	}
+	return (n + d/2) / d
+}
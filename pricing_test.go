@@ -0,0 +1,104 @@
+package innpark
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// monday is a Monday in Madrid local time.
+func monday(hour int, minute int) time.Time {
+	return time.Date(2024, 1, 15, hour, minute, 0, 0, Madrid)
+}
+
+func TestTariffPrice(t *testing.T) {
+	workdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}
+	regulated := Tariff{Bands: []TariffBand{
+		{Weekdays: workdays, From: "09:00", To: "14:00", CentsPerHour: 120},
+		{Weekdays: workdays, From: "16:00", To: "20:00", CentsPerHour: 120},
+	}}
+	night := Tariff{Bands: []TariffBand{
+		{Weekdays: []time.Weekday{time.Friday}, From: "22:00", To: "02:00", CentsPerHour: 60},
+	}}
+	steps := []TariffStep{{Minutes: 60, Cents: 100}, {Minutes: 240, Cents: 300}}
+	steppedDaily := Tariff{Bands: []TariffBand{
+		{From: "00:00", To: "24:00", Rate: TARIFF_RATE_STEPPED, Steps: steps, CentsPerHour: 100},
+	}}
+	steppedMorning := Tariff{Bands: []TariffBand{
+		{From: "09:00", To: "14:00", Rate: TARIFF_RATE_STEPPED, Steps: steps, CentsPerHour: 100},
+	}}
+	allDay := Tariff{Bands: []TariffBand{{From: "00:00", To: "24:00", CentsPerHour: 60}}}
+
+	tests := []struct {
+		name    string
+		tariff  Tariff
+		stay    Stay
+		minutes int
+		total   int
+	}{
+		{name: "inside a band", tariff: regulated, stay: Stay{From: monday(10, 0), To: monday(11, 0)}, minutes: 60, total: 120},
+		{name: "started minutes", tariff: regulated, stay: Stay{From: monday(10, 0), To: monday(10, 0).Add(61 * time.Second)}, minutes: 2, total: 4},
+		{name: "across a band start", tariff: regulated, stay: Stay{From: monday(8, 50), To: monday(9, 10)}, minutes: 10, total: 20},
+		{name: "across a band end", tariff: regulated, stay: Stay{From: monday(13, 30), To: monday(14, 30)}, minutes: 30, total: 60},
+		{name: "ending at a band end", tariff: regulated, stay: Stay{From: monday(13, 0), To: monday(14, 0)}, minutes: 60, total: 120},
+		{name: "between bands", tariff: regulated, stay: Stay{From: monday(14, 0), To: monday(16, 0)}, minutes: 0, total: 0},
+		{name: "outside the weekdays", tariff: regulated, stay: Stay{From: monday(10, 0).AddDate(0, 0, 6), To: monday(12, 0).AddDate(0, 0, 6)}, minutes: 0, total: 0},
+		{name: "multi-day", tariff: regulated, stay: Stay{From: monday(13, 0), To: monday(10, 0).AddDate(0, 0, 1)}, minutes: 360, total: 720},
+		{name: "past midnight", tariff: night, stay: Stay{From: monday(23, 0).AddDate(0, 0, 4), To: monday(1, 0).AddDate(0, 0, 5)}, minutes: 120, total: 120},
+		{name: "past midnight of a window opened on another weekday", tariff: night, stay: Stay{From: monday(23, 0).AddDate(0, 0, 5), To: monday(1, 0).AddDate(0, 0, 6)}, minutes: 0, total: 0},
+		{name: "stepped", tariff: steppedDaily, stay: Stay{From: monday(10, 0), To: monday(11, 30)}, minutes: 90, total: 300},
+		{name: "stepped past the last step", tariff: steppedDaily, stay: Stay{From: monday(0, 0), To: monday(5, 0)}, minutes: 300, total: 400},
+		{name: "stepped across midnight", tariff: steppedDaily, stay: Stay{From: monday(23, 0), To: monday(1, 0).AddDate(0, 0, 1)}, minutes: 120, total: 200},
+		{name: "stepped across days", tariff: steppedMorning, stay: Stay{From: monday(13, 0), To: monday(10, 0).AddDate(0, 0, 1)}, minutes: 120, total: 200},
+		{name: "free minutes", tariff: Tariff{Bands: regulated.Bands, FreeMinutes: 15}, stay: Stay{From: monday(10, 0), To: monday(11, 0)}, minutes: 45, total: 90},
+		{name: "free bag", tariff: regulated, stay: Stay{From: monday(10, 0), To: monday(11, 0), FreeBagSeconds: 659}, minutes: 50, total: 100},
+		{name: "minimum stay", tariff: Tariff{Bands: regulated.Bands, MinStayMinutes: 30}, stay: Stay{From: monday(10, 0), To: monday(10, 10)}, minutes: 30, total: 60},
+		{name: "minimum stay past the band end", tariff: Tariff{Bands: regulated.Bands, MinStayMinutes: 30}, stay: Stay{From: monday(13, 50), To: monday(14, 0)}, minutes: 30, total: 60},
+		{name: "minimum stay ending outside the bands", tariff: Tariff{Bands: regulated.Bands, MinStayMinutes: 30}, stay: Stay{From: monday(13, 55), To: monday(14, 30)}, minutes: 30, total: 60},
+		{name: "minimum stay without charged minutes", tariff: Tariff{Bands: []TariffBand{{Weekdays: []time.Weekday{time.Monday}, From: "09:00", To: "14:00", CentsPerHour: 120}}, MinStayMinutes: 30}, stay: Stay{From: monday(10, 0).AddDate(0, 0, -1), To: monday(10, 10).AddDate(0, 0, -1)}, minutes: 0, total: 0},
+		{name: "minimum stay stepped", tariff: Tariff{Bands: steppedMorning.Bands, MinStayMinutes: 90}, stay: Stay{From: monday(13, 30), To: monday(14, 30)}, minutes: 90, total: 300},
+		{name: "modifier", tariff: Tariff{Bands: regulated.Bands, Modifiers: []TariffModifier{{EnvironmentalLabels: []string{"ECO"}, Percent: -50}}}, stay: Stay{From: monday(10, 0), To: monday(11, 0), EnvironmentalLabel: "eco"}, minutes: 60, total: 60},
+		{name: "modifier not matching", tariff: Tariff{Bands: regulated.Bands, Modifiers: []TariffModifier{{EnvironmentalLabels: []string{"ECO"}, Percent: -50}}}, stay: Stay{From: monday(10, 0), To: monday(11, 0), EnvironmentalLabel: "B"}, minutes: 60, total: 120},
+		{name: "daylight saving change", tariff: allDay, stay: Stay{From: time.Date(2024, 3, 31, 1, 30, 0, 0, Madrid), To: time.Date(2024, 3, 31, 3, 30, 0, 0, Madrid)}, minutes: 60, total: 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, err := tt.tariff.Price(tt.stay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if price.ChargedMinutes != tt.minutes {
+				t.Errorf("got %d charged minutes, want %d", price.ChargedMinutes, tt.minutes)
+			}
+			if price.Total != tt.total {
+				t.Errorf("got a total of %d, want %d", price.Total, tt.total)
+			}
+		})
+	}
+}
+
+func TestTariffPriceErrors(t *testing.T) {
+	bands := []TariffBand{{From: "09:00", To: "14:00", CentsPerHour: 120}}
+
+	tests := []struct {
+		name   string
+		tariff Tariff
+		stay   Stay
+		want   error
+	}{
+		{name: "empty stay", tariff: Tariff{Bands: bands}, stay: Stay{From: monday(10, 0), To: monday(10, 0)}, want: ErrInvalidStay},
+		{name: "maximum stay", tariff: Tariff{Bands: bands, MaxStayMinutes: 120}, stay: Stay{From: monday(9, 0), To: monday(12, 0)}, want: ErrMaxStayExceeded},
+		{name: "invalid time", tariff: Tariff{Bands: []TariffBand{{From: "09:00", To: "25:00"}}}, stay: Stay{From: monday(9, 0), To: monday(10, 0)}, want: ErrInvalidTariff},
+		{name: "stepped without steps", tariff: Tariff{Bands: []TariffBand{{From: "09:00", To: "14:00", Rate: TARIFF_RATE_STEPPED}}}, stay: Stay{From: monday(9, 0), To: monday(10, 0)}, want: ErrInvalidTariff},
+		{name: "unknown rate", tariff: Tariff{Bands: []TariffBand{{From: "09:00", To: "14:00", Rate: "daily"}}}, stay: Stay{From: monday(9, 0), To: monday(10, 0)}, want: ErrInvalidTariff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.tariff.Price(tt.stay); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package innpark
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidFilter is returned when a filter value cannot be expressed in
+// the PocketBase filter syntax.
+var ErrInvalidFilter = errors.New("innpark: invalid filter")
+
+// Filter is a PocketBase filter expression for the upstream
+// /collections/<name>/records endpoints. Build it with Eq, Like, And, Or and
+// the other helpers, which quote and escape values; field names are taken
+// as is and must come from the library, never from user input.
+//
+// The zero Filter matches every record.
+type Filter struct {
+	expr string
+	err  error
+}
+
+// String returns the filter expression.
+func (f Filter) String() string {
+	return f.expr
+}
+
+// Err returns the error of the first value that could not be escaped.
+func (f Filter) Err() error {
+	return f.err
+}
+
+// IsZero reports whether the filter is empty.
+func (f Filter) IsZero() bool {
+	return f.expr == "" && f.err == nil
+}
+
+func Eq(field string, value any) Filter      { return compare(field, "=", value) }
+func NotEq(field string, value any) Filter   { return compare(field, "!=", value) }
+func Gt(field string, value any) Filter      { return compare(field, ">", value) }
+func Gte(field string, value any) Filter     { return compare(field, ">=", value) }
+func Lt(field string, value any) Filter      { return compare(field, "<", value) }
+func Lte(field string, value any) Filter     { return compare(field, "<=", value) }
+func Like(field string, value any) Filter    { return compare(field, "~", value) }
+func NotLike(field string, value any) Filter { return compare(field, "!~", value) }
+
+// In matches records whose field equals any of the values. No values match
+// nothing.
+func In[T any](field string, values ...T) Filter {
+	if len(values) == 0 {
+		return Filter{expr: "1=0"}
+	}
+	filters := make([]Filter, 0, len(values))
+	for _, value := range values {
+		filters = append(filters, Eq(field, value))
+	}
+	return Or(filters...)
+}
+
+// And matches records matching every filter. Zero filters are skipped.
+func And(filters ...Filter) Filter {
+	return join(" && ", filters)
+}
+
+// Or matches records matching any of the filters. Zero filters are skipped.
+func Or(filters ...Filter) Filter {
+	return join(" || ", filters)
+}
+
+func compare(field string, operator string, value any) Filter {
+	literal, err := filterLiteral(value)
+	if err != nil {
+		return Filter{err: fmt.Errorf("%w: %s: %w", ErrInvalidFilter, field, err)}
+	}
+	return Filter{expr: field + operator + literal}
+}
+
+func join(separator string, filters []Filter) Filter {
+	var exprs []string
+	for _, f := range filters {
+		if f.err != nil {
+			return f
+		}
+		if f.expr != "" {
+			exprs = append(exprs, f.expr)
+		}
+	}
+
+	switch len(exprs) {
+	case 0:
+		return Filter{}
+	case 1:
+		return Filter{expr: exprs[0]}
+	}
+	return Filter{expr: "(" + strings.Join(exprs, separator) + ")"}
+}
+
+// filterLiteral formats a value as a PocketBase filter literal.
+func filterLiteral(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return quoteFilterText(FormatDateTime(v))
+	case DateTime:
+		return quoteFilterText(v.String())
+	case fmt.Stringer:
+		return quoteFilterText(v.String())
+	case string:
+		return quoteFilterText(v)
+	}
+	return quoteFilterText(fmt.Sprint(value))
+}
+
+// quoteFilterText single quotes text, escaping the quotes in it. The filter
+// syntax has no escape for a backslash, so one right before the closing
+// quote would escape it and is rejected instead.
+func quoteFilterText(text string) (string, error) {
+	if strings.HasSuffix(text, `\`) {
+		return "", fmt.Errorf("value %q ends with a backslash", text)
+	}
+	return "'" + strings.ReplaceAll(text, "'", `\'`) + "'", nil
+}
+
+// Query describes a read of an upstream /collections/<name>/records
+// endpoint. It is immutable, every method returns a modified copy.
+type Query struct {
+	filter    Filter
+	sort      []string
+	fields    []string
+	expand    []string
+	page      int
+	perPage   int
+	skipTotal bool
+}
+
+func NewQuery() Query {
+	return Query{}
+}
+
+// Where ANDs the filter with the ones already set.
+func (q Query) Where(filter Filter) Query {
+	q.filter = And(q.filter, filter)
+	return q
+}
+
+// Sort orders by the fields, a leading "-" sorts descending.
+func (q Query) Sort(fields ...string) Query {
+	q.sort = append(slices.Clip(q.sort), fields...)
+	return q
+}
+
+// Fields limits the returned fields.
+func (q Query) Fields(fields ...string) Query {
+	q.fields = append(slices.Clip(q.fields), fields...)
+	return q
+}
+
+// Expand expands the relation fields.
+func (q Query) Expand(relations ...string) Query {
+	q.expand = append(slices.Clip(q.expand), relations...)
+	return q
+}
+
+func (q Query) Page(page int) Query {
+	q.page = page
+	return q
+}
+
+func (q Query) PerPage(perPage int) Query {
+	q.perPage = perPage
+	return q
+}
+
+// SkipTotal skips counting the records, TotalItems and TotalPages are then
+// reported as -1.
+func (q Query) SkipTotal() Query {
+	q.skipTotal = true
+	return q
+}
+
+// Values returns the query parameters of the read.
+func (q Query) Values() (url.Values, error) {
+	if err := q.filter.Err(); err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	if q.filter.expr != "" {
+		values.Set("filter", q.filter.expr)
+	}
+	if len(q.sort) > 0 {
+		values.Set("sort", strings.Join(q.sort, ","))
+	}
+	if len(q.fields) > 0 {
+		values.Set("fields", strings.Join(q.fields, ","))
+	}
+	if len(q.expand) > 0 {
+		values.Set("expand", strings.Join(q.expand, ","))
+	}
+	if q.page > 0 {
+		values.Set("page", strconv.Itoa(q.page))
+	}
+	if q.perPage > 0 {
+		values.Set("perPage", strconv.Itoa(q.perPage))
+	}
+	if q.skipTotal {
+		values.Set("skipTotal", "1")
+	}
+	return values, nil
+}
+
+// Encode returns the URL encoded query string, without the leading "?".
+func (q Query) Encode() (string, error) {
+	values, err := q.Values()
+	if err != nil {
+		return "", err
+	}
+	return values.Encode(), nil
+}
+
+// RecordsPage is a page of an upstream /collections/<name>/records response.
+type RecordsPage[T any] struct {
+	Items      []T `json:"items"`
+	Page       int `json:"page"`
+	PerPage    int `json:"perPage"`
+	TotalItems int `json:"totalItems"`
+	TotalPages int `json:"totalPages"`
+}
+
+// recordsURL returns the URL of a collection read on the backend.
+func (c *Client) recordsURL(service Backend, collection string, query Query) (string, error) {
+	baseURL, err := c.collectionURL(service, collection)
+	if err != nil {
+		return "", err
+	}
+
+	rawQuery, err := query.Encode()
+	if err != nil {
+		return "", err
+	}
+
+	u := baseURL + "/records"
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	return u, nil
+}
+
+// recordURL returns the URL of a single record of a collection on the
+// backend.
+func (c *Client) recordURL(service Backend, collection string, id string) (string, error) {
+	baseURL, err := c.collectionURL(service, collection)
+	if err != nil {
+		return "", err
+	}
+	return baseURL + "/records/" + url.PathEscape(id), nil
+}
+
+func (c *Client) collectionURL(service Backend, collection string) (string, error) {
+	var baseURL string
+	switch service {
+	case BACKEND_ONSTREET:
+		baseURL = c.config.OnstreetURL
+	case BACKEND_OFFSTREET:
+		baseURL = c.config.OffstreetURL
+	default:
+		return "", fmt.Errorf("innpark: %s has no collections", service)
+	}
+	return fmt.Sprintf("%s/collections/%s", baseURL, url.PathEscape(collection)), nil
+}
@@ -0,0 +1,122 @@
+package innpark
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{name: "string", filter: Eq("plate", "1234ABC"), want: `plate='1234ABC'`},
+		{name: "quote", filter: Eq("name", "O'Brien"), want: `name='O\'Brien'`},
+		{name: "injection", filter: Eq("plate", "x' || id!='"), want: `plate='x\' || id!=\''`},
+		{name: "double quote", filter: Eq("name", `say "hi"`), want: `name='say "hi"'`},
+		{name: "inner backslash", filter: Like("name", `a\b`), want: `name~'a\b'`},
+		{name: "int", filter: Gt("amount", 100), want: `amount>100`},
+		{name: "float", filter: Lte("amount", 1.5), want: `amount<=1.5`},
+		{name: "bool", filter: NotEq("active", true), want: `active!=true`},
+		{name: "nil", filter: Eq("deleted", nil), want: `deleted=null`},
+		{name: "time", filter: Gte("created", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)), want: `created>='` + FormatDateTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) + `'`},
+		{name: "and", filter: And(Eq("a", 1), Filter{}, Eq("b", "x")), want: `(a=1 && b='x')`},
+		{name: "single and", filter: And(Filter{}, Eq("a", 1)), want: `a=1`},
+		{name: "nested", filter: Or(Eq("a", 1), And(Eq("b", 2), Eq("c", 3))), want: `(a=1 || (b=2 && c=3))`},
+		{name: "in", filter: In("id", "x", "y"), want: `(id='x' || id='y')`},
+		{name: "empty in", filter: In[string]("id"), want: `1=0`},
+		{name: "zero", filter: And(), want: ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filter.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.filter.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterTrailingBackslash(t *testing.T) {
+	filter := And(Eq("a", 1), Eq("name", `x\`))
+	if !errors.Is(filter.Err(), ErrInvalidFilter) {
+		t.Fatalf("got %v, want ErrInvalidFilter", filter.Err())
+	}
+	if _, err := NewQuery().Where(filter).Encode(); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("encoding: got %v, want ErrInvalidFilter", err)
+	}
+}
+
+func TestQueryEncode(t *testing.T) {
+	query := NewQuery().
+		Where(Eq("plate", "12&34=AB+C")).
+		Where(Like("name", "50% off")).
+		Sort("-created", "id").
+		Fields("id", "plate").
+		Expand("vehicle").
+		Page(2).
+		PerPage(50).
+		SkipTotal()
+
+	raw, err := query.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"filter":    `(plate='12&34=AB+C' && name~'50% off')`,
+		"sort":      "-created,id",
+		"fields":    "id,plate",
+		"expand":    "vehicle",
+		"page":      "2",
+		"perPage":   "50",
+		"skipTotal": "1",
+	}
+	for key, value := range want {
+		if got := values.Get(key); got != value {
+			t.Errorf("%s: got %q, want %q", key, got, value)
+		}
+	}
+	if len(values) != len(want) {
+		t.Errorf("got %d parameters, want %d", len(values), len(want))
+	}
+}
+
+func TestQueryImmutable(t *testing.T) {
+	base := NewQuery().Sort("a")
+	first := base.Sort("b")
+	second := base.Sort("c")
+
+	if raw, _ := first.Encode(); raw != "sort=a%2Cb" {
+		t.Errorf("first: got %s", raw)
+	}
+	if raw, _ := second.Encode(); raw != "sort=a%2Cc" {
+		t.Errorf("second: got %s", raw)
+	}
+}
+
+func TestRecordURL(t *testing.T) {
+	c := NewClient(Config{OnstreetURL: "https://onstreet.test"})
+
+	got, err := c.recordURL(BACKEND_ONSTREET, "vehicles", "a/b?c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://onstreet.test/collections/vehicles/records/a%2Fb%3Fc"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := c.recordURL(BACKEND_PAYMENT, "vehicles", "x"); err == nil {
+		t.Error("got no error for a backend without collections")
+	}
+}
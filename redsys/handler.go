@@ -0,0 +1,34 @@
+package redsys
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// Handler returns an echo.HandlerFunc for the url_notification of a
+// redirect payment. It verifies the posted notification with the base64
+// merchant secret and hands it to callback, whether the payment was
+// approved or not; see Notification.Outcome. Notifications failing
+// verification are answered with a 400 and never reach callback.
+//
+//	e.Router.POST("/redsys/notification", redsys.Handler(secret, onNotification))
+func Handler(secret string, callback func(e echo.Context, notification Notification) error) echo.HandlerFunc {
+	return func(e echo.Context) error {
+		if version := e.FormValue("Ds_SignatureVersion"); version != "" && version != SIGNATURE_VERSION {
+			return apis.NewBadRequestError("unsupported signature version", nil)
+		}
+
+		notification, err := Verify(secret, e.FormValue("Ds_MerchantParameters"), e.FormValue("Ds_Signature"))
+		if err != nil {
+			return apis.NewBadRequestError("invalid notification", err)
+		}
+
+		if err := callback(e, notification); err != nil {
+			return err
+		}
+
+		return e.String(http.StatusOK, "OK")
+	}
+}
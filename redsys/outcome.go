@@ -0,0 +1,38 @@
+package redsys
+
+// Outcome classifies a Ds_Response code.
+type Outcome string
+
+const (
+	OUTCOME_AUTHORIZED     Outcome = "authorized"     // 0000 to 0099
+	OUTCOME_CONFIRMED      Outcome = "confirmed"      // 0900, refunds and preauthorization confirmations
+	OUTCOME_CANCELLED      Outcome = "cancelled"      // 0400, cancellations
+	OUTCOME_DENIED         Outcome = "denied"         // refused by the card issuer
+	OUTCOME_FRAUD          Outcome = "fraud"          // refused as suspected fraud
+	OUTCOME_USER_CANCELLED Outcome = "user-cancelled" // 9915, the cardholder left the payment
+	OUTCOME_ERROR          Outcome = "error"          // merchant, configuration or system errors
+)
+
+// Approved reports whether the operation went through.
+func (o Outcome) Approved() bool {
+	return o == OUTCOME_AUTHORIZED || o == OUTCOME_CONFIRMED || o == OUTCOME_CANCELLED
+}
+
+// OutcomeOf classifies a Ds_Response code.
+func OutcomeOf(response int) Outcome {
+	switch {
+	case response >= 0 && response <= 99:
+		return OUTCOME_AUTHORIZED
+	case response == 900:
+		return OUTCOME_CONFIRMED
+	case response == 400:
+		return OUTCOME_CANCELLED
+	case response == 9915:
+		return OUTCOME_USER_CANCELLED
+	case response == 102 || response == 202 || response == 208 || response == 209 || response == 290:
+		return OUTCOME_FRAUD
+	case response >= 100 && response < 300:
+		return OUTCOME_DENIED
+	}
+	return OUTCOME_ERROR
+}
@@ -0,0 +1,220 @@
+// Package redsys verifies the notifications Redsys posts to the
+// url_notification of a redirect payment.
+//
+// Redsys signs the base64 Ds_MerchantParameters with HMAC-SHA256, keyed
+// with the order number encrypted under the merchant secret with 3DES.
+package redsys
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	innpark "github.com/studiogenesisprojects/lib-innpark"
+)
+
+const SIGNATURE_VERSION = "HMAC_SHA256_V1"
+
+var (
+	ErrInvalidSignature  = errors.New("redsys: invalid signature")
+	ErrInvalidParameters = errors.New("redsys: invalid merchant parameters")
+	ErrInvalidSecret     = errors.New("redsys: invalid merchant secret")
+)
+
+// Notification is a verified Redsys notification.
+type Notification struct {
+	Order             string
+	Amount            int // minor units
+	Currency          string
+	Response          int
+	Outcome           Outcome
+	AuthorisationCode string
+	TransactionType   string
+	MerchantCode      string
+	Terminal          string
+	MerchantData      string
+	SecurePayment     bool
+	CardCountry       string
+	CardBrand         string
+	ErrorCode         string
+	Date              time.Time
+
+	// Parameters holds every decoded parameter, percent unescaped.
+	Parameters map[string]string
+}
+
+// DecodeParameters decodes a Ds_MerchantParameters value, in either base64
+// alphabet, into its percent unescaped parameters. A '+' is kept as is,
+// Redsys percent encodes spaces.
+func DecodeParameters(merchantParameters string) (map[string]string, error) {
+	raw, err := decodeBase64(merchantParameters)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidParameters, err)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidParameters, err)
+	}
+
+	parameters := make(map[string]string, len(decoded))
+	for key, value := range decoded {
+		s := fmt.Sprint(value)
+		if value == nil {
+			s = ""
+		}
+		if unescaped, err := url.PathUnescape(s); err == nil {
+			s = unescaped
+		}
+		parameters[key] = s
+	}
+	return parameters, nil
+}
+
+// EncodeParameters encodes parameters as a Ds_MerchantParameters value.
+func EncodeParameters(parameters map[string]string) (string, error) {
+	raw, err := json.Marshal(parameters)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Sign returns the Ds_Signature of merchantParameters for the order, in
+// the url safe base64 alphabet Redsys notifications use. secret is the
+// base64 merchant secret.
+func Sign(secret string, order string, merchantParameters string) (string, error) {
+	key, err := orderKey(secret, order)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(merchantParameters))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verify checks the signature of a notification and decodes it.
+func Verify(secret string, merchantParameters string, signature string) (Notification, error) {
+	parameters, err := DecodeParameters(merchantParameters)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	order := parameter(parameters, "Ds_Order")
+	if order == "" {
+		return Notification{}, fmt.Errorf("%w: missing Ds_Order", ErrInvalidParameters)
+	}
+
+	expected, err := Sign(secret, order, merchantParameters)
+	if err != nil {
+		return Notification{}, err
+	}
+	given, err := decodeBase64(signature)
+	if err != nil {
+		return Notification{}, ErrInvalidSignature
+	}
+	want, _ := base64.URLEncoding.DecodeString(expected)
+	if !hmac.Equal(given, want) {
+		return Notification{}, ErrInvalidSignature
+	}
+
+	return newNotification(parameters)
+}
+
+func newNotification(parameters map[string]string) (Notification, error) {
+	n := Notification{
+		Order:             parameter(parameters, "Ds_Order"),
+		Currency:          parameter(parameters, "Ds_Currency"),
+		AuthorisationCode: strings.TrimSpace(parameter(parameters, "Ds_AuthorisationCode")),
+		TransactionType:   parameter(parameters, "Ds_TransactionType"),
+		MerchantCode:      parameter(parameters, "Ds_MerchantCode"),
+		Terminal:          parameter(parameters, "Ds_Terminal"),
+		MerchantData:      parameter(parameters, "Ds_MerchantData"),
+		SecurePayment:     parameter(parameters, "Ds_SecurePayment") == "1",
+		CardCountry:       parameter(parameters, "Ds_Card_Country"),
+		CardBrand:         parameter(parameters, "Ds_Card_Brand"),
+		ErrorCode:         parameter(parameters, "Ds_ErrorCode"),
+		Parameters:        parameters,
+	}
+
+	response, err := strconv.Atoi(strings.TrimSpace(parameter(parameters, "Ds_Response")))
+	if err != nil {
+		return Notification{}, fmt.Errorf("%w: Ds_Response: %w", ErrInvalidParameters, err)
+	}
+	n.Response = response
+	n.Outcome = OutcomeOf(response)
+
+	if amount := parameter(parameters, "Ds_Amount"); amount != "" {
+		if n.Amount, err = strconv.Atoi(amount); err != nil {
+			return Notification{}, fmt.Errorf("%w: Ds_Amount: %w", ErrInvalidParameters, err)
+		}
+	}
+
+	if date := parameter(parameters, "Ds_Date"); date != "" {
+		layout, value := "02/01/2006", date
+		if hour := parameter(parameters, "Ds_Hour"); hour != "" {
+			layout, value = "02/01/2006 15:04", date+" "+hour
+		}
+		// Redsys reports Ds_Date and Ds_Hour in Madrid local time
+		if t, err := time.ParseInLocation(layout, value, innpark.Madrid); err == nil {
+			n.Date = t
+		}
+	}
+
+	return n, nil
+}
+
+// parameter looks a parameter up case insensitively, Redsys is not
+// consistent about the case of the Ds_ prefix.
+func parameter(parameters map[string]string, key string) string {
+	if value, ok := parameters[key]; ok {
+		return value
+	}
+	for k, value := range parameters {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+// orderKey diversifies the merchant secret for the order: the order, zero
+// padded to the block size, encrypted with 3DES-CBC and a zero IV.
+func orderKey(secret string, order string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSecret, err)
+	}
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSecret, err)
+	}
+
+	plaintext := []byte(order)
+	if rem := len(plaintext) % des.BlockSize; rem != 0 || len(plaintext) == 0 {
+		plaintext = append(plaintext, bytes.Repeat([]byte{0}, des.BlockSize-rem)...)
+	}
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, make([]byte, des.BlockSize)).CryptBlocks(ciphertext, plaintext)
+	return ciphertext, nil
+}
+
+// decodeBase64 accepts both the standard and the url safe alphabets, padded
+// or not.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "=")
+	s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,194 @@
+package redsys
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	innpark "github.com/studiogenesisprojects/lib-innpark"
+)
+
+// The known answers below were computed with openssl from the Redsys test
+// environment secret, independently of this package:
+//
+//	printf '1446068581\0\0\0\0\0\0' | openssl enc -des-ede3-cbc -K <secret> -iv 0 -nopad
+//	printf '%s' <parameters> | openssl dgst -sha256 -mac HMAC -macopt hexkey:<order key> -binary | base64
+const (
+	testSecret   = "sq7HjrUOBfKmC576ILgskD5srU870gJ7"
+	testOrder    = "1446068581"
+	testOrderKey = "decaf4a139d22921434c30c18e0431af"
+
+	// {"Ds_Date":"20%2F10%2F2026","Ds_Hour":"12%3A30","Ds_Amount":"1250",
+	// "Ds_Currency":"978","Ds_Order":"1446068581","Ds_MerchantCode":"999008881",
+	// "Ds_Terminal":"001","Ds_Response":"0000","Ds_MerchantData":"a+b%20c",
+	// "Ds_SecurePayment":"1","Ds_TransactionType":"0","Ds_AuthorisationCode":"123456"}
+	testParameters = "eyJEc19EYXRlIjoiMjAlMkYxMCUyRjIwMjYiLCJEc19Ib3VyIjoiMTIlM0EzMCIsIkRzX0Ftb3VudCI6IjEyNTAiLCJEc19DdXJyZW5jeSI6Ijk3OCIsIkRzX09yZGVyIjoiMTQ0NjA2ODU4MSIsIkRzX01lcmNoYW50Q29kZSI6Ijk5OTAwODg4MSIsIkRzX1Rlcm1pbmFsIjoiMDAxIiwiRHNfUmVzcG9uc2UiOiIwMDAwIiwiRHNfTWVyY2hhbnREYXRhIjoiYStiJTIwYyIsIkRzX1NlY3VyZVBheW1lbnQiOiIxIiwiRHNfVHJhbnNhY3Rpb25UeXBlIjoiMCIsIkRzX0F1dGhvcmlzYXRpb25Db2RlIjoiMTIzNDU2In0="
+	testSignature  = "G76kByK6hvMqq5PrD-avG5sR8nUQXCX2sL43sSjWNGA="
+)
+
+func TestOrderKey(t *testing.T) {
+	key, err := orderKey(testSecret, testOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(key); got != testOrderKey {
+		t.Errorf("got %s, want %s", got, testOrderKey)
+	}
+
+	if _, err := orderKey("not base64!", testOrder); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("invalid secret: got %v, want ErrInvalidSecret", err)
+	}
+	if _, err := orderKey("c2hvcnQ=", testOrder); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("short secret: got %v, want ErrInvalidSecret", err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	signature, err := Sign(testSecret, testOrder, testParameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != testSignature {
+		t.Errorf("got %s, want %s", signature, testSignature)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	standard := strings.NewReplacer("-", "+", "_", "/").Replace(testSignature)
+
+	for name, signature := range map[string]string{
+		"url safe":          testSignature,
+		"url safe unpadded": strings.TrimRight(testSignature, "="),
+		"standard":          standard,
+	} {
+		notification, err := Verify(testSecret, testParameters, signature)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if notification.Order != testOrder || notification.Amount != 1250 || notification.Response != 0 {
+			t.Errorf("%s: got %+v", name, notification)
+		}
+	}
+
+	notification, err := Verify(testSecret, testParameters, testSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.Outcome != OUTCOME_AUTHORIZED || !notification.SecurePayment || notification.AuthorisationCode != "123456" {
+		t.Errorf("got %+v", notification)
+	}
+	if want := time.Date(2026, 10, 20, 12, 30, 0, 0, innpark.Madrid); !notification.Date.Equal(want) {
+		t.Errorf("date: got %s, want %s", notification.Date, want)
+	}
+	// '+' is not a space in the percent encoding Redsys uses
+	if notification.MerchantData != "a+b c" {
+		t.Errorf("merchant data: got %q, want %q", notification.MerchantData, "a+b c")
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	tampered, err := EncodeParameters(map[string]string{
+		"Ds_Order":    testOrder,
+		"Ds_Amount":   "1",
+		"Ds_Response": "0000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		secret     string
+		parameters string
+		signature  string
+	}{
+		"tampered parameters": {testSecret, tampered, testSignature},
+		"tampered signature":  {testSecret, testParameters, "A" + testSignature[1:]},
+		"other secret":        {"YW5vdGhlcjI0Ynl0ZXNlY3JldGtleSEh", testParameters, testSignature},
+		"empty signature":     {testSecret, testParameters, ""},
+		"garbage signature":   {testSecret, testParameters, "%%%"},
+	}
+	for name, test := range tests {
+		if _, err := Verify(test.secret, test.parameters, test.signature); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: got %v, want ErrInvalidSignature", name, err)
+		}
+	}
+
+	if _, err := Verify(testSecret, "not base64!", testSignature); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("invalid parameters: got %v, want ErrInvalidParameters", err)
+	}
+	withoutOrder, _ := EncodeParameters(map[string]string{"Ds_Response": "0000"})
+	if _, err := Verify(testSecret, withoutOrder, testSignature); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("missing order: got %v, want ErrInvalidParameters", err)
+	}
+}
+
+func TestDecodeParameters(t *testing.T) {
+	encoded, err := EncodeParameters(map[string]string{
+		"Ds_MerchantData": "a+b%20c%2Bd",
+		"Ds_Date":         "20%2F10%2F2026",
+		"Ds_Malformed":    "100%",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parameters, err := DecodeParameters(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Ds_MerchantData": "a+b c+d",
+		"Ds_Date":         "20/10/2026",
+		"Ds_Malformed":    "100%",
+	}
+	for key, value := range want {
+		if parameters[key] != value {
+			t.Errorf("%s: got %q, want %q", key, parameters[key], value)
+		}
+	}
+}
+
+func TestOutcomeOf(t *testing.T) {
+	tests := map[int]Outcome{
+		0:    OUTCOME_AUTHORIZED,
+		99:   OUTCOME_AUTHORIZED,
+		900:  OUTCOME_CONFIRMED,
+		400:  OUTCOME_CANCELLED,
+		9915: OUTCOME_USER_CANCELLED,
+		102:  OUTCOME_FRAUD,
+		202:  OUTCOME_FRAUD,
+		208:  OUTCOME_FRAUD,
+		209:  OUTCOME_FRAUD,
+		290:  OUTCOME_FRAUD,
+		100:  OUTCOME_DENIED,
+		101:  OUTCOME_DENIED,
+		180:  OUTCOME_DENIED,
+		299:  OUTCOME_DENIED,
+		300:  OUTCOME_ERROR,
+		913:  OUTCOME_ERROR,
+		9104: OUTCOME_ERROR,
+		-1:   OUTCOME_ERROR,
+	}
+	for response, want := range tests {
+		if got := OutcomeOf(response); got != want {
+			t.Errorf("%04d: got %s, want %s", response, got, want)
+		}
+	}
+
+	for outcome, approved := range map[Outcome]bool{
+		OUTCOME_AUTHORIZED:     true,
+		OUTCOME_CONFIRMED:      true,
+		OUTCOME_CANCELLED:      true,
+		OUTCOME_DENIED:         false,
+		OUTCOME_FRAUD:          false,
+		OUTCOME_USER_CANCELLED: false,
+		OUTCOME_ERROR:          false,
+	} {
+		if outcome.Approved() != approved {
+			t.Errorf("%s: got approved %t, want %t", outcome, !approved, approved)
+		}
+	}
+}
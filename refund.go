@@ -0,0 +1,375 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const REFUND_LEDGER_COLLECTION = "refund_ledger"
+
+var (
+	// ErrRefundExceedsCaptured is returned, before any upstream call, for
+	// refunds above what is left to refund of what was captured.
+	ErrRefundExceedsCaptured = errors.New("innpark: refund exceeds the captured amount")
+	// ErrInvalidRefundAmount is returned for refunds of a negative amount,
+	// or of no amount to the partial refund endpoint.
+	ErrInvalidRefundAmount = errors.New("innpark: invalid refund amount")
+	// ErrNoRefundLedger is returned by the ledger reads of a client
+	// configured without a RefundLedger.
+	ErrNoRefundLedger = errors.New("innpark: no refund ledger configured")
+)
+
+// Refund is a refund issued on a payable. Amount is in cents; zero refunds
+// everything still refundable. Reason and Operator are only recorded in the
+// RefundLedger.
+type Refund struct {
+	Amount   int
+	Reason   string
+	Operator string
+}
+
+// RefundEntry is a refund recorded in the RefundLedger.
+type RefundEntry struct {
+	Id        string
+	PayableId string
+	// Amount is zero for full refunds sent without a PaymentStateStore,
+	// which nothing tells the amount of.
+	Amount int
+	// Full is set for refunds of everything left, sent to the refund
+	// endpoint rather than the partial one.
+	Full           bool
+	Reason         string
+	Operator       string
+	IdempotencyKey string
+	Outcome        LedgerOutcome
+	Error          string
+	Created        time.Time
+}
+
+// RefundLedger records every refund issued on a payable, keyed by payable,
+// and its upstream outcome.
+type RefundLedger = Ledger[RefundEntry]
+
+// IssueRefund refunds refund.Amount of the payable, or everything left when
+// it is zero. Refunds above RefundableAmount are rejected before reaching
+// the payment API; as only the PaymentStateStore knows what was captured, a
+// client without one sends them unchecked. With a RefundLedger, the refund
+// is recorded with its reason and operator too. The payee gives the breakdown
+// of partial refunds as in CreateService and may be nil.
+func (c *Client) IssueRefund(ctx context.Context, payable Payable, payee Payee, refund Refund) error {
+	if refund.Amount < 0 {
+		return fmt.Errorf("%w: refunding %d of payable %s", ErrInvalidRefundAmount, refund.Amount, payable.GetId())
+	}
+
+	if refund.Amount == 0 {
+		return c.refund(ctx, payable, payee, refund, "RefundPayment")
+	}
+	return c.refund(ctx, payable, payee, refund, "RefundPartialPaymentFromService")
+}
+
+// RefundableAmount returns how much of the payable, in cents, can still be
+// refunded: what its payment captured minus the refunds that were, or may
+// have been, applied. Payments captured before the PaymentStateStore was
+// set up count as captured for the amount of the payable.
+func (c *Client) RefundableAmount(ctx context.Context, payable Payable) (int, error) {
+	store := c.config.PaymentStateStore
+	if store == nil {
+		return 0, ErrNoPaymentStateStore
+	}
+
+	history, err := store.History(ctx, payable.GetId())
+	if err != nil {
+		return 0, err
+	}
+	entries, err := c.refundEntries(ctx, payable.GetId())
+	if err != nil {
+		return 0, err
+	}
+	captured, err := capturedAmountOf(payable, history)
+	if err != nil {
+		return 0, err
+	}
+
+	return refundableAmountOf(captured, history, entries), nil
+}
+
+// GetRefunds returns the refunds recorded for the payable, oldest first.
+func (c *Client) GetRefunds(ctx context.Context, payableId string) ([]RefundEntry, error) {
+	ledger := c.config.RefundLedger
+	if ledger == nil {
+		return nil, ErrNoRefundLedger
+	}
+	return ledger.Entries(ctx, payableId)
+}
+
+// ResolveRefund settles a pending or unknown refund once its outcome is
+// known, e.g. from the payment API: applied keeps it counted against
+// RefundableAmount, otherwise it is marked failed and its amount can be
+// refunded again. The payment transition the refund left pending, if any,
+// is resolved with it, see ResolvePaymentTransition.
+func (c *Client) ResolveRefund(ctx context.Context, payableId string, entryId string, applied bool) error {
+	ledger := c.config.RefundLedger
+	if ledger == nil {
+		return ErrNoRefundLedger
+	}
+
+	entries, err := ledger.Entries(ctx, payableId)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(entries, func(entry RefundEntry) bool { return entry.Id == entryId })
+	if i < 0 {
+		return fmt.Errorf("%w: refund %s of payable %s", ErrNotFound, entryId, payableId)
+	}
+	entry := entries[i]
+	if !entry.Outcome.Uncertain() {
+		return fmt.Errorf("%w: refund %s of payable %s is %s", ErrConflict, entryId, payableId, entry.Outcome)
+	}
+
+	if store := c.config.PaymentStateStore; store != nil {
+		last, err := store.Last(ctx, payableId)
+		if err != nil {
+			return err
+		}
+		if last.Pending && last.IdempotencyKey == entry.IdempotencyKey {
+			if err := c.ResolvePaymentTransition(ctx, payableId, applied, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	if applied {
+		return ledger.Settle(ctx, entryId, LEDGER_OUTCOME_APPLIED, "")
+	}
+	return ledger.Settle(ctx, entryId, LEDGER_OUTCOME_FAILED, entry.Error)
+}
+
+func (c *Client) refundEntries(ctx context.Context, payableId string) ([]RefundEntry, error) {
+	if c.config.RefundLedger == nil {
+		return nil, nil
+	}
+	return c.config.RefundLedger.Entries(ctx, payableId)
+}
+
+// capturedAmountOf returns what the payment of the payable captured, read
+// from its history. Payments captured before the PaymentStateStore was set
+// up have no history, or one that starts with a refund, and are taken as
+// captured for the amount of the payable.
+func capturedAmountOf(payable Payable, history []PaymentTransition) (int, error) {
+	if len(history) == 0 || history[0].From == PAYMENT_STATE_UNKNOWN && isRefundState(history[0].To) {
+		return amountOf(payable)
+	}
+
+	captured := 0
+	for _, transition := range history {
+		if transition.To == PAYMENT_STATE_CAPTURED && !transition.Pending {
+			captured = transition.Amount
+		}
+	}
+	return captured, nil
+}
+
+// refundableAmountOf subtracts from captured what was refunded, read from
+// both the refund transitions and the entries of the ledger, whichever is
+// larger. Pending and unknown refunds count as applied so they cannot be
+// refunded twice.
+func refundableAmountOf(captured int, history []PaymentTransition, entries []RefundEntry) int {
+	refunded, recorded := 0, 0
+	for _, transition := range history {
+		if isRefundState(transition.To) {
+			refunded += transition.Amount
+		}
+	}
+	for _, entry := range entries {
+		if entry.Outcome != LEDGER_OUTCOME_FAILED {
+			recorded += entry.Amount
+		}
+	}
+	return max(captured-max(refunded, recorded), 0)
+}
+
+func (c *Client) refund(ctx context.Context, payable Payable, payee Payee, refund Refund, operation string) error {
+	key, ok := IdempotencyKeyFromContext(ctx)
+	if !ok {
+		key = NewIdempotencyKey()
+		ctx = WithIdempotencyKey(ctx, key)
+	}
+
+	full := refund.Amount == 0
+	ledger := c.config.RefundLedger
+
+	// without a PaymentStateStore nothing tells what was captured, so the
+	// refund is sent unchecked
+	amount, to := refund.Amount, PAYMENT_STATE_UNKNOWN
+	if store := c.config.PaymentStateStore; store != nil {
+		history, err := store.History(ctx, payable.GetId())
+		if err != nil {
+			return err
+		}
+		entries, err := c.refundEntries(ctx, payable.GetId())
+		if err != nil {
+			return err
+		}
+
+		// a retry of the last refund is let through so the idempotency
+		// store can replay it, without checking or recording it again;
+		// while it is pending, it fails without reaching upstream
+		if n := len(history); n > 0 && history[n-1].IdempotencyKey == key && history[n-1].Operation == operation {
+			last := history[n-1]
+			err := c.sendRefund(ctx, payable, payee, operation, last.To, last.Amount, full)
+			for _, entry := range entries {
+				if ledger != nil && !last.Pending && entry.IdempotencyKey == key && entry.Outcome.Uncertain() && !errors.Is(err, ErrIdempotencyKeyInFlight) {
+					settleLedgerEntry(c, ctx, ledger, entry.Id, err, "payable_id", payable.GetId())
+				}
+			}
+			return err
+		}
+
+		captured, err := capturedAmountOf(payable, history)
+		if err != nil {
+			return err
+		}
+		refundable := refundableAmountOf(captured, history, entries)
+		if full {
+			amount = refundable
+		}
+		if amount <= 0 || amount > refundable {
+			return fmt.Errorf("%w: refunding %d of %d left of payable %s", ErrRefundExceedsCaptured, amount, refundable, payable.GetId())
+		}
+		to = refundStateOf(amount, refundable)
+	}
+
+	// concurrent refunds both get here, the payment transition lets a
+	// single one through
+	call := func(ctx context.Context) error {
+		return c.sendRefund(ctx, payable, payee, operation, to, amount, full)
+	}
+	if ledger == nil {
+		return call(ctx)
+	}
+
+	entry := RefundEntry{
+		PayableId:      payable.GetId(),
+		Amount:         amount,
+		Full:           full,
+		Reason:         refund.Reason,
+		Operator:       refund.Operator,
+		IdempotencyKey: key,
+		Outcome:        LEDGER_OUTCOME_PENDING,
+	}
+	return appendAndCall(c, ctx, ledger, entry, call, "payable_id", payable.GetId())
+}
+
+// sendRefund moves the payment to the state to, refunding amount, through
+// the refund endpoint when full and the partial one otherwise.
+func (c *Client) sendRefund(ctx context.Context, payable Payable, payee Payee, operation string, to PaymentState, amount int, full bool) error {
+	if full {
+		return c.transitionPayment(ctx, payable.GetId(), operation, to, amount, func(ctx context.Context) (string, error) {
+			r, err := c.makeRequest(ctx, operation, "POST", fmt.Sprintf("%s/v1/services/%s/payments/refund", c.config.PaymentURL, payable.GetId()), EmptyRequest{})
+			return paymentIdOf(r), err
+		})
+	}
+
+	breakdown, err := c.taxBreakdown(ctx, amount, payee, payable)
+	if err != nil {
+		return err
+	}
+
+	request := RefundPartialRequest{
+		Amount:    amount,
+		Breakdown: breakdown,
+	}
+	return c.transitionPayment(ctx, payable.GetId(), operation, to, amount, func(ctx context.Context) (string, error) {
+		r, err := c.makeRequest(ctx, operation, "POST", fmt.Sprintf("%s/v1/services/%s/payments/refund-partial-amount", c.config.PaymentURL, payable.GetId()), request)
+		return paymentIdOf(r), err
+	})
+}
+
+func isRefundState(state PaymentState) bool {
+	return state == PAYMENT_STATE_PARTIALLY_REFUNDED || state == PAYMENT_STATE_REFUNDED
+}
+
+// refundStateOf returns the state a refund of amount leaves the payment in.
+func refundStateOf(amount int, refundable int) PaymentState {
+	if amount >= refundable {
+		return PAYMENT_STATE_REFUNDED
+	}
+	return PAYMENT_STATE_PARTIALLY_REFUNDED
+}
+
+type pocketBaseRefundLedger struct {
+	pocketBaseLedger
+}
+
+// NewPocketBaseRefundLedger returns a RefundLedger backed by the
+// REFUND_LEDGER_COLLECTION, creating the collection if needed.
+func NewPocketBaseRefundLedger(app core.App) (RefundLedger, error) {
+	err := ensureCollection(app, REFUND_LEDGER_COLLECTION,
+		ledgerFields(
+			textField("payable_id", true),
+			numberField("amount"),
+			boolField("full"),
+			textField("reason", false),
+			textField("operator", false),
+		),
+		"CREATE INDEX idx_refund_ledger_payable ON "+REFUND_LEDGER_COLLECTION+" (payable_id)",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pocketBaseRefundLedger{pocketBaseLedger{app: app, collection: REFUND_LEDGER_COLLECTION}}, nil
+}
+
+func (l *pocketBaseRefundLedger) Append(ctx context.Context, entry RefundEntry) (string, error) {
+	collection, err := l.app.Dao().FindCollectionByNameOrId(REFUND_LEDGER_COLLECTION)
+	if err != nil {
+		return "", err
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("payable_id", entry.PayableId)
+	record.Set("amount", entry.Amount)
+	record.Set("full", entry.Full)
+	record.Set("reason", entry.Reason)
+	record.Set("operator", entry.Operator)
+	record.Set("idempotency_key", entry.IdempotencyKey)
+	record.Set("outcome", string(entry.Outcome))
+	record.Set("error", entry.Error)
+	if err := l.app.Dao().SaveRecord(record); err != nil {
+		return "", err
+	}
+
+	return record.Id, nil
+}
+
+func (l *pocketBaseRefundLedger) Entries(ctx context.Context, payableId string) ([]RefundEntry, error) {
+	records, err := l.app.Dao().FindRecordsByFilter(REFUND_LEDGER_COLLECTION, "payable_id = {:id}", "created", 0, 0, dbx.Params{"id": payableId})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]RefundEntry, 0, len(records))
+	for _, record := range records {
+		entries = append(entries, RefundEntry{
+			Id:             record.Id,
+			PayableId:      record.GetString("payable_id"),
+			Amount:         record.GetInt("amount"),
+			Full:           record.GetBool("full"),
+			Reason:         record.GetString("reason"),
+			Operator:       record.GetString("operator"),
+			IdempotencyKey: record.GetString("idempotency_key"),
+			Outcome:        LedgerOutcome(record.GetString("outcome")),
+			Error:          record.GetString("error"),
+			Created:        record.GetDateTime("created").Time(),
+		})
+	}
+	return entries, nil
+}
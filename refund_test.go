@@ -0,0 +1,263 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryRefundLedger struct {
+	mu      sync.Mutex
+	entries []RefundEntry
+}
+
+func (l *memoryRefundLedger) Append(ctx context.Context, entry RefundEntry) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.Id = fmt.Sprint(len(l.entries) + 1)
+	entry.Created = time.Now()
+	l.entries = append(l.entries, entry)
+	return entry.Id, nil
+}
+
+func (l *memoryRefundLedger) Settle(ctx context.Context, id string, outcome LedgerOutcome, message string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.entries {
+		if l.entries[i].Id == id {
+			l.entries[i].Outcome, l.entries[i].Error = outcome, message
+		}
+	}
+	return nil
+}
+
+func (l *memoryRefundLedger) Entries(ctx context.Context, payableId string) ([]RefundEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var entries []RefundEntry
+	for _, entry := range l.entries {
+		if entry.PayableId == payableId {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func requireRefundable(t *testing.T, c *Client, payable Payable, want int) {
+	t.Helper()
+	refundable, err := c.RefundableAmount(context.Background(), payable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refundable != want {
+		t.Errorf("refundable: got %d, want %d", refundable, want)
+	}
+}
+
+func TestRefundRequiresCapture(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+
+	if err := c.RecordPaymentState(ctx, payable.id, PAYMENT_STATE_PREAUTHORIZED, "CreatePayment", "pay1", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Cents(100)); !errors.Is(err, ErrRefundExceedsCaptured) {
+		t.Errorf("preauthorized payable: got %v, want ErrRefundExceedsCaptured", err)
+	}
+
+	if err := c.CancelPreautorhization(ctx, payable); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RefundPayment(ctx, payable); !errors.Is(err, ErrRefundExceedsCaptured) {
+		t.Errorf("cancelled payable: got %v, want ErrRefundExceedsCaptured", err)
+	}
+
+	if calls := server.count("refund") + server.count("refund-partial-amount"); calls != 0 {
+		t.Errorf("refunds reached upstream %d times", calls)
+	}
+}
+
+func TestRefundUntrackedPayment(t *testing.T) {
+	server, c, _ := newPaymentServer(t, Config{})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+
+	// payments from before the state store are taken as captured in full
+	requireRefundable(t, c, payable, 1000)
+	if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Cents(1200)); !errors.Is(err, ErrRefundExceedsCaptured) {
+		t.Errorf("refund over the amount: got %v, want ErrRefundExceedsCaptured", err)
+	}
+	if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Cents(400)); err != nil {
+		t.Fatal(err)
+	}
+	requireRefundable(t, c, payable, 600)
+	if err := c.RefundPayment(ctx, payable); err != nil {
+		t.Fatal(err)
+	}
+	requireRefundable(t, c, payable, 0)
+	requireState(t, c, payable.id, PAYMENT_STATE_REFUNDED)
+
+	// without a state store nothing tells what was captured, refunds are
+	// sent unchecked
+	unchecked := NewClient(Config{PaymentURL: c.config.PaymentURL})
+	if err := unchecked.RefundPartialPaymentFromService(ctx, payable, nil, Cents(5000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := unchecked.RefundPayment(ctx, payable); err != nil {
+		t.Fatal(err)
+	}
+	if partial, full := server.count("refund-partial-amount"), server.count("refund"); partial != 2 || full != 2 {
+		t.Errorf("got %d partial and %d full refunds upstream, want 2 of each", partial, full)
+	}
+}
+
+func TestRefundInvalidAmount(t *testing.T) {
+	_, c, _ := newPaymentServer(t, Config{})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+
+	for _, amount := range []int{0, -100} {
+		if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Cents(amount)); !errors.Is(err, ErrInvalidRefundAmount) {
+			t.Errorf("partial refund of %d: got %v, want ErrInvalidRefundAmount", amount, err)
+		}
+	}
+	if err := c.IssueRefund(ctx, payable, nil, Refund{Amount: -1}); !errors.Is(err, ErrInvalidRefundAmount) {
+		t.Errorf("negative refund: got %v, want ErrInvalidRefundAmount", err)
+	}
+}
+
+func TestRefundableAmount(t *testing.T) {
+	ledger := &memoryRefundLedger{}
+	server, c, _ := newPaymentServer(t, Config{RefundLedger: ledger})
+	ctx := context.Background()
+
+	if err := c.RecordPaymentState(ctx, "p1", PAYMENT_STATE_PREAUTHORIZED, "CreatePayment", "pay1", 2500); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConfirmPreautorhization(ctx, testPayable{id: "p1", amount: 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit is what was captured, whatever the payable says now
+	payable := testPayable{id: "p1", amount: 5000}
+	requireRefundable(t, c, payable, 1000)
+
+	if err := c.IssueRefund(ctx, payable, nil, Refund{Amount: 300, Reason: "disputed stay", Operator: "support"}); err != nil {
+		t.Fatal(err)
+	}
+	requireRefundable(t, c, payable, 700)
+	requireState(t, c, payable.id, PAYMENT_STATE_PARTIALLY_REFUNDED)
+
+	if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Cents(800)); !errors.Is(err, ErrRefundExceedsCaptured) {
+		t.Errorf("over-refund: got %v, want ErrRefundExceedsCaptured", err)
+	}
+
+	if err := c.RefundPayment(ctx, payable); err != nil {
+		t.Fatal(err)
+	}
+	requireRefundable(t, c, payable, 0)
+	requireState(t, c, payable.id, PAYMENT_STATE_REFUNDED)
+
+	if err := c.RefundPayment(ctx, payable); !errors.Is(err, ErrRefundExceedsCaptured) {
+		t.Errorf("second full refund: got %v, want ErrRefundExceedsCaptured", err)
+	}
+
+	refunds, err := c.GetRefunds(ctx, payable.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 2 || refunds[0].Amount != 300 || refunds[0].Reason != "disputed stay" || refunds[1].Amount != 700 || !refunds[1].Full {
+		t.Errorf("got %+v", refunds)
+	}
+	for _, refund := range refunds {
+		if refund.Outcome != LEDGER_OUTCOME_APPLIED {
+			t.Errorf("refund %s: got %s, want applied", refund.Id, refund.Outcome)
+		}
+	}
+	if server.count("refund-partial-amount") != 1 || server.count("refund") != 1 {
+		t.Errorf("got %d partial and %d full refunds upstream, want 1 and 1", server.count("refund-partial-amount"), server.count("refund"))
+	}
+}
+
+func TestResolveRefund(t *testing.T) {
+	ledger := &memoryRefundLedger{}
+	server, c, _ := newPaymentServer(t, Config{RefundLedger: ledger})
+	ctx := context.Background()
+	payable := testPayable{id: "p1", amount: 1000}
+
+	if err := c.RecordPaymentState(ctx, payable.id, PAYMENT_STATE_CAPTURED, "CreatePayment", "pay1", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	server.statuses["refund-partial-amount"] = http.StatusInternalServerError
+	if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Cents(400)); err == nil {
+		t.Fatal("failed refund succeeded")
+	}
+	refunds, _ := c.GetRefunds(ctx, payable.id)
+	if len(refunds) != 1 || refunds[0].Outcome != LEDGER_OUTCOME_UNKNOWN {
+		t.Fatalf("got %+v, want an unknown refund", refunds)
+	}
+	// it may have been applied, so it cannot be refunded again yet
+	requireRefundable(t, c, payable, 600)
+
+	if err := c.ResolveRefund(ctx, payable.id, refunds[0].Id, false); err != nil {
+		t.Fatal(err)
+	}
+	requireRefundable(t, c, payable, 1000)
+	requireState(t, c, payable.id, PAYMENT_STATE_CAPTURED)
+
+	if err := c.ResolveRefund(ctx, payable.id, refunds[0].Id, true); !errors.Is(err, ErrConflict) {
+		t.Errorf("resolving twice: got %v, want ErrConflict", err)
+	}
+	if err := c.ResolveRefund(ctx, payable.id, "missing", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing refund: got %v, want ErrNotFound", err)
+	}
+
+	if err := c.RefundPartialPaymentFromService(ctx, payable, nil, Cents(400)); err == nil {
+		t.Fatal("failed refund succeeded")
+	}
+	refunds, _ = c.GetRefunds(ctx, payable.id)
+	if err := c.ResolveRefund(ctx, payable.id, refunds[1].Id, true); err != nil {
+		t.Fatal(err)
+	}
+	requireRefundable(t, c, payable, 600)
+	requireState(t, c, payable.id, PAYMENT_STATE_PARTIALLY_REFUNDED)
+}
+
+func TestRefundRetryWhilePending(t *testing.T) {
+	ledger := &memoryRefundLedger{}
+	server, c, _ := newPaymentServer(t, Config{RefundLedger: ledger})
+	ctx := WithIdempotencyKey(context.Background(), "refund-1")
+	payable := testPayable{id: "p1", amount: 1000}
+
+	if err := c.RecordPaymentState(context.Background(), payable.id, PAYMENT_STATE_CAPTURED, "CreatePayment", "pay1", 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	server.statuses["refund"] = http.StatusBadGateway
+	if err := c.RefundPayment(ctx, payable); err == nil {
+		t.Fatal("failed refund succeeded")
+	}
+
+	delete(server.statuses, "refund")
+	if err := c.RefundPayment(ctx, payable); !errors.Is(err, ErrPaymentTransitionPending) {
+		t.Errorf("retry while pending: got %v, want ErrPaymentTransitionPending", err)
+	}
+	if calls := server.count("refund"); calls != 1 {
+		t.Errorf("refund reached upstream %d times, want 1", calls)
+	}
+
+	refunds, _ := c.GetRefunds(ctx, payable.id)
+	if len(refunds) != 1 || refunds[0].Outcome != LEDGER_OUTCOME_UNKNOWN {
+		t.Fatalf("got %+v, want a single unknown refund", refunds)
+	}
+	if err := c.ResolveRefund(ctx, payable.id, refunds[0].Id, true); err != nil {
+		t.Fatal(err)
+	}
+	requireState(t, c, payable.id, PAYMENT_STATE_REFUNDED)
+}
@@ -0,0 +1,115 @@
+package innpark
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+const instrumentationName = "github.com/studiogenesisprojects/lib-innpark"
+
+// telemetry holds the instruments every backend call reports to.
+type telemetry struct {
+	tracer       trace.Tracer
+	propagator   propagation.TextMapPropagator
+	callDuration metric.Float64Histogram
+	callErrors   metric.Int64Counter
+}
+
+func newTelemetry(config Config) telemetry {
+	tracerProvider := config.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = tracenoop.NewTracerProvider()
+	}
+	meterProvider := config.MeterProvider
+	if meterProvider == nil {
+		meterProvider = metricnoop.NewMeterProvider()
+	}
+	propagator := config.Propagator
+	if propagator == nil {
+		propagator = propagation.NewCompositeTextMapPropagator()
+	}
+
+	meter := meterProvider.Meter(instrumentationName)
+
+	// instrument creation only fails on invalid names, which are constant
+	callDuration, _ := meter.Float64Histogram("innpark.client.call.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Duration of calls to the innpark backends, retries included."))
+	callErrors, _ := meter.Int64Counter("innpark.client.call.errors",
+		metric.WithDescription("Failed calls to the innpark backends."))
+
+	return telemetry{
+		tracer:       tracerProvider.Tracer(instrumentationName),
+		propagator:   propagator,
+		callDuration: callDuration,
+		callErrors:   callErrors,
+	}
+}
+
+// startCall starts the span of a backend call and logs it. The returned
+// function ends the span, records the call metrics and logs the outcome: it
+// must be called exactly once with the error of the call.
+//
+// Log levels are the same for every backend: Debug for the start and
+// completion of a call, Warn for upstream and transport failures and Error
+// for responses that could not be decoded.
+func (c *Client) startCall(ctx context.Context, service Backend, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	attrs := []attribute.KeyValue{
+		attribute.String("innpark.backend", string(service)),
+		attribute.String("innpark.operation", operation),
+	}
+
+	ctx, span := c.tracer.Start(ctx, string(service)+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+
+	logger := c.logger.With("backend", string(service), "operation", operation)
+	logger.DebugContext(ctx, "request started")
+
+	return ctx, func(err error) {
+		duration := time.Since(start)
+
+		if err == nil {
+			logger.DebugContext(ctx, "request completed", "duration", duration)
+		} else {
+			errorType := "error"
+			var apiErr *APIError
+			if errors.As(err, &apiErr) && apiErr.StatusCode != 0 {
+				errorType = strconv.Itoa(apiErr.StatusCode)
+				span.SetAttributes(attribute.Int("http.response.status_code", apiErr.StatusCode))
+			} else if errors.Is(err, ErrCircuitOpen) {
+				errorType = "circuit_open"
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				errorType = "timeout"
+			}
+			attrs = append(attrs, attribute.String("error.type", errorType))
+
+			// the error text holds request URLs, plates included, so the
+			// tracing backend gets it redacted like the logs
+			message := c.redactor.redactText(err.Error())
+			span.RecordError(errors.New(message))
+			span.SetStatus(codes.Error, message)
+			c.callErrors.Add(ctx, 1, metric.WithAttributes(attrs...))
+
+			if apiErr != nil && apiErr.StatusCode >= 200 && apiErr.StatusCode < 300 {
+				logger.ErrorContext(ctx, "error decoding response", "duration", duration, "error", err)
+			} else {
+				logger.WarnContext(ctx, "request failed", "duration", duration, "error_type", errorType, "error", err)
+			}
+		}
+
+		c.callDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(attrs...))
+		span.End()
+	}
+}
@@ -0,0 +1,53 @@
+package innpark
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSpanErrorsAreRedacted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"unknown plate 1234BCD"}`))
+	}))
+	defer server.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	c := NewClient(Config{
+		OnstreetURL:    server.URL,
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+
+	if _, err := c.GetPlateLists(context.Background(), "1234 BCD", time.Now()); err == nil {
+		t.Fatal("failing lookup succeeded")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Status().Code != codes.Error || !strings.Contains(span.Status().Description, REDACTED) {
+		t.Errorf("got status %+v, want a redacted error", span.Status())
+	}
+
+	texts := []string{span.Status().Description}
+	for _, event := range span.Events() {
+		for _, attr := range event.Attributes {
+			texts = append(texts, attr.Value.Emit())
+		}
+	}
+	for _, text := range texts {
+		if strings.Contains(text, "1234BCD") || strings.Contains(text, "1234+BCD") {
+			t.Errorf("span leaks the plate: %s", text)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package innpark
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// DefaultTimeouts bounds each backend call, retries included, when
+// Config.Timeouts does not say otherwise.
+var DefaultTimeouts = map[Backend]time.Duration{
+	BACKEND_ONSTREET:  10 * time.Second,
+	BACKEND_OFFSTREET: 10 * time.Second,
+	BACKEND_PAYMENT:   30 * time.Second,
+	BACKEND_NOVU:      20 * time.Second,
+}
+
+// RetryPolicy configures exponential backoff with full jitter. Only
+// idempotent requests are retried, and only on transport errors and
+// 408/425/429/5xx responses.
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts, 1 disables retries
+	BaseDelay   time.Duration // delay before the first retry, doubled on each one
+	MaxDelay    time.Duration // upper bound for any single delay, Retry-After included
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+}
+
+func newPooledTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 20
+	return transport
+}
+
+type noRetryKey struct{}
+
+// withoutRetries marks the requests made with ctx as unsafe to repeat, for
+// upstream endpoints that mutate state behind a GET.
+func withoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// retryTransport retries idempotent requests on the base round tripper.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+	// keyedPaths are the path patterns of the mutations known to
+	// deduplicate on the idempotency key, see Config.IdempotentEndpoints.
+	keyedPaths []string
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := t.policy.MaxAttempts
+	if attempts < 1 || !t.isIdempotent(req) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 {
+			r = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+
+		response, err := t.base.RoundTrip(r)
+		if attempt >= attempts || req.Context().Err() != nil {
+			return response, err
+		}
+
+		var delay time.Duration
+		switch {
+		case err != nil:
+			delay = t.backoff(attempt)
+		case isRetryableStatus(response.StatusCode):
+			delay = t.backoff(attempt)
+			if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+				delay = min(retryAfter, t.policy.MaxDelay)
+			}
+			io.Copy(io.Discard, io.LimitReader(response.Body, maxErrorBodySize))
+			response.Body.Close()
+		default:
+			return response, nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random delay in [0, BaseDelay*2^(attempt-1)], capped at
+// MaxDelay.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	ceiling := t.policy.BaseDelay << (attempt - 1)
+	if ceiling <= 0 || ceiling > t.policy.MaxDelay {
+		ceiling = t.policy.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// isIdempotent reports whether the request is safe to repeat: its method is
+// idempotent, or it carries an idempotency key for an endpoint known to
+// honour it. Sending a key alone does not make a mutation retryable.
+func (t *retryTransport) isIdempotent(req *http.Request) bool {
+	if noRetry, _ := req.Context().Value(noRetryKey{}).(bool); noRetry {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if req.Header.Get(IDEMPOTENCY_KEY_HEADER) == "" {
+		return false
+	}
+	for _, pattern := range t.keyedPaths {
+		if ok, _ := path.Match(pattern, req.URL.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter accepts both the delay-seconds and HTTP-date forms.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// doJSON sends an authenticated request to the given backend and decodes a
+// 200 response into out, when out is not nil. A *json.RawMessage out
+// receives the body as is. operation names the call in traces and metrics.
+func (c *Client) doJSON(ctx context.Context, service Backend, operation string, method string, url string, body io.Reader, out any) (err error) {
+	ctx, end := c.startCall(ctx, service, operation)
+	defer func() { end(err) }()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	c.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if token := c.authorizationFor(service); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		req.Header.Set(IDEMPOTENCY_KEY_HEADER, key)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := c.httpClients[service].Do(req)
+	if err != nil {
+		return newRequestError(service, req, 0, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return newResponseError(service, response)
+	}
+
+	// reading the whole body also lets the connection be reused
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return newRequestError(service, req, response.StatusCode, err)
+	}
+
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *json.RawMessage:
+		*out = responseBody
+		return nil
+	}
+
+	if err := json.Unmarshal(responseBody, out); err != nil {
+		return newRequestError(service, req, response.StatusCode, err)
+	}
+	return nil
+}
+
+// jsonBody marshals a request struct into a body doJSON can send and the
+// retry transport can replay.
+func jsonBody(request any) (io.Reader, error) {
+	j, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(j), nil
+}
+
+func (c *Client) authorizationFor(service Backend) string {
+	switch service {
+	case BACKEND_ONSTREET:
+		return c.config.OnstreetToken
+	case BACKEND_PAYMENT:
+		return c.config.PaymentToken
+	case BACKEND_NOVU:
+		return "ApiKey " + c.config.NovuToken
+	}
+	return ""
+}
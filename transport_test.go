@@ -0,0 +1,67 @@
+package innpark
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransportMutations(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		key        bool
+		noRetry    bool
+		keyedPaths []string
+		want       int32
+	}{
+		{name: "get", method: "GET", path: "/v1/parkings", want: 3},
+		{name: "get without retries", method: "GET", path: "/v1/subscriptions/decrement-free-bag-seconds", noRetry: true, want: 1},
+		{name: "post", method: "POST", path: "/v1/services/create", want: 1},
+		{name: "post with key", method: "POST", path: "/v1/services/s1/payments/create", key: true, want: 1},
+		{name: "post with key to allowed endpoint", method: "POST", path: "/v1/services/s1/payments/create", key: true, keyedPaths: []string{"/v1/services/*/payments/create"}, want: 3},
+		{name: "post without key to allowed endpoint", method: "POST", path: "/v1/services/s1/payments/create", keyedPaths: []string{"/v1/services/*/payments/create"}, want: 1},
+		{name: "patch with key to other endpoint", method: "PATCH", path: "/v1/services/s1/update", key: true, keyedPaths: []string{"/v1/services/*/payments/create"}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			transport := &retryTransport{
+				base:       http.DefaultTransport,
+				policy:     RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+				keyedPaths: tt.keyedPaths,
+			}
+
+			ctx := context.Background()
+			if tt.noRetry {
+				ctx = withoutRetries(ctx)
+			}
+			req, _ := http.NewRequestWithContext(ctx, tt.method, server.URL+tt.path, http.NoBody)
+			if tt.key {
+				req.Header.Set(IDEMPOTENCY_KEY_HEADER, "key")
+			}
+
+			response, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if got := calls.Load(); got != tt.want {
+				t.Errorf("got %d attempts, want %d", got, tt.want)
+			}
+		})
+	}
+}
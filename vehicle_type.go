@@ -0,0 +1,106 @@
+package innpark
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/studiogenesisprojects/lib-innpark/plate"
+)
+
+// VehicleType is the kind of vehicle a list, pass, tariff or parking
+// applies to. The zero VehicleType means any vehicle.
+type VehicleType string
+
+const (
+	VEHICLE_TYPE_CAR       VehicleType = "CAR"
+	VEHICLE_TYPE_MOTORBIKE VehicleType = "MOTORBIKE"
+	VEHICLE_TYPE_VAN       VehicleType = "VAN"
+	VEHICLE_TYPE_TRUCK     VehicleType = "TRUCK"
+	VEHICLE_TYPE_EV        VehicleType = "EV"
+	VEHICLE_TYPE_MOPED     VehicleType = "MOPED"
+)
+
+var ErrInvalidVehicleType = errors.New("innpark: invalid vehicle type")
+
+// VehicleTypes lists every known vehicle type.
+var VehicleTypes = []VehicleType{
+	VEHICLE_TYPE_CAR,
+	VEHICLE_TYPE_MOTORBIKE,
+	VEHICLE_TYPE_VAN,
+	VEHICLE_TYPE_TRUCK,
+	VEHICLE_TYPE_EV,
+	VEHICLE_TYPE_MOPED,
+}
+
+// ParseVehicleType parses a vehicle type case insensitively. An empty string
+// parses to the zero VehicleType.
+func ParseVehicleType(s string) (VehicleType, error) {
+	t := VehicleType(strings.ToUpper(strings.TrimSpace(s)))
+	if t != "" && !t.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrInvalidVehicleType, s)
+	}
+	return t, nil
+}
+
+// Valid reports whether the type is one of the known vehicle types.
+func (t VehicleType) Valid() bool {
+	switch t {
+	case VEHICLE_TYPE_CAR, VEHICLE_TYPE_MOTORBIKE, VEHICLE_TYPE_VAN, VEHICLE_TYPE_TRUCK, VEHICLE_TYPE_EV, VEHICLE_TYPE_MOPED:
+		return true
+	}
+	return false
+}
+
+func (t VehicleType) String() string {
+	return string(t)
+}
+
+// Matches reports whether something restricted to t applies to a vehicle of
+// the given type. The zero VehicleType matches every type.
+func (t VehicleType) Matches(vehicleType VehicleType) bool {
+	return t == "" || t == vehicleType
+}
+
+func (t VehicleType) MarshalText() ([]byte, error) {
+	return []byte(t), nil
+}
+
+// UnmarshalText accepts any type, upper cased, so the types upstream adds
+// after this library, e.g. "BUS", do not fail whole responses. Such types
+// are not Valid and only match themselves.
+func (t *VehicleType) UnmarshalText(text []byte) error {
+	*t = VehicleType(strings.ToUpper(strings.TrimSpace(string(text))))
+	return nil
+}
+
+// InferVehicleType returns the vehicle type the plate format implies, or the
+// zero VehicleType when it does not tell. Only moped plates do, see
+// plate.Kind.
+func InferVehicleType(vehiclePlate string) VehicleType {
+	if plate.InferKind(vehiclePlate) == plate.KIND_MOPED {
+		return VEHICLE_TYPE_MOPED
+	}
+	return ""
+}
+
+// VehicleTyped is implemented by the values restricted to a vehicle type.
+type VehicleTyped interface {
+	GetVehicleType() VehicleType
+}
+
+// FilterByVehicleType returns the items that apply to vehicles of the given
+// type, unrestricted items included. The zero VehicleType returns them all.
+func FilterByVehicleType[T VehicleTyped](items []T, vehicleType VehicleType) []T {
+	if vehicleType == "" {
+		return items
+	}
+
+	filtered := make([]T, 0, len(items))
+	for _, item := range items {
+		if item.GetVehicleType().Matches(vehicleType) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
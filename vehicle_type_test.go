@@ -0,0 +1,59 @@
+package innpark
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestVehicleTypeJSON(t *testing.T) {
+	var parking Parking
+	if err := json.Unmarshal([]byte(`{"id":"p1","vehicle_types":["car","BUS"]}`), &parking); err != nil {
+		t.Fatal(err)
+	}
+	if len(parking.VehicleTypes) != 2 || parking.VehicleTypes[0] != VEHICLE_TYPE_CAR || parking.VehicleTypes[1] != "BUS" {
+		t.Fatalf("got %q", parking.VehicleTypes)
+	}
+	if parking.VehicleTypes[1].Valid() {
+		t.Error("an unknown type is valid")
+	}
+	if !parking.Admits("BUS") || parking.Admits(VEHICLE_TYPE_VAN) {
+		t.Error("unknown types must only admit themselves")
+	}
+
+	raw, err := json.Marshal(parking.VehicleTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `["CAR","BUS"]` {
+		t.Errorf("got %s", raw)
+	}
+}
+
+func TestParseVehicleType(t *testing.T) {
+	if got, err := ParseVehicleType(" moped "); err != nil || got != VEHICLE_TYPE_MOPED {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if got, err := ParseVehicleType(""); err != nil || got != "" {
+		t.Errorf("empty: got %q, %v", got, err)
+	}
+	if _, err := ParseVehicleType("BUS"); !errors.Is(err, ErrInvalidVehicleType) {
+		t.Errorf("unknown: got %v, want ErrInvalidVehicleType", err)
+	}
+}
+
+func TestFilterByVehicleType(t *testing.T) {
+	tariffs := []Tariff{
+		{Id: "any"},
+		{Id: "car", VehicleType: VEHICLE_TYPE_CAR},
+		{Id: "moped", VehicleType: VEHICLE_TYPE_MOPED},
+	}
+
+	got := FilterByVehicleType(tariffs, VEHICLE_TYPE_CAR)
+	if len(got) != 2 || got[0].Id != "any" || got[1].Id != "car" {
+		t.Errorf("got %v", got)
+	}
+	if got := FilterByVehicleType(tariffs, ""); len(got) != 3 {
+		t.Errorf("zero type: got %d tariffs, want them all", len(got))
+	}
+}